@@ -1,6 +1,7 @@
 import { apis } from "@/apis/http"
 
-type TypeStatus = "0" | "1" | "2"
+// 0 待发送 1 已发送 2 撤回中 3 已撤回 4 定时发送 5 发送中 6 已取消 7 发送失败
+type TypeStatus = "0" | "1" | "2" | "3" | "4" | "5" | "6" | "7"
 
 export interface IBroadcast {
   avatar_url: string
@@ -12,14 +13,261 @@ export interface IBroadcast {
   status: TypeStatus
   user_id: string
   top_at: string
+  send_at?: string
   is_top: boolean
 }
 
+export interface IMessageStat {
+  message_id: string
+  distributed_count: number
+  delivered_count: number
+  read_count: number
+  pending_count: number
+  delivery_rate: string
+  read_rate: string
+  updated_at: string
+  // delivered_count and read_count are HyperLogLog estimates
+  approximate: boolean
+}
+
 export const ApiGetBroadcastList = (): Promise<IBroadcast[]> =>
   apis.get(`/broadcast`)
 
 export const ApiPostBroadcast = (data: string): Promise<boolean> =>
   apis.post(`/broadcast`, { data })
 
+// 已发送的公告会被撤回，还没有发送的定时公告会被取消
 export const ApiGetBroadcastRecall = (broadcast_id: string): Promise<boolean> =>
   apis.delete(`/broadcast/${broadcast_id}`)
+
+// 公告的目标成员，所有条件同时满足，为空发给所有成员
+export interface IBroadcastSegment {
+  status?: number[]
+  pay_status?: number[]
+  joined_after?: string
+  joined_before?: string
+  active_after?: string
+  active_before?: string
+  asset_id?: string
+  asset_amount?: string
+  user_ids?: string[]
+}
+
+// 预览目标成员的数量，按持币筛选时 pending 为 true，稍后用同样的条件再次请求
+export const ApiPostBroadcastPreview = (segment: IBroadcastSegment): Promise<{ count: number, pending: boolean }> =>
+  apis.post(`/broadcast/preview`, segment)
+
+export const ApiPostSegmentBroadcast = (data: string, segment: IBroadcastSegment): Promise<boolean> =>
+  apis.post(`/broadcast`, { data, segment })
+
+// 按成员替换公告中的 {name} {level} {expired_at} {invite_code} {group}，user_id 为空时按自己预览
+export const ApiPostTemplatePreview = (data: string, user_id?: string): Promise<{ data: string }> =>
+  apis.post(`/broadcast/template/preview`, { data, user_id })
+
+export interface IScheduledBroadcast {
+  message_id?: string
+  category?: string
+  data: string
+  send_at: string
+  segment?: IBroadcastSegment
+  status?: number
+  created_by?: string
+  created_at?: string
+}
+
+// 定时公告，到 send_at 之后自动发送
+export const ApiPostScheduledBroadcast = (b: IScheduledBroadcast): Promise<IScheduledBroadcast> =>
+  apis.post(`/broadcast`, b)
+
+export const ApiGetScheduledBroadcastList = (): Promise<IScheduledBroadcast[]> =>
+  apis.get(`/broadcast/scheduled`)
+
+export const ApiPutScheduledBroadcast = (broadcast_id: string, b: IScheduledBroadcast): Promise<boolean> =>
+  apis.put(`/broadcast/${broadcast_id}`, b)
+
+export const ApiGetMessageStat = (message_id: string): Promise<IMessageStat> =>
+  apis.get(`/message/stat/${message_id}`)
+
+export interface IMessageRedeliver {
+  redeliver_id?: string
+  message_id: string
+  audience: "all" | "status" | "missed" | "users"
+  status?: number
+  user_ids?: string[]
+  state?: number
+  total?: number
+  sent?: number
+  error?: string
+  created_at?: string
+  updated_at?: string
+}
+
+// 重新投递 / 补发历史消息
+export const ApiPostMessageRedeliver = (redeliver: IMessageRedeliver): Promise<IMessageRedeliver> =>
+  apis.post(`/message/redeliver`, redeliver)
+
+export const ApiGetMessageRedeliverList = (): Promise<IMessageRedeliver[]> =>
+  apis.get(`/message/redeliver`)
+
+export const ApiGetMessageRedeliver = (redeliver_id: string): Promise<IMessageRedeliver> =>
+  apis.get(`/message/redeliver/${redeliver_id}`)
+
+export interface IMessageSearchResult {
+  message_id: string
+  user_id: string
+  full_name: string
+  avatar_url: string
+  category: string
+  content: string
+  created_at: string
+}
+
+export interface IMessageSearchParams {
+  q: string
+  page?: number
+  user_id?: string
+  category?: string
+  start?: string
+  end?: string
+}
+
+// 搜索自己收到过的消息
+export const ApiGetMessageSearch = (q: string, page = 1): Promise<IMessageSearchResult[]> =>
+  apis.get(`/message/search`, { q, page })
+
+// 管理员搜索所有消息
+export const ApiGetMessageSearchAll = (params: IMessageSearchParams): Promise<IMessageSearchResult[]> =>
+  apis.get(`/message/search/all`, params)
+
+export interface IMessageExport {
+  export_id?: string
+  format: "jsonl" | "csv" | "html"
+  start_at: string
+  end_at: string
+  state?: number
+  count?: number
+  size?: number
+  file_name?: string
+  error?: string
+  created_at?: string
+  updated_at?: string
+}
+
+// 导出聊天记录，完成后通过 /message/export/:id/download 下载
+export const ApiPostMessageExport = (e: IMessageExport): Promise<IMessageExport> =>
+  apis.post(`/message/export`, e)
+
+export const ApiGetMessageExportList = (): Promise<IMessageExport[]> =>
+  apis.get(`/message/export`)
+
+export const ApiGetMessageExport = (export_id: string): Promise<IMessageExport> =>
+  apis.get(`/message/export/${export_id}`)
+
+export interface IHistoryMessage {
+  message_id: string
+  user_id: string
+  full_name: string
+  avatar_url: string
+  category: string
+  data: string
+  quote_message_id?: string
+  pinned?: boolean
+  created_at: string
+}
+
+export interface IMessageHistory {
+  messages: IHistoryMessage[]
+  before?: string
+  after?: string
+}
+
+export interface IMessageHistoryParams {
+  before?: string
+  after?: string
+  around?: string
+  unread?: boolean
+  limit?: number
+}
+
+// 分页查看历史消息，按时间从旧到新排列，before / after 为继续翻页的游标
+export const ApiGetMessageHistory = (params: IMessageHistoryParams = {}): Promise<IMessageHistory> =>
+  apis.get(`/message/history`, params)
+
+export interface IRecurringBroadcast {
+  recurring_id?: string
+  category?: string
+  data: string
+  cron: string
+  timezone: string
+  end_at?: string
+  // 1 生效 2 暂停 3 已结束
+  status?: number
+  next_at?: string
+  last_at?: string
+  created_by?: string
+  created_at?: string
+}
+
+// 没有选择时区时使用浏览器的时区
+const withTimezone = (b: IRecurringBroadcast): IRecurringBroadcast => ({
+  ...b,
+  timezone: b.timezone || Intl.DateTimeFormat().resolvedOptions().timeZone,
+})
+
+// 周期公告，按 cron 表达式和时区生成定时公告
+export const ApiPostRecurringBroadcast = (b: IRecurringBroadcast): Promise<IRecurringBroadcast> =>
+  apis.post(`/broadcast/recurring`, withTimezone(b))
+
+export const ApiGetRecurringBroadcastList = (): Promise<IRecurringBroadcast[]> =>
+  apis.get(`/broadcast/recurring`)
+
+export const ApiPutRecurringBroadcast = (recurring_id: string, b: IRecurringBroadcast): Promise<IRecurringBroadcast> =>
+  apis.put(`/broadcast/recurring/${recurring_id}`, withTimezone(b))
+
+// 1 恢复 2 暂停 3 结束
+export const ApiPutRecurringBroadcastStatus = (recurring_id: string, status: number): Promise<IRecurringBroadcast> =>
+  apis.put(`/broadcast/recurring/${recurring_id}/status`, { status })
+
+export const ApiGetRecurringBroadcastHistory = (recurring_id: string): Promise<IScheduledBroadcast[]> =>
+  apis.get(`/broadcast/recurring/${recurring_id}/history`)
+
+export interface IOwnerClient {
+  client_id: string
+  name: string
+  lang: string
+}
+
+export interface IMultiBroadcast {
+  multi_id?: string
+  category?: string
+  data: string
+  // 按社群语言的内容，没有对应语言时使用 data
+  variants?: Record<string, string>
+  client_ids: string[]
+  send_at?: string
+  created_at?: string
+}
+
+export interface IMultiBroadcastReport extends IMultiBroadcast {
+  clients: {
+    client_id: string
+    name: string
+    message_id: string
+    status: number
+    stat: IMessageStat
+  }[]
+  total: IMessageStat
+}
+
+// 跨社群公告，只有社群的创建者可以使用
+export const ApiGetMultiBroadcastClients = (): Promise<IOwnerClient[]> =>
+  apis.get(`/broadcast/multi/clients`)
+
+export const ApiPostMultiBroadcast = (b: IMultiBroadcast): Promise<IMultiBroadcast> =>
+  apis.post(`/broadcast/multi`, b)
+
+export const ApiGetMultiBroadcastList = (): Promise<IMultiBroadcast[]> =>
+  apis.get(`/broadcast/multi`)
+
+export const ApiGetMultiBroadcastReport = (multi_id: string): Promise<IMultiBroadcastReport> =>
+  apis.get(`/broadcast/multi/${multi_id}`)
@@ -28,6 +28,7 @@ export interface IUser {
 
   is_claim?: boolean
   is_block?: boolean
+  tier?: IMemberTier
 }
 
 export interface IAdvanceSetting {
@@ -46,6 +47,23 @@ export const ApiPostChatStatus =
     is_notice_join
   })
 
+export interface IUserDelivery {
+  delivery_mode: number // 1 实时 2 每小时摘要 3 每天摘要 4 只接收管理员消息
+  timezone: string
+  quiet_start: number // 当天的第几分钟
+  quiet_end: number
+  digest_at?: string
+}
+
+// 获取 / 修改 消息接收方式
+export const ApiGetUserDelivery = (): Promise<IUserDelivery> => apis.get(`/user/delivery`)
+export const ApiPutUserDelivery = (delivery: IUserDelivery): Promise<IUserDelivery> =>
+  apis.put(`/user/delivery`, delivery)
+
+// 获取 / 修改 希望收到的消息语言，为空不翻译
+export const ApiGetUserLang = (): Promise<{ lang: string }> => apis.get(`/user/lang`)
+export const ApiPutUserLang = (lang: string): Promise<{ lang: string }> => apis.put(`/user/lang`, { lang })
+
 export const ApiGetGroupUsers = (status = "", search = "") =>
   apis.get(`/groupUsers/${getGroupID()}`, { status, search })
 
@@ -127,3 +145,85 @@ export const ApiGetGroupMemberAuth = (): Promise<IGroupMemberAuthResp> =>
   apis.get(`/group/member/auth`)
 export const ApiPutGroupMemberAuth = (auth: IGroupMemberAuth) => apis.put(`/group/member/auth`, auth)
 
+
+export interface IDeliveryTier {
+  tier_index?: number
+  name: string
+  priority: number[]
+  status: number[]
+  is_paid: boolean
+  active_days: number
+  delay: number
+}
+
+// 获取 / 修改 分发梯队
+export const ApiGetGroupDeliveryTier = (): Promise<IDeliveryTier[]> =>
+  apis.get(`/group/delivery/tier`)
+export const ApiPutGroupDeliveryTier = (tiers: IDeliveryTier[]) => apis.put(`/group/delivery/tier`, tiers)
+
+export interface IBlazeStatus {
+  client_id: string
+  state: "connecting" | "connected" | "disconnected" | ""
+  connected_at: string
+  disconnected_at: string
+  last_message_at: string
+  updated_at: string
+  reconnects: number
+  backoff: number
+  last_error: string
+  alert?: string
+}
+
+// 获取机器人 blaze 连接状态
+export const ApiGetBlazeStatus = (): Promise<IBlazeStatus> => apis.get(`/blaze/status`)
+
+export interface IGroupRetention {
+  mapping_days: number
+  messages_days: number
+  distribute_days: number
+  live_replay_days: number
+  login_log_days: number
+  snapshots_days: number
+  updated_at?: string
+}
+
+// 获取 / 修改 社群数据的保存天数，0 表示一直保存
+export const ApiGetGroupRetention = (): Promise<IGroupRetention> => apis.get(`/group/retention`)
+export const ApiPutGroupRetention = (retention: IGroupRetention) => apis.put(`/group/retention`, retention)
+
+// 0 不补发 1 最近 N 条 2 未读消息 3 置顶和公告 4 摘要
+export interface IGroupCatchupPolicy {
+  join_policy: number
+  return_policy: number
+  latest_count: number
+  max_count: number
+  updated_at?: string
+}
+
+// 获取 / 修改 新成员入群和失活成员重新激活时补发消息的方式
+export const ApiGetGroupCatchupPolicy = (): Promise<IGroupCatchupPolicy> => apis.get(`/group/catchup`)
+export const ApiPutGroupCatchupPolicy = (policy: IGroupCatchupPolicy) => apis.put(`/group/catchup`, policy)
+
+// 计算持仓等级时使用的持仓来源和权重，available 为已注册的持仓来源
+export interface IGroupHoldingProvider {
+  provider: string
+  weight: string
+}
+
+export const ApiGetGroupHoldingProviders = (): Promise<{ available: string[]; providers: IGroupHoldingProvider[] }> =>
+  apis.get(`/group/holding`)
+export const ApiPutGroupHoldingProviders = (providers: IGroupHoldingProvider[]) => apis.put(`/group/holding`, providers)
+
+export interface IMemberTier {
+  level: number
+  name: string
+  amount: string
+  usd_amount: string
+  price: string
+  duration: number
+  msg_limit: number
+  permissions: { [category: string]: boolean }
+}
+
+export const ApiGetGroupTiers = (): Promise<IMemberTier[]> => apis.get(`/group/tiers`)
+export const ApiPutGroupTiers = (tiers: IMemberTier[]) => apis.put(`/group/tiers`, tiers)
@@ -35,6 +35,15 @@ const _i18n = {
       content:
         "Stop receiving group messages, not affect group announcements, all-important news will be sent by announcement!<br /> Enter the numbers below in order to confirm the operation.",
     },
+    delivery: {
+      title: "Message delivery",
+      mode: "Delivery mode",
+      modes: ["Real time", "Hourly digest", "Daily digest", "Admin messages only"],
+      digestTips: "Digests are sent by the bot in one message. Announcements are always sent right away.",
+      quiet: "Quiet hours",
+      quietTips: "Messages during quiet hours are sent as a digest when they end. Recalls and pins are still sent. Leave start and end equal to turn quiet hours off.",
+      timezone: "Timezone",
+    },
     exited: "Group quited",
     exitedDesc:
       "You have successfully exited the group, all data related to your account has been deleted, click the top right corner to close the page, hope you are back soon!",
@@ -141,6 +150,11 @@ const _i18n = {
       "1-Receive all chat messages,1-Participate in grabbing Lucky Coin,1-Send chat messages,1-Send 20 messages per minute,1-You could send 9 types of messages/ such as text",
     level5Sub: "You could send 9 types of messages, and send 10 to 20 messages per minute.",
 
+    tierSub: "Periodically check your wallet position; your membership level depends on your holdings: {levels}.",
+    tierDesc:
+      "1-Receive all chat messages,1-Participate in grabbing Lucky Coin,1-Send chat messages,1-Send {limit} messages per minute,1-You could send {category} types of messages",
+    tierPay:
+      "Pay {amount} {symbol} to get {level} for {days} days. You could send {category} types of messages, with a sending limitation of {limit} messages per minute.",
     upgrade: "Upgrade Membership",
     levelPay:
       "Pay {amount} {symbol} to get 1-year {level}. You could send {category} types of messages, such as text, with a sending limitation of {min} to {max} messages per minute.",
@@ -35,6 +35,15 @@ const _i18n = {
       content:
         "コミュニティチャットの受信を停止しても、重要なプロジェクトのアナウンスはすべて掲載されます。<br />以下の数字を順番に入力して、操作を確定してください。",
     },
+    delivery: {
+      title: "メッセージの受信方法",
+      mode: "受信方法",
+      modes: ["リアルタイム", "1時間ごとのまとめ", "1日ごとのまとめ", "管理者のメッセージのみ"],
+      digestTips: "まとめはボットから1通のメッセージで届きます。アナウンスは常にすぐに届きます。",
+      quiet: "おやすみ時間",
+      quietTips: "おやすみ時間中のメッセージは終了後にまとめて届きます。取り消しとピン留めは通常どおり届きます。開始と終了を同じにするとオフになります。",
+      timezone: "タイムゾーン",
+    },
     exited: "コミュニティから退会しました",
     exitedDesc:
       "コミュニティから退会しました。また、あなたのアカウントに関するデータはすべて削除されました。右上をクリックしてコミュニティページを閉じてください。",
@@ -141,6 +150,11 @@ const _i18n = {
       "1-全てのチャットを受信することができます,1-ラッキーコインに参加することができます,1-チャットに参加するためにメッセージを送信することができます,1-1分間に20メッセージを送信することができます,1-テキストを含む9種類のメッセージを送信することができます。",
     level5Sub: "テキストを含む9種類のメッセージを送信でき、1分間に10〜20通の送信が可能です。",
 
+    tierSub: "定期的にウォレットの保有資産を確認し、保有量に応じてメンバーシップのレベルが決まります：{levels}。",
+    tierDesc:
+      "1-全てのチャットを受信することができます,1-ラッキーコインに参加することができます,1-チャットに参加するためにメッセージを送信することができます,1-1分間に{limit}メッセージを送信することができます,1-{category}種類のメッセージを送信することができます。",
+    tierPay:
+      "{amount} {symbol}を支払って{days}日分の{level}を取得でき、{category}種類のメッセージを送信でき、1分間に{limit}通のメッセージの送信が可能です。",
     upgrade: "メンバーシップのアップグレード",
     levelPay:
       "{amount} {symbol}を支払って1年分の{level}を取得でき、テキストなど{category}のメッセージを送信でき、1分間に{min}～{max}通のメッセージの送信が可能です。",
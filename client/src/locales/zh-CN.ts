@@ -38,6 +38,15 @@ const _i18n = {
       content:
         "停止接收社群聊天仍然可以收到公告，所有重要的项目动态都会发公告！<br /> 依次输入下方数字确认操作。",
     },
+    delivery: {
+      title: "消息接收方式",
+      mode: "接收方式",
+      modes: ["实时接收", "每小时摘要", "每天摘要", "只接收管理员消息"],
+      digestTips: "摘要由机器人合并成一条消息发送，公告始终实时发送。",
+      quiet: "免打扰时间",
+      quietTips: "免打扰时间内的消息在结束后合并成摘要发送，撤回和置顶照常发送。开始和结束时间相同表示关闭。",
+      timezone: "时区",
+    },
     exited: "社群已退出",
     exitedDesc:
       "你已成功退出社群，你账户相关的数据均已删除，点右上角关闭社群页面即可，欢迎再来！",
@@ -144,6 +153,9 @@ const _i18n = {
       "1-接受全部聊天记录,1-参与抢红包,1-发消息参与聊天,1-每分钟发 20 条消息,1-可发文字等 9 种消息类型",
     level5Sub: "可发文字等 9 种消息类型，每分钟可发 10～20 条消息。",
 
+    tierSub: "定期检查钱包持仓，按持仓获得对应的会员等级：{levels}。",
+    tierDesc: "1-接受全部聊天记录,1-参与抢红包,1-发消息参与聊天,1-每分钟发 {limit} 条消息,1-可发 {category} 种消息类型",
+    tierPay: "付费 {amount} {symbol} 获得 {days} 天{level}，可发 {category} 种类型消息，每分钟可发 {limit} 条消息。",
     upgrade: "升级会员",
     levelPay:
       "付费 {amount} {symbol} 获得 1 年{level}，可发文字等 {category} 种类型消息，每分钟可发 {min}～{max} 条消息。",
@@ -8,7 +8,7 @@ import { Button, ToastSuccess } from '@/components/Sub'
 import { get$t } from '@/locales/tools'
 import { useIntl } from 'umi'
 import { $get } from '@/stores/localStorage'
-import { ApiGetMe, IUser } from '@/apis/user'
+import { ApiGetGroupTiers, ApiGetMe, IMemberTier, IUser } from '@/apis/user'
 import moment from 'moment'
 import { getAuthUrl, payUrl } from '@/apis/http'
 import { ApiGetGroupVipAmount, IGroupInfo, IVipAmount } from '@/apis/group'
@@ -35,17 +35,23 @@ export default function Page() {
   const [vipAmount, setVipAmount] = useState<IVipAmount>()
   const [payLoading, setPayLoading] = useState(false)
   const [isLoaded, setIsLoaded] = useState(false)
+  const [tiers, setTiers] = useState<IMemberTier[]>([])
   const group: IGroupInfo = $get('group')
   if (!group.asset_id) {
     group.asset_id = '4d8c508b-91c5-375b-92b0-ee702ed2dac5'
     group.symbol = 'USDT'
   }
+  // 社群设置了自定义等级时，按等级显示和付费
+  const isTier = tiers.length > 0
+  const payTiers = tiers.filter(t => Number(t.price) > 0 && t.level >= (u?.tier?.level || 0))
+  const payAmount = (status: number) =>
+    isTier ? tiers.find(t => t.level === status)?.price : getPayAmount(status, vipAmount)
 
   useEffect(() => {
     changeTheme('#4A4A4D')
     ApiGetMe().then(u => {
       setUser(u)
-      if (u.status === 2) {
+      if (u.status === 2 && !u.tier) {
         setSelectList([5])
         setSelectStatus(5)
       }
@@ -56,6 +62,7 @@ export default function Page() {
       setIsLoaded(true)
     })
     ApiGetGroupVipAmount().then(setVipAmount)
+    ApiGetGroupTiers().then(t => setTiers(t || []))
     return () => {
       changeTheme('#fff')
     }
@@ -63,7 +70,8 @@ export default function Page() {
 
   const clickPay = async () => {
     const trace = getUUID()
-    const amount = getPayAmount(selectStatus, vipAmount)
+    const amount = payAmount(selectStatus)
+    const expiredAt = u?.pay_expired_at
     const asset = group.asset_id
     const recipient = group.client_id
     location.href = payUrl({
@@ -80,10 +88,11 @@ export default function Page() {
     if (t === 'paid') {
       while (true) {
         const u = await ApiGetMe()
-        if (u.pay_status === selectStatus) {
+        // 等级续费时 pay_status 不变，按到期时间判断
+        if (isTier ? u.pay_expired_at !== expiredAt : u.pay_status === selectStatus) {
           setPayLoading(false)
           setUser(u)
-          if (u.status === 2) {
+          if (u.status === 2 && !u.tier) {
             setSelectList([5])
             setSelectStatus(5)
           }
@@ -105,9 +114,11 @@ export default function Page() {
           <div className={`${styles.tip1} ${styles.tip}`} dangerouslySetInnerHTML={{ __html: $t('member.authTips') }} />
         )}
         <div className={styles.foot}>
-          {(!u?.status || (u?.status <= 2)) && (
+          {(isTier ? payTiers.length > 0 : (!u?.status || (u?.status <= 2))) && (
             <Button onClick={() => {
-              if (isPay(u!)) {
+              if (isTier) {
+                setSelectStatus(0)
+              } else if (isPay(u!)) {
                 setShowNext(true)
                 setSelectStatus(5)
               }
@@ -141,7 +152,7 @@ export default function Page() {
             {showNext ? (
               <>
                 {/* 确认验证模式 */}
-                <MemberCard showMode={selectStatus} $t={$t} />
+                <MemberCard showMode={selectStatus} tier={tiers.find(t => t.level === selectStatus)} $t={$t} />
                 {selectStatus === 0 && (
                   <div className={styles.tip} dangerouslySetInnerHTML={{ __html: $t('member.authTips') }} />
                 )}
@@ -153,7 +164,7 @@ export default function Page() {
                   ) : (
                     <Button className={styles.pay} onClick={() => clickPay()}>
                       {$t('member.forPay', {
-                        amount: getPayAmount(selectStatus, vipAmount),
+                        amount: payAmount(selectStatus),
                         symbol: group.symbol,
                       })}
                     </Button>
@@ -169,14 +180,38 @@ export default function Page() {
                 >
                   <div className={styles.title}>{$t(`member.level${0}`)}</div>
                   <div className={styles.intro}>
-                    {$t(`member.level${0}Sub`, {
+                    {isTier ? $t('member.tierSub', {
+                      levels: tiers
+                        .filter(t => Number(t.amount) > 0 || Number(t.usd_amount) > 0)
+                        .map(t => `${t.name} ${Number(t.amount) > 0 ? `${formatNumber(t.amount)} ${group?.symbol}` : `${formatNumber(t.usd_amount)} USD`}`)
+                        .join(', '),
+                    }) : $t(`member.level${0}Sub`, {
                       lamount: formatNumber(group?.amount),
                       hamount: formatNumber(group?.large_amount),
                       symbol: group?.symbol,
                     })}
                   </div>
                 </div>
-                {group.asset_id &&
+                {isTier && payTiers.map((t, index) => (
+                  <div
+                    key={t.level}
+                    className={`${styles.desc} ${styles[`desc${index === payTiers.length - 1 ? 5 : 2}`]} ${selectStatus === t.level && styles.active}`}
+                    onClick={() => setSelectStatus(t.level)}
+                  >
+                    <div className={styles.title}>{t.name}</div>
+                    <div className={styles.price}>
+                      {$t(`member.tierPay`, {
+                        amount: formatNumber(t.price),
+                        symbol: group?.symbol,
+                        days: t.duration,
+                        level: t.name,
+                        category: countPermissions(t),
+                        limit: t.msg_limit,
+                      })}
+                    </div>
+                  </div>
+                ))}
+                {!isTier && group.asset_id &&
                   selectList.map((item) => (
                     <div
                       key={item}
@@ -252,17 +287,24 @@ const formatNumber = (num?: number | string) => {
 const isPay = (u: IUser) =>
   u.pay_expired_at && new Date(u.pay_expired_at) > new Date()
 
+const countPermissions = (t: IMemberTier) =>
+  Object.values(t.permissions || {}).filter(Boolean).length
+
 interface IMemberPros {
   user?: IUser
   showMode?: number
+  tier?: IMemberTier
   $t?: any
 }
 
 const MemberCard = (props: IMemberPros) => {
   const { user, $t, showMode } = props
+  const tier = props.tier || user?.tier
   let sub = '',
     _status = 2
-  if (user && !user.status) {
+  if (tier) {
+    _status = tier.level > 1 ? 5 : 2
+  } else if (user && !user.status) {
     _status = 1
   } else if (user) {
     let { pay_expired_at, status } = user
@@ -274,9 +316,10 @@ const MemberCard = (props: IMemberPros) => {
     _status = showMode
     if (_status !== 0) sub = 'Pay'
   }
-  const data: { label: string; isCheck: boolean }[] = $t(
-    `member.level${_status}Desc`,
-  )
+  const data: { label: string; isCheck: boolean }[] = (tier ? $t(`member.tierDesc`, {
+    limit: tier.msg_limit,
+    category: countPermissions(tier),
+  }) : $t(`member.level${_status}Desc`))
     .split(',')
     .map((item: string) => {
       const [isCheck, label] = item.split('-')
@@ -291,7 +334,7 @@ const MemberCard = (props: IMemberPros) => {
       className={`${styles.memberCard} ${showMode && styles.memberCardShort}`}
     >
       <div className={styles.cardHead}>
-        <div>{$t(`member.level${_status}${sub}`)}</div>
+        <div>{tier ? tier.name : $t(`member.level${_status}${sub}`)}</div>
         {_status !== 1 && (
           <img
             className={styles.cardHeadIcon}
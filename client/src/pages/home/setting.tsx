@@ -6,15 +6,38 @@ import { useIntl } from "@@/plugin-locale/localeExports"
 import { Switch } from 'antd-mobile'
 import { NumberConfirm } from "@/components/BottomkModal/number"
 import { Confirm, ToastFailed, ToastSuccess } from "@/components/Sub"
-import { ApiGetMe, ApiPostChatStatus, ApiPutUserProxy, IUser } from '@/apis/user'
+import { ApiGetMe, ApiGetUserDelivery, ApiPostChatStatus, ApiPutUserDelivery, ApiPutUserProxy, IUser, IUserDelivery } from '@/apis/user'
 import styles from './setting.less'
 import { ApiDeleteGroup } from "@/apis/group"
 import { $get, $set } from "@/stores/localStorage"
 
+// 当天的第几分钟和 input[type=time] 的 HH:mm 互相转换
+const minuteToTime = (m: number) =>
+  `${String(Math.floor(m / 60)).padStart(2, "0")}:${String(m % 60).padStart(2, "0")}`
+const timeToMinute = (t: string) => {
+  const [h, m] = t.split(":").map(Number)
+  return (h || 0) * 60 + (m || 0)
+}
+
 export default function Page() {
   const $t = get$t(useIntl())
   const [show, setShow] = useState(false)
   const [user, setUser] = useState<IUser>($get('_user'))
+  const [delivery, setDelivery] = useState<IUserDelivery>()
+
+  // 没有设置时区时使用浏览器的时区
+  const updateDelivery = async (d: Partial<IUserDelivery>) => {
+    if (!delivery) return
+    const res = await ApiPutUserDelivery({
+      ...delivery,
+      ...d,
+      timezone: delivery.timezone || Intl.DateTimeFormat().resolvedOptions().timeZone,
+    })
+    if (res && res.delivery_mode) {
+      ToastSuccess($t("success.operator"))
+      setDelivery(res)
+    }
+  }
 
   const toggleReceive = async () => {
     const res = await ApiPostChatStatus(!user?.is_received, user!.is_notice_join)
@@ -55,6 +78,7 @@ export default function Page() {
 
   useEffect(() => {
     initPage()
+    ApiGetUserDelivery().then(setDelivery)
   }, [])
 
 
@@ -82,6 +106,40 @@ export default function Page() {
             onChange={toggleNoticeJoin}
           />
         </li>
+        {delivery && <>
+          <li className={styles.formItem}>
+            <p>{$t('setting.delivery.mode')}</p>
+            <select
+              className={styles.select}
+              value={delivery.delivery_mode}
+              onChange={e => updateDelivery({ delivery_mode: Number(e.target.value) })}
+            >
+              {[1, 2, 3, 4].map(mode =>
+                <option key={mode} value={mode}>{$t(`setting.delivery.modes.${mode - 1}`)}</option>
+              )}
+            </select>
+          </li>
+          <p className={styles.desc}>{$t('setting.delivery.digestTips')}</p>
+          <li className={styles.formItem}>
+            <p>{$t('setting.delivery.quiet')}</p>
+            <div className={styles.quiet}>
+              <input
+                type="time"
+                value={minuteToTime(delivery.quiet_start)}
+                onChange={e => updateDelivery({ quiet_start: timeToMinute(e.target.value) })}
+              />
+              <span>-</span>
+              <input
+                type="time"
+                value={minuteToTime(delivery.quiet_end)}
+                onChange={e => updateDelivery({ quiet_end: timeToMinute(e.target.value) })}
+              />
+            </div>
+          </li>
+          <p className={styles.desc}>
+            {$t('setting.delivery.quietTips')} {$t('setting.delivery.timezone')}: {delivery.timezone || Intl.DateTimeFormat().resolvedOptions().timeZone}
+          </p>
+        </>}
         {/* <li className={styles.formItem}>
           <p>{$t('setting.useProxy')}</p>
           <Switch
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"os"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -23,6 +24,16 @@ const (
 	UpdateUserDeliverTime      = 30 * time.Minute
 
 	QuoteMsgSavedTime = 48 * time.Hour
+
+	BlazeBackoffMin          = time.Second
+	BlazeBackoffMax          = 5 * time.Minute
+	BlazeDisconnectAlertTime = 5 * time.Minute
+	BlazeSilentAlertTime     = 30 * time.Minute
+
+	DefaultMappingRetentionDays    = 30
+	MaxMappingRetentionDays        = 365
+	DefaultDistributeRetentionDays = 1
+	MaxRetentionDays               = 3650
 )
 
 var LangCheckPer = decimal.NewFromInt(2).Div(decimal.NewFromInt(3))
@@ -37,6 +48,28 @@ type Lottery struct {
 	SupplyID  string `json:"supply_id,omitempty"`
 	Inventory int    `json:"inventory,omitempty"`
 }
+
+// 分发消息的发送速率，按社群配置，未配置的字段使用 default 或内置默认值
+type DistributeRate struct {
+	Initial       float64 `json:"initial"`        // 初始每秒发送条数
+	Min           float64 `json:"min"`            // 最低每秒发送条数
+	Max           float64 `json:"max"`            // 最高每秒发送条数
+	Increase      float64 `json:"increase"`       // 每批发送正常后增加的速率
+	Decrease      float64 `json:"decrease"`       // 耗时过长或被限流后速率乘以的系数
+	TargetLatency int64   `json:"target_latency"` // 单批发送的目标耗时，毫秒
+	CreateLimit   int     `json:"create_limit"`   // 每分钟最多创建的分发消息数
+}
+
+var defaultDistributeRate = DistributeRate{
+	Initial:       1000,
+	Min:           100,
+	Max:           5000,
+	Increase:      50,
+	Decrease:      0.5,
+	TargetLatency: 2000,
+	CreateLimit:   100000,
+}
+
 type config struct {
 	Lang      string `json:"lang"`
 	Port      int    `json:"port"`
@@ -83,6 +116,12 @@ type config struct {
 	FoxToken     string `json:"fox_token"`
 	ExinToken    string `json:"exin_token"`
 	ExinLocalKey string `json:"exin_local_key"`
+
+	DistributeRate map[string]DistributeRate `json:"distribute_rate"`
+	SearchLanguage map[string]string         `json:"search_language"`
+
+	Translator            string                       `json:"translator"`
+	TranslationDictionary map[string]map[string]string `json:"translation_dictionary"`
 }
 
 type text struct {
@@ -139,7 +178,12 @@ type text struct {
 	MemberTips      string
 	JoinMsgInfo     string
 	PINMessageErorr string
+	CatchupSummary  string
+	History         string
 	Category        map[string]string
+	MemberLevel     map[int]string
+	PayForTier      string
+	TierTips        string
 }
 
 var Config config
@@ -147,7 +191,12 @@ var Config config
 var Text text
 
 func init() {
-	data, err := ioutil.ReadFile("config.json")
+	// 测试时工作目录是包所在的目录，通过 SUPERGROUP_CONFIG 指定配置文件
+	path := "config.json"
+	if p := os.Getenv("SUPERGROUP_CONFIG"); p != "" {
+		path = p
+	}
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Println("config.json open fail...", err)
 		return
@@ -162,3 +211,55 @@ func init() {
 		Text = en_Text
 	}
 }
+
+// 获取社群的发送速率配置，优先级：社群配置 > default 配置 > 内置默认值
+func GetDistributeRate(clientID string) DistributeRate {
+	r := defaultDistributeRate
+	for _, key := range []string{"default", clientID} {
+		c, ok := Config.DistributeRate[key]
+		if !ok {
+			continue
+		}
+		if c.Initial > 0 {
+			r.Initial = c.Initial
+		}
+		if c.Min > 0 {
+			r.Min = c.Min
+		}
+		if c.Max > 0 {
+			r.Max = c.Max
+		}
+		if c.Increase > 0 {
+			r.Increase = c.Increase
+		}
+		if c.Decrease > 0 && c.Decrease < 1 {
+			r.Decrease = c.Decrease
+		}
+		if c.TargetLatency > 0 {
+			r.TargetLatency = c.TargetLatency
+		}
+		if c.CreateLimit > 0 {
+			r.CreateLimit = c.CreateLimit
+		}
+	}
+	if r.Max < r.Min {
+		r.Max = r.Min
+	}
+	if r.Initial < r.Min {
+		r.Initial = r.Min
+	} else if r.Initial > r.Max {
+		r.Initial = r.Max
+	}
+	return r
+}
+
+// 获取社群全文搜索使用的语言，优先级：社群配置 > default 配置 > simple
+func GetSearchLanguage(clientID string) string {
+	if l := Config.SearchLanguage[clientID]; l != "" {
+		return l
+	}
+	if l := Config.SearchLanguage["default"]; l != "" {
+		return l
+	}
+	return "simple"
+}
@@ -54,6 +54,8 @@ var en_Text = text{
 	Forbid:          "【Reminder】It's not allowed to send {category} messages!",
 	BotCard:         "Bot card",
 	PINMessageErorr: "The pin message failed. Please resend the message and then perform the pin operation again.",
+	CatchupSummary:  "There are {count} messages you have not seen yet. Open the history to catch up.",
+	History:         "History",
 	Category: map[string]string{
 		"PLAIN_TEXT":     "Text",
 		"PLAIN_POST":     "Article",
@@ -67,4 +69,14 @@ var en_Text = text{
 		"PLAIN_CONTACT":  "Contact",
 		"PLAIN_AUDIO":    "Audio",
 	},
+	PayForTier: "🎉Congratulations, you are now {tier} until {expired_at}.",
+	TierTips:   "\n\n「Hint」Your level is {tier}. Higher levels can send more messages per minute and more types of messages.",
+	MemberLevel: map[int]string{
+		1: "Audience",
+		2: "Primary member",
+		3: "Senior member",
+		5: "Premium member",
+		8: "Lecturer",
+		9: "Admin",
+	},
 }
@@ -53,6 +53,8 @@ var zh_CN_Text = text{
 	JoinMsgInfo:     "你可以发文字、贴纸和红包类型的消息，每分钟 5 条消息。发广告、私信骚扰群友、引战、挑事会被禁言甚至拉黑。\n\n打开会员中心，付费或免费授权持仓检测获取会员资格，更多特权等你来领。",
 	Forbid:          "【提醒】本社群禁止发{category}消息！",
 	PINMessageErorr: "置顶消息失败，请重新发送该消息然后再进行置顶操作。",
+	CatchupSummary:  "你有 {count} 条消息还没有看到，可以在历史消息中查看。",
+	History:         "历史消息",
 	BotCard:         "机器人卡片",
 	Category: map[string]string{
 		"PLAIN_TEXT":       "文字",
@@ -68,4 +70,14 @@ var zh_CN_Text = text{
 		"PLAIN_AUDIO":      "音频",
 		"PLAIN_TRANSCRIPT": "聊天记录",
 	},
+	PayForTier: "🎉恭喜成为{tier}，有效期到 {expired_at}。",
+	TierTips:   "\n\n「小提示」你当前的等级是{tier}，等级越高每分钟发言次数越多，消息类型越丰富。",
+	MemberLevel: map[int]string{
+		1: "观众",
+		2: "初级会员",
+		3: "中级会员",
+		5: "资深会员",
+		8: "嘉宾",
+		9: "管理员",
+	},
 }
@@ -0,0 +1,113 @@
+package durable
+
+import (
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// 所有指标注册到单独的 registry，通过单独的端口输出，不和 pprof 共用
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsCollectors = struct {
+	sync.Mutex
+	list []func()
+}{}
+
+var DefaultDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// label 数量不对时只记录日志，不影响业务
+type CounterVec struct{ *prometheus.CounterVec }
+type GaugeVec struct{ *prometheus.GaugeVec }
+type HistogramVec struct{ *prometheus.HistogramVec }
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(v)
+	return &CounterVec{v}
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(v)
+	return &GaugeVec{v}
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	metricsRegistry.MustRegister(v)
+	return &HistogramVec{v}
+}
+
+// 在输出指标之前调用，用于更新需要实时查询的 gauge
+func RegisterMetricsCollector(f func()) {
+	metricsCollectors.Lock()
+	defer metricsCollectors.Unlock()
+	metricsCollectors.list = append(metricsCollectors.list, f)
+}
+
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	m, err := c.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m.Add(delta)
+}
+
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	m, err := g.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m.Set(value)
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	m, err := h.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	m.Observe(value)
+}
+
+func MetricsHandler() http.Handler {
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		metricsCollectors.Lock()
+		list := metricsCollectors.list
+		metricsCollectors.Unlock()
+		for _, f := range list {
+			f()
+		}
+		return metricsRegistry.Gather()
+	})
+	return promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+}
+
+// 只提供 /metrics 的 http 服务
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("metrics listen error...", err)
+	}
+}
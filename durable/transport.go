@@ -0,0 +1,57 @@
+package durable
+
+import (
+	"context"
+
+	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+// 机器人和 Mixin 之间的所有通信，测试时可以替换成 FakeTransport
+type Transport interface {
+	ClientID() string
+	SendMessage(ctx context.Context, msg *mixin.MessageRequest) error
+	SendMessages(ctx context.Context, msgs []*mixin.MessageRequest) error
+	// body 为 /encrypted_messages 的请求体，resp 为返回的结果
+	SendEncryptedMessages(ctx context.Context, body []map[string]interface{}, resp interface{}) error
+	ReadConversation(ctx context.Context, conversationID string) (*mixin.Conversation, error)
+	CreateConversation(ctx context.Context, input *mixin.CreateConversationInput) (*mixin.Conversation, error)
+	ReadUser(ctx context.Context, userIDOrIdentityNumber string) (*mixin.User, error)
+	UserMe(ctx context.Context) (*mixin.User, error)
+	Transfer(ctx context.Context, input *mixin.TransferInput, pin string) (*mixin.Snapshot, error)
+	Acknowledge(ctx context.Context, reqs []*bot.ReceiptAcknowledgementRequest) error
+	// 阻塞接收 blaze 消息，连接断开后返回
+	Loop(ctx context.Context, listener bot.BlazeListener) error
+}
+
+// 创建 Transport，使用 UseFakeTransport 后返回 FakeTransport
+var NewTransport = newMixinTransport
+
+type mixinTransport struct {
+	*mixin.Client
+	keystore *mixin.Keystore
+}
+
+func newMixinTransport(keystore *mixin.Keystore) (Transport, error) {
+	client, err := mixin.NewFromKeystore(keystore)
+	if err != nil {
+		return nil, err
+	}
+	return &mixinTransport{Client: client, keystore: keystore}, nil
+}
+
+func (t *mixinTransport) ClientID() string {
+	return t.Client.ClientID
+}
+
+func (t *mixinTransport) SendEncryptedMessages(ctx context.Context, body []map[string]interface{}, resp interface{}) error {
+	return t.Client.Post(ctx, "/encrypted_messages", body, resp)
+}
+
+func (t *mixinTransport) Acknowledge(ctx context.Context, reqs []*bot.ReceiptAcknowledgementRequest) error {
+	return bot.PostAcknowledgements(ctx, reqs, t.keystore.ClientID, t.keystore.SessionID, t.keystore.PrivateKey)
+}
+
+func (t *mixinTransport) Loop(ctx context.Context, listener bot.BlazeListener) error {
+	return bot.NewBlazeClient(t.keystore.ClientID, t.keystore.SessionID, t.keystore.PrivateKey).Loop(ctx, listener)
+}
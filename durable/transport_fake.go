@@ -0,0 +1,216 @@
+package durable
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/gofrs/uuid"
+)
+
+// 内存中的 Transport，记录所有发出的请求，并可以向 blaze 推送消息
+type FakeTransport struct {
+	mutex    sync.Mutex
+	clientID string
+	inbox    chan bot.MessageView
+
+	Sent          []*mixin.MessageRequest
+	Acks          []*bot.ReceiptAcknowledgementRequest
+	Transfers     []*mixin.TransferInput
+	Users         map[string]*mixin.User
+	Conversations map[string]*mixin.Conversation
+	// 不为空时，所有发送消息的请求都返回该错误
+	sendError error
+}
+
+var fakeTransports = struct {
+	sync.Mutex
+	m map[string]*FakeTransport
+}{m: make(map[string]*FakeTransport)}
+
+// 之后创建的 Transport 都使用内存中的 FakeTransport
+func UseFakeTransport() {
+	NewTransport = func(keystore *mixin.Keystore) (Transport, error) {
+		return GetFakeTransport(keystore.ClientID), nil
+	}
+}
+
+// 获取某个机器人的 FakeTransport，同一个机器人总是返回同一个
+func GetFakeTransport(clientID string) *FakeTransport {
+	fakeTransports.Lock()
+	defer fakeTransports.Unlock()
+	t := fakeTransports.m[clientID]
+	if t == nil {
+		t = &FakeTransport{
+			clientID:      clientID,
+			inbox:         make(chan bot.MessageView, 1024),
+			Users:         make(map[string]*mixin.User),
+			Conversations: make(map[string]*mixin.Conversation),
+		}
+		fakeTransports.m[clientID] = t
+	}
+	return t
+}
+
+// 模拟用户发给机器人的消息，由 Loop 交给 listener 处理
+func (t *FakeTransport) Deliver(msg bot.MessageView) {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now()
+	}
+	t.inbox <- msg
+}
+
+// 已发出的消息的副本
+func (t *FakeTransport) SentMessages() []*mixin.MessageRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*mixin.MessageRequest{}, t.Sent...)
+}
+
+// 已 ack 的消息的副本
+func (t *FakeTransport) AckedMessages() []*bot.ReceiptAcknowledgementRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*bot.ReceiptAcknowledgementRequest{}, t.Acks...)
+}
+
+// 设置后所有发送消息的请求都返回 err，传 nil 恢复
+func (t *FakeTransport) SetSendError(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sendError = err
+}
+
+func (t *FakeTransport) ClientID() string {
+	return t.clientID
+}
+
+func (t *FakeTransport) SendMessage(ctx context.Context, msg *mixin.MessageRequest) error {
+	return t.SendMessages(ctx, []*mixin.MessageRequest{msg})
+}
+
+func (t *FakeTransport) SendMessages(ctx context.Context, msgs []*mixin.MessageRequest) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.sendError != nil {
+		return t.sendError
+	}
+	t.Sent = append(t.Sent, msgs...)
+	return nil
+}
+
+func (t *FakeTransport) SendEncryptedMessages(ctx context.Context, body []map[string]interface{}, resp interface{}) error {
+	msgs := make([]*mixin.MessageRequest, 0, len(body))
+	results := make([]map[string]interface{}, 0, len(body))
+	for _, m := range body {
+		msg := &mixin.MessageRequest{}
+		msg.ConversationID, _ = m["conversation_id"].(string)
+		msg.RecipientID, _ = m["recipient_id"].(string)
+		msg.MessageID, _ = m["message_id"].(string)
+		msg.QuoteMessageID, _ = m["quote_message_id"].(string)
+		msg.Category, _ = m["category"].(string)
+		msg.Data, _ = m["data_base64"].(string)
+		msg.RepresentativeID, _ = m["representative_id"].(string)
+		msgs = append(msgs, msg)
+		results = append(results, map[string]interface{}{
+			"message_id":   msg.MessageID,
+			"recipient_id": msg.RecipientID,
+			"state":        "SUCCESS",
+		})
+	}
+	if err := t.SendMessages(ctx, msgs); err != nil {
+		return err
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, resp)
+}
+
+func (t *FakeTransport) ReadConversation(ctx context.Context, conversationID string) (*mixin.Conversation, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if c := t.Conversations[conversationID]; c != nil {
+		return c, nil
+	}
+	return &mixin.Conversation{ConversationID: conversationID, Category: mixin.ConversationCategoryContact}, nil
+}
+
+func (t *FakeTransport) CreateConversation(ctx context.Context, input *mixin.CreateConversationInput) (*mixin.Conversation, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c := &mixin.Conversation{
+		ConversationID: input.ConversationID,
+		Category:       input.Category,
+		Name:           input.Name,
+		CreatorID:      t.clientID,
+		CreatedAt:      time.Now().Format(time.RFC3339Nano),
+	}
+	t.Conversations[input.ConversationID] = c
+	return c, nil
+}
+
+func (t *FakeTransport) ReadUser(ctx context.Context, userIDOrIdentityNumber string) (*mixin.User, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if u := t.Users[userIDOrIdentityNumber]; u != nil {
+		return u, nil
+	}
+	for _, u := range t.Users {
+		if u.IdentityNumber == userIDOrIdentityNumber {
+			return u, nil
+		}
+	}
+	return &mixin.User{UserID: userIDOrIdentityNumber, FullName: userIDOrIdentityNumber}, nil
+}
+
+func (t *FakeTransport) UserMe(ctx context.Context) (*mixin.User, error) {
+	return &mixin.User{UserID: t.clientID, App: &mixin.App{AppID: t.clientID}}, nil
+}
+
+func (t *FakeTransport) Transfer(ctx context.Context, input *mixin.TransferInput, pin string) (*mixin.Snapshot, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Transfers = append(t.Transfers, input)
+	return &mixin.Snapshot{
+		SnapshotID: uuid.Must(uuid.NewV4()).String(),
+		TraceID:    input.TraceID,
+		AssetID:    input.AssetID,
+		OpponentID: input.OpponentID,
+		Amount:     input.Amount.Neg(),
+		Memo:       input.Memo,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+func (t *FakeTransport) Acknowledge(ctx context.Context, reqs []*bot.ReceiptAcknowledgementRequest) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Acks = append(t.Acks, reqs...)
+	return nil
+}
+
+func (t *FakeTransport) Loop(ctx context.Context, listener bot.BlazeListener) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg := <-t.inbox:
+			var err error
+			if msg.Category == "ACKNOWLEDGE_MESSAGE_RECEIPT" {
+				err = listener.OnAckReceipt(ctx, msg, t.clientID)
+			} else {
+				err = listener.OnMessage(ctx, msg, t.clientID)
+			}
+			if err != nil {
+				// 和 blaze 一样，没有 ack 的消息重连后会再次推送
+				go func(msg bot.MessageView) { t.inbox <- msg }(msg)
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package durable
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+type fakeListener struct {
+	fail     int
+	received chan bot.MessageView
+}
+
+func (l *fakeListener) OnMessage(ctx context.Context, msg bot.MessageView, clientID string) error {
+	if l.fail > 0 {
+		l.fail--
+		return errors.New("listener failed")
+	}
+	l.received <- msg
+	return nil
+}
+
+func (l *fakeListener) OnAckReceipt(ctx context.Context, msg bot.MessageView, clientID string) error {
+	return nil
+}
+
+func (l *fakeListener) SyncAck() bool {
+	return false
+}
+
+func TestFakeTransportRedeliversAfterListenerError(t *testing.T) {
+	transport := GetFakeTransport("fake-transport-redeliver")
+	l := &fakeListener{fail: 1, received: make(chan bot.MessageView, 1)}
+	transport.Deliver(bot.MessageView{MessageId: "m1", Category: mixin.MessageCategoryPlainText})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := transport.Loop(ctx, l); err == nil {
+		t.Fatal("Loop should return the listener error")
+	}
+	go func() { _ = transport.Loop(ctx, l) }()
+	select {
+	case msg := <-l.received:
+		if msg.MessageId != "m1" {
+			t.Fatalf("unexpected message %s", msg.MessageId)
+		}
+	case <-ctx.Done():
+		t.Fatal("message was not redelivered")
+	}
+}
+
+func TestFakeTransportSendError(t *testing.T) {
+	transport := GetFakeTransport("fake-transport-send-error")
+	ctx := context.Background()
+	transport.SetSendError(errors.New("rate limited"))
+	if err := transport.SendMessage(ctx, &mixin.MessageRequest{MessageID: "m1"}); err == nil {
+		t.Fatal("SendMessage should return the send error")
+	}
+	transport.SetSendError(nil)
+	if err := transport.SendMessage(ctx, &mixin.MessageRequest{MessageID: "m2"}); err != nil {
+		t.Fatal(err)
+	}
+	sent := transport.SentMessages()
+	if len(sent) != 1 || sent[0].MessageID != "m2" {
+		t.Fatalf("unexpected sent messages %v", sent)
+	}
+}
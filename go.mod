@@ -15,6 +15,8 @@ require (
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/makiuchi-d/gozxing v0.0.1
 	github.com/mvdan/xurls v1.1.0 // indirect
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/client_model v0.2.0
 	github.com/qiniu/go-sdk/v7 v7.9.7
 	github.com/robfig/cron/v3 v3.0.1
 	github.com/satori/go.uuid v1.2.0
@@ -6,7 +6,10 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/models"
@@ -15,8 +18,20 @@ import (
 )
 
 func main() {
-	service := flag.String("service", "http", "run a service")
+	service := flag.String("service", "http", "run a service, multiple services separated by commas or all")
+	metrics := flag.String("metrics", "0.0.0.0:9100", "metrics listen address, each process on the same host needs its own port")
+	faultRate := flag.Float64("fault-rate", 0, "test mode: inject distribute failures at this rate (0-1) and check per-user ordering")
+	exportClient := flag.String("export-client", "", "export service: export this client once instead of running queued jobs")
+	exportFormat := flag.String("export-format", "jsonl", "export service: jsonl, csv or html")
+	exportStart := flag.String("export-start", "", "export service: start date, e.g. 2022-01-01")
+	exportEnd := flag.String("export-end", "", "export service: end date (exclusive), defaults to now")
 	flag.Parse()
+	services.SetDistributeFaultRate(*faultRate)
+	if err := services.SetExportOnce(*exportClient, *exportFormat, *exportStart, *exportEnd); err != nil {
+		log.Println(err)
+		return
+	}
+	go durable.ServeMetrics(*metrics)
 
 	database := durable.NewDatabase(context.Background())
 	redis := durable.NewRedis(context.Background())
@@ -35,8 +50,15 @@ func main() {
 			log.Println("start http error...", err)
 		}
 	default:
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+			log.Println("shutting down...", <-sig)
+			cancel()
+		}()
 		hub := services.NewHub(database, redis)
-		err := hub.StartService(*service)
+		err := hub.StartServices(ctx, *service)
 		if err != nil {
 			log.Println("service error...", err)
 		}
@@ -10,7 +10,6 @@ import (
 	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/MixinNetwork/supergroup/tools"
-	"github.com/fox-one/mixin-sdk-go"
 	"github.com/jackc/pgx/v4"
 	"github.com/shopspring/decimal"
 )
@@ -77,9 +76,7 @@ WHERE client_id=$1
 }
 
 func GetClientUserStatusByClientUser(ctx context.Context, u *ClientUser) (int, error) {
-	foxUserAssetMap, _ := GetAllUserFoxShares(ctx, []string{u.UserID})
-	exinUserAssetMap, _ := GetAllUserExinShares(ctx, []string{u.UserID})
-	return GetClientUserStatus(ctx, u, foxUserAssetMap[u.UserID], exinUserAssetMap[u.UserID])
+	return GetClientUserStatus(ctx, u, nil)
 }
 
 func GetClientUserUsdAmountByClientUser(ctx context.Context, u *ClientUser) (decimal.Decimal, error) {
@@ -87,22 +84,27 @@ func GetClientUserUsdAmountByClientUser(ctx context.Context, u *ClientUser) (dec
 	if err != nil {
 		return decimal.Zero, err
 	}
-	assets, err := GetUserAssets(ctx, u.AccessToken)
+	holdings, providers, err := getClientUserHoldings(ctx, u, nil)
 	if err != nil {
 		return decimal.Zero, err
 	}
-	foxAsset, _ := GetAllUserFoxShares(ctx, []string{u.UserID})
-	exinAsset, _ := GetAllUserExinShares(ctx, []string{u.UserID})
-	return getNoAssetUserStatus(ctx, client, assets, foxAsset[u.UserID], exinAsset[u.UserID])
+	totalAmount := decimal.Zero
+	for _, p := range providers {
+		if h, ok := holdings[p.Provider]; ok {
+			amount, _ := getNoAssetUserStatus(ctx, client, h)
+			totalAmount = totalAmount.Add(amount.Mul(p.Weight))
+		}
+	}
+	return totalAmount, nil
 }
 
-// 更新每个社群的币资产数量
-func GetClientUserStatus(ctx context.Context, u *ClientUser, foxAsset durable.AssetMap, exinAsset durable.AssetMap) (int, error) {
+// 更新每个社群的币资产数量，snapshot 为批量查询的持仓，可以为空
+func GetClientUserStatus(ctx context.Context, u *ClientUser, snapshot HoldingSnapshot) (int, error) {
 	client, err := GetMixinClientByIDOrHost(ctx, u.ClientID)
 	if err != nil {
 		return ClientUserStatusAudience, session.BadDataError(ctx)
 	}
-	assets, err := GetUserAssets(ctx, u.AccessToken)
+	holdings, providers, err := getClientUserHoldings(ctx, u, snapshot)
 	if err != nil {
 		// 获取资产出现问题
 		if strings.Contains(err.Error(), "Forbidden") {
@@ -111,6 +113,13 @@ func GetClientUserStatus(ctx context.Context, u *ClientUser, foxAsset durable.As
 		}
 		return ClientUserStatusAudience, err
 	}
+	tiers, err := getClientMemberTiers(ctx, client.ClientID)
+	if err != nil {
+		return ClientUserStatusAudience, err
+	}
+	if len(tiers) > 0 {
+		return getClientUserTierStatus(ctx, client, u, holdings, providers, tiers)
+	}
 	assetLevel, err := GetClientAssetLevel(ctx, client.ClientID)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -118,15 +127,24 @@ func GetClientUserStatus(ctx context.Context, u *ClientUser, foxAsset durable.As
 		}
 		return ClientUserStatusAudience, err
 	}
+	// 每个持仓来源按社群设置的权重累加
 	totalAmount := decimal.Zero
-	if client.C.AssetID != "" {
-		totalAmount, err = getHasAssetUserStatus(ctx, client, assets, assetLevel, foxAsset, exinAsset)
-	} else {
-		totalAmount, err = getNoAssetUserStatus(ctx, client, assets, foxAsset, exinAsset)
-	}
-	if err != nil {
-		session.Logger(ctx).Println(err)
-		return ClientUserStatusAudience, nil
+	for _, p := range providers {
+		h, ok := holdings[p.Provider]
+		if !ok {
+			continue
+		}
+		var amount decimal.Decimal
+		if client.C.AssetID != "" {
+			amount, err = getHasAssetUserStatus(ctx, client, h, assetLevel)
+		} else {
+			amount, err = getNoAssetUserStatus(ctx, client, h)
+		}
+		if err != nil {
+			session.Logger(ctx).Println(err)
+			return ClientUserStatusAudience, nil
+		}
+		totalAmount = totalAmount.Add(amount.Mul(p.Weight))
 	}
 
 	if assetLevel.Large.LessThanOrEqual(totalAmount) {
@@ -141,7 +159,8 @@ func GetClientUserStatus(ctx context.Context, u *ClientUser, foxAsset durable.As
 	return ClientUserStatusAudience, nil
 }
 
-func getHasAssetUserStatus(ctx context.Context, client *MixinClient, assets []*mixin.Asset, assetLevel ClientAssetLevel, foxAsset durable.AssetMap, exinAsset durable.AssetMap) (decimal.Decimal, error) {
+// 社群币的数量，LP 按价格折算成社群币
+func getHasAssetUserStatus(ctx context.Context, client *MixinClient, holdings durable.AssetMap, assetLevel ClientAssetLevel) (decimal.Decimal, error) {
 	lpPriceMap, err := GetClientAssetLPCheckMapByID(ctx, client.ClientID)
 	if err != nil {
 		return decimal.Zero, err
@@ -151,43 +170,30 @@ func getHasAssetUserStatus(ctx context.Context, client *MixinClient, assets []*m
 		return decimal.Zero, err
 	}
 	totalAmount := decimal.Zero
-	for _, m := range assets {
-		if !lpPriceMap[m.AssetID].IsZero() {
+	for assetID, balance := range holdings {
+		if !lpPriceMap[assetID].IsZero() {
 			if asset.PriceUsd.IsZero() {
 				return assetLevel.Large, err
 			}
-			amount := lpPriceMap[m.AssetID].Mul(m.Balance).Div(asset.PriceUsd)
+			amount := lpPriceMap[assetID].Mul(balance).Div(asset.PriceUsd)
 			totalAmount = totalAmount.Add(amount)
 		}
-		if m.AssetID == asset.AssetID {
-			totalAmount = totalAmount.Add(m.Balance)
+		if assetID == asset.AssetID {
+			totalAmount = totalAmount.Add(balance)
 		}
 	}
-	if !foxAsset[asset.AssetID].IsZero() {
-		totalAmount = totalAmount.Add(foxAsset[asset.AssetID])
-	}
-	if !exinAsset[asset.AssetID].IsZero() {
-		totalAmount = totalAmount.Add(exinAsset[asset.AssetID])
-	}
 	return totalAmount, nil
 }
 
-func getNoAssetUserStatus(ctx context.Context, client *MixinClient, assets []*mixin.Asset, foxAsset durable.AssetMap, exinAsset durable.AssetMap) (decimal.Decimal, error) {
+// 没有社群币的社群按持仓的美元价值计算
+func getNoAssetUserStatus(ctx context.Context, client *MixinClient, holdings durable.AssetMap) (decimal.Decimal, error) {
 	totalAmount := decimal.Zero
-	for _, asset := range assets {
-		if !asset.PriceUSD.IsZero() {
-			totalAmount = totalAmount.Add(asset.PriceUSD.Mul(asset.Balance))
+	for assetID, balance := range holdings {
+		if balance.IsZero() {
+			continue
 		}
-	}
-	for assetID, balance := range foxAsset {
-		asset, err := GetAssetByID(ctx, client.Client, assetID)
-		if err == nil && !asset.PriceUsd.IsZero() && !balance.IsZero() {
-			totalAmount = totalAmount.Add(asset.PriceUsd.Mul(balance))
-		}
-	}
-	for assetID, balance := range exinAsset {
 		asset, err := GetAssetByID(ctx, client.Client, assetID)
-		if err == nil && !asset.PriceUsd.IsZero() && !balance.IsZero() {
+		if err == nil && !asset.PriceUsd.IsZero() {
 			totalAmount = totalAmount.Add(asset.PriceUsd.Mul(balance))
 		}
 	}
@@ -0,0 +1,141 @@
+//go:build integration
+// +build integration
+
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/shopspring/decimal"
+)
+
+// 社群币的价格为 1 美元，测试结束后删除
+func setTestClientAsset(t *testing.T, clientID string) string {
+	t.Helper()
+	assetID := tools.GetUUID()
+	if _, err := session.Database(_ctx).Exec(_ctx, `
+INSERT INTO assets(asset_id,chain_id,icon_url,symbol,name,price_usd,change_usd) VALUES($1,$1,'','TEST','test','1','0')
+`, assetID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Database(_ctx).Exec(_ctx, `UPDATE client SET asset_id=$2 WHERE client_id=$1`, clientID, assetID); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, session.Database(_ctx))
+		if _, err := session.Database(ctx).Exec(ctx, `DELETE FROM assets WHERE asset_id=$1`, assetID); err != nil {
+			t.Log(err)
+		}
+		session.Redis(_ctx).Del(_ctx, "asset:"+assetID)
+	})
+	return assetID
+}
+
+// 注册两个固定的持仓来源，权重分别为 1 和 0.5，权重为 0 的来源不参与计算
+func setTestHoldingProviders(t *testing.T, clientID string, a, b, zero FakeHoldingProvider) {
+	t.Helper()
+	prefix := "test_" + clientID[:8] + "_"
+	providers := map[string]FakeHoldingProvider{prefix + "a": a, prefix + "b": b, prefix + "zero": zero}
+	weights := map[string]string{prefix + "a": "1", prefix + "b": "0.5", prefix + "zero": "0"}
+	for name, p := range providers {
+		RegisterHoldingProvider(name, p)
+		if _, err := session.Database(_ctx).Exec(_ctx, `
+INSERT INTO client_holding_provider(client_id,provider,weight) VALUES($1,$2,$3)
+`, clientID, name, weights[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheClientHoldingProviders.Delete(clientID)
+	t.Cleanup(func() {
+		holdingProviderMutex.Lock()
+		for name := range providers {
+			delete(holdingProviders, name)
+		}
+		holdingProviderMutex.Unlock()
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, session.Database(_ctx))
+		if _, err := session.Database(ctx).Exec(ctx, `DELETE FROM client_holding_provider WHERE client_id=$1`, clientID); err != nil {
+			t.Log(err)
+		}
+		cacheClientHoldingProviders.Delete(clientID)
+	})
+}
+
+type weightedStatusCase struct {
+	userID string
+	a, b   decimal.Decimal
+	want   int
+}
+
+func setupWeightedStatusCases(t *testing.T, clientID, assetID string, cases []*weightedStatusCase) {
+	t.Helper()
+	a, b, zero := make(FakeHoldingProvider), make(FakeHoldingProvider), make(FakeHoldingProvider)
+	for _, c := range cases {
+		c.userID = addTestClientUser(t, clientID, ClientUserStatusFresh)
+		a[c.userID] = durable.AssetMap{assetID: c.a}
+		b[c.userID] = durable.AssetMap{assetID: c.b}
+		// 权重为 0，数量再大也不影响结果
+		zero[c.userID] = durable.AssetMap{assetID: decimal.NewFromInt(1000000)}
+	}
+	setTestHoldingProviders(t, clientID, a, b, zero)
+}
+
+func checkWeightedStatus(t *testing.T, clientID string, cases []*weightedStatusCase) {
+	t.Helper()
+	userIDs := make([]string, 0, len(cases))
+	for _, c := range cases {
+		userIDs = append(userIDs, c.userID)
+	}
+	// 不传 snapshot 时逐个查询，传入时使用批量查询的结果，两者相同
+	for _, snapshot := range []HoldingSnapshot{nil, PrefetchHoldings(_ctx, userIDs)} {
+		for _, c := range cases {
+			status, err := GetClientUserStatus(_ctx, &ClientUser{ClientID: clientID, UserID: c.userID}, snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != c.want {
+				t.Fatalf("a=%s b=%s: got status %d, want %d", c.a, c.b, status, c.want)
+			}
+		}
+	}
+}
+
+func TestGetClientUserStatusWeightedHoldings(t *testing.T) {
+	durable.UseFakeTransport()
+	clientID := createTestClient(t, "zh")
+	assetID := setTestClientAsset(t, clientID)
+	if err := UpdateClientAssetLevel(_ctx, &ClientAssetLevel{
+		ClientID: clientID,
+		Fresh:    decimal.NewFromInt(10),
+		Senior:   decimal.NewFromInt(100),
+		Large:    decimal.NewFromInt(1000),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, session.Database(_ctx))
+		if _, err := session.Database(ctx).Exec(ctx, `DELETE FROM client_asset_level WHERE client_id=$1`, clientID); err != nil {
+			t.Log(err)
+		}
+		cacheClientAssetLevel.Delete(clientID)
+	})
+
+	n := decimal.NewFromInt
+	cases := []*weightedStatusCase{
+		{a: n(5), b: n(0), want: ClientUserStatusAudience},
+		{a: n(50), b: n(0), want: ClientUserStatusFresh},
+		// 50 + 100 * 0.5
+		{a: n(50), b: n(100), want: ClientUserStatusSenior},
+		// 只有权重 0.5 的来源，180 折算为 90
+		{a: n(0), b: n(180), want: ClientUserStatusFresh},
+		{a: n(500), b: n(1000), want: ClientUserStatusLarge},
+	}
+	setupWeightedStatusCases(t, clientID, assetID, cases)
+	checkWeightedStatus(t, clientID, cases)
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+)
+
+const (
+	BlazeStateConnecting   = "connecting"
+	BlazeStateConnected    = "connected"
+	BlazeStateDisconnected = "disconnected"
+)
+
+// 每个机器人 blaze 连接的状态，由 blaze 服务写入 redis
+type BlazeStatus struct {
+	ClientID       string    `json:"client_id"`
+	State          string    `json:"state"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	DisconnectedAt time.Time `json:"disconnected_at"`
+	LastMessageAt  time.Time `json:"last_message_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	Reconnects     int64     `json:"reconnects"`
+	Backoff        int64     `json:"backoff"`
+	LastError      string    `json:"last_error"`
+
+	Alert string `json:"alert,omitempty"`
+}
+
+func blazeStatusKey(clientID string) string {
+	return fmt.Sprintf("blaze_status:%s", clientID)
+}
+
+func SaveBlazeStatus(ctx context.Context, s *BlazeStatus) error {
+	s.UpdatedAt = time.Now()
+	return session.Redis(ctx).HSet(ctx, blazeStatusKey(s.ClientID),
+		"state", s.State,
+		"connected_at", timeToMilli(s.ConnectedAt),
+		"disconnected_at", timeToMilli(s.DisconnectedAt),
+		"last_message_at", timeToMilli(s.LastMessageAt),
+		"updated_at", timeToMilli(s.UpdatedAt),
+		"reconnects", s.Reconnects,
+		"backoff", s.Backoff,
+		"last_error", s.LastError,
+	).Err()
+}
+
+func GetBlazeStatus(ctx context.Context, clientID string) (*BlazeStatus, error) {
+	res, err := session.Redis(ctx).HGetAll(ctx, blazeStatusKey(clientID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	s := &BlazeStatus{ClientID: clientID, State: res["state"], LastError: res["last_error"]}
+	s.ConnectedAt = milliToTime(res["connected_at"])
+	s.DisconnectedAt = milliToTime(res["disconnected_at"])
+	s.LastMessageAt = milliToTime(res["last_message_at"])
+	s.UpdatedAt = milliToTime(res["updated_at"])
+	s.Reconnects, _ = strconv.ParseInt(res["reconnects"], 10, 64)
+	s.Backoff, _ = strconv.ParseInt(res["backoff"], 10, 64)
+	s.Alert = s.alert(time.Now())
+	return s, nil
+}
+
+func GetBlazeStatusByAdmin(ctx context.Context, u *ClientUser) (*BlazeStatus, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return GetBlazeStatus(ctx, u.ClientID)
+}
+
+// 需要报警的原因，正常时返回空
+func (s *BlazeStatus) alert(now time.Time) string {
+	if s.State == "" {
+		return "blaze 服务未运行"
+	}
+	if now.Sub(s.UpdatedAt) > config.BlazeDisconnectAlertTime {
+		return fmt.Sprintf("blaze 服务 %s 未更新状态", now.Sub(s.UpdatedAt).Truncate(time.Second))
+	}
+	if s.State != BlazeStateConnected {
+		if !s.DisconnectedAt.IsZero() && now.Sub(s.DisconnectedAt) > config.BlazeDisconnectAlertTime {
+			return fmt.Sprintf("已断开 %s，重连 %d 次：%s", now.Sub(s.DisconnectedAt).Truncate(time.Second), s.Reconnects, s.LastError)
+		}
+		return ""
+	}
+	last := s.LastMessageAt
+	if last.Before(s.ConnectedAt) {
+		last = s.ConnectedAt
+	}
+	if now.Sub(last) > config.BlazeSilentAlertTime {
+		return fmt.Sprintf("已连接但 %s 没有收到消息", now.Sub(last).Truncate(time.Second))
+	}
+	return ""
+}
+
+// 每分钟检查所有机器人的 blaze 状态，异常时通知监控群，同一个机器人 30 分钟内只通知一次
+func taskCheckBlazeStatus() {
+	for {
+		time.Sleep(time.Minute)
+		for _, clientID := range config.Config.ClientList {
+			s, err := GetBlazeStatus(_ctx, clientID)
+			if err != nil {
+				session.Logger(_ctx).Println(err)
+				continue
+			}
+			if s.Alert == "" {
+				continue
+			}
+			ok, err := session.Redis(_ctx).SetNX(_ctx, "blaze_alert:"+clientID, "1", 30*time.Minute).Result()
+			if err != nil {
+				session.Logger(_ctx).Println(err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			name := clientID
+			if c, err := GetClientByIDOrHost(_ctx, clientID); err == nil && c.Name != "" {
+				name = c.Name
+			}
+			SendMonitorGroupMsg(_ctx, nil, fmt.Sprintf("blaze 异常！%s\n%s", name, s.Alert))
+		}
+	}
+}
+
+func timeToMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func milliToTime(s string) time.Time {
+	ms, _ := strconv.ParseInt(s, 10, 64)
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -22,6 +22,15 @@ CREATE TABLE IF NOT EXISTS broadcast (
   created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
   PRIMARY KEY(client_id,message_id)
 ); 
+-- 定时公告，发送前消息内容保存在 broadcast 中，发送时再创建消息
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS category VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS data TEXT NOT NULL DEFAULT '';
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS created_by VARCHAR(36) NOT NULL DEFAULT '';
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS send_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '1970-1-1';
+CREATE INDEX IF NOT EXISTS broadcast_send_idx ON broadcast (status, send_at);
+-- 开始发送的时间和次数，发送中超时的定时公告重新发送或者标记为失败
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS sending_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '1970-1-1';
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS attempts SMALLINT NOT NULL DEFAULT 0;
 `
 
 type Broadcast struct {
@@ -30,6 +39,12 @@ type Broadcast struct {
 	Status    int       `json:"status,omitempty"`
 	TopAt     time.Time `json:"top_at,omitempty"`
 	CreatedAt time.Time `json:"created_at,omitempty"`
+	Category  string    `json:"category,omitempty"`
+	Data      string    `json:"data,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	SendAt    time.Time `json:"send_at,omitempty"`
+
+	Segment *BroadcastSegment `json:"segment,omitempty"`
 }
 
 var (
@@ -37,23 +52,25 @@ var (
 	BroadcastStatusFinished       = 1
 	BroadcastStatusRecallPending  = 2
 	BroadcastStatusRecallFinished = 3
+	BroadcastStatusScheduled      = 4 // 定时发送
+	BroadcastStatusSending        = 5
+	BroadcastStatusCanceled       = 6
+	BroadcastStatusFailed         = 7 // 多次发送超时
 )
 
 func GetBroadcast(ctx context.Context, u *ClientUser) ([]*Message, error) {
 	broadcasts := make([]*Message, 0)
 	if err := session.Database(ctx).ConnQuery(ctx, `
-SELECT m.message_id, m.user_id, m.category, m.data, u.full_name, u.avatar_url, b.status, b.created_at, b.top_at
-FROM messages as m
-LEFT JOIN users as u ON m.user_id=u.user_id
-LEFT JOIN broadcast as b ON m.message_id=b.message_id
-WHERE m.message_id IN (
-  SELECT message_id FROM broadcast WHERE m.client_id=$1
-)
+SELECT b.message_id, COALESCE(m.user_id,b.created_by), COALESCE(m.category,b.category), COALESCE(m.data,b.data), u.full_name, u.avatar_url, b.status, b.created_at, b.top_at, b.send_at
+FROM broadcast as b
+LEFT JOIN messages as m ON m.client_id=b.client_id AND m.message_id=b.message_id
+LEFT JOIN users as u ON u.user_id=COALESCE(m.user_id,b.created_by)
+WHERE b.client_id=$1
 ORDER BY b.created_at DESC
 `, func(rows pgx.Rows) error {
 		for rows.Next() {
 			var b Message
-			if err := rows.Scan(&b.MessageID, &b.UserID, &b.Category, &b.Data, &b.FullName, &b.AvatarURL, &b.Status, &b.CreatedAt, &b.TopAt); err != nil {
+			if err := rows.Scan(&b.MessageID, &b.UserID, &b.Category, &b.Data, &b.FullName, &b.AvatarURL, &b.Status, &b.CreatedAt, &b.TopAt, &b.SendAt); err != nil {
 				return err
 			}
 			b.Data = string(tools.Base64Decode(b.Data))
@@ -66,10 +83,13 @@ ORDER BY b.created_at DESC
 	return broadcasts, nil
 }
 
-func CreateBroadcast(ctx context.Context, u *ClientUser, data, category string) error {
+func CreateBroadcast(ctx context.Context, u *ClientUser, data, category string, segment *BroadcastSegment) error {
 	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
 		return session.ForbiddenError(ctx)
 	}
+	if !checkBroadcastSegment(segment) {
+		return session.BadDataError(ctx)
+	}
 	msgID := tools.GetUUID()
 	now := time.Now()
 	if category == "" {
@@ -87,11 +107,11 @@ func CreateBroadcast(ctx context.Context, u *ClientUser, data, category string)
 		CreatedAt:      now,
 		UpdatedAt:      now,
 	}
-	if err := createBroadcast(ctx, u.ClientID, msgID); err != nil {
+	if err := createBroadcast(ctx, u.ClientID, msgID, segment.encode()); err != nil {
 		session.Logger(ctx).Println(err)
 		return err
 	}
-	if err := createMessage(ctx, u.ClientID, msg, MessageStatusBroadcast); err != nil {
+	if err := createMessage(ctx, u.ClientID, msg, getBroadcastMessageStatus(segment.encode())); err != nil {
 		session.Logger(ctx).Println(err)
 		return err
 	}
@@ -103,6 +123,12 @@ func DeleteBroadcast(ctx context.Context, u *ClientUser, broadcastID string) err
 	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
 		return session.ForbiddenError(ctx)
 	}
+	// 还没有发送的定时公告直接取消
+	if canceled, err := cancelScheduledBroadcast(ctx, u.ClientID, broadcastID); err != nil {
+		return err
+	} else if canceled {
+		return nil
+	}
 	// 发送一条 recall 的消息
 	// 1. 找到之前的
 	if err := updateBroadcast(ctx, u.ClientID, broadcastID, BroadcastStatusRecallPending); err != nil {
@@ -124,7 +150,7 @@ SELECT status FROM broadcast WHERE client_id=$1 AND message_id=$2
 	if status != BroadcastStatusRecallPending {
 		return
 	}
-	dms, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, originMsgID)
+	dms, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, clientID, originMsgID)
 	if err != nil {
 		session.Logger(ctx).Println(err)
 		return
@@ -151,7 +177,7 @@ SELECT status FROM broadcast WHERE client_id=$1 AND message_id=$2
 		return
 	}
 
-	if err := SendBatchMessages(ctx, client.Client, msgs); err != nil {
+	if err := SendBatchMessages(ctx, client.Transport, msgs); err != nil {
 		session.Logger(ctx).Println(err)
 		return
 	}
@@ -161,9 +187,9 @@ SELECT status FROM broadcast WHERE client_id=$1 AND message_id=$2
 	}
 }
 
-func createBroadcast(ctx context.Context, clientID, msgID string) error {
-	query := durable.InsertQuery("broadcast", "client_id,message_id")
-	_, err := session.Database(ctx).Exec(ctx, query, clientID, msgID)
+func createBroadcast(ctx context.Context, clientID, msgID, segment string) error {
+	query := durable.InsertQuery("broadcast", "client_id,message_id,segment")
+	_, err := session.Database(ctx).Exec(ctx, query, clientID, msgID, segment)
 	return err
 }
 
@@ -176,48 +202,59 @@ WHERE client_id=$1 AND message_id=$2
 }
 
 func SendBroadcast(ctx context.Context, u *ClientUser, msgID, category, data string, now time.Time) {
-	users, err := GetClientUserByPriority(ctx, u.ClientID, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, false, true)
+	users, err := getBroadcastUsers(ctx, u.ClientID, msgID)
 	if err != nil {
 		session.Logger(ctx).Println(err)
 		return
 	}
+	rendered := renderTemplateDataMap(ctx, u.ClientID, category, data, users)
 	msgs := make([]*mixin.MessageRequest, 0)
 	for _, userID := range users {
 		if checkIsBlockUser(ctx, u.ClientID, userID) {
 			continue
 		}
-		_msgID := tools.GetUUID()
+		// 同一条公告发给同一个用户的消息 ID 固定，重新发送时不会重复
+		_msgID := mixin.UniqueConversationID(msgID, userID)
+		_data := data
+		if d, ok := rendered[userID]; ok {
+			_data = d
+		}
 		msgs = append(msgs, &mixin.MessageRequest{
 			ConversationID: mixin.UniqueConversationID(u.ClientID, userID),
 			RecipientID:    userID,
 			MessageID:      _msgID,
 			Category:       category,
-			Data:           data,
+			Data:           _data,
 		})
 	}
 	client, err := GetMixinClientByIDOrHost(ctx, u.ClientID)
 	if err != nil {
 		return
 	}
-	if err := SendBatchMessages(ctx, client.Client, msgs); err != nil {
+	if err := SendBatchMessages(ctx, client.Transport, msgs); err != nil {
 		session.Logger(ctx).Println(err)
 		return
 	}
+	dms := make([]*DistributeMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		dms = append(dms, &DistributeMessage{
+			UserID:          msg.RecipientID,
+			OriginMessageID: msgID,
+			MessageID:       msg.MessageID,
+		})
+	}
 	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
-		for _, msg := range msgs {
-			if err := buildOriginMsgAndMsgIndex(ctx, p, &DistributeMessage{
-				UserID:          msg.RecipientID,
-				OriginMessageID: msgID,
-				MessageID:       msg.MessageID,
-			}); err != nil {
+		for _, dm := range dms {
+			if err := buildOriginMsgAndMsgIndex(ctx, p, dm); err != nil {
 				return err
 			}
 		}
-		return nil
+		return incrMessageStatDistributed(ctx, p, u.ClientID, msgID, len(msgs))
 	}); err != nil {
 		session.Logger(ctx).Println(err)
 		return
 	}
+	createMessageMapping(ctx, u.ClientID, dms)
 	if err := updateBroadcast(ctx, u.ClientID, msgID, BroadcastStatusFinished); err != nil {
 		session.Logger(ctx).Println(err)
 	}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const multi_broadcast_DDL = `
+-- 跨社群公告，社群的创建者一次发到自己的多个社群
+CREATE TABLE IF NOT EXISTS multi_broadcast (
+  multi_id            VARCHAR(36) NOT NULL PRIMARY KEY,
+  owner_id            VARCHAR(36) NOT NULL,
+  category            VARCHAR NOT NULL,
+  data                TEXT NOT NULL,
+  variants            TEXT NOT NULL DEFAULT '', -- 按社群语言的内容，JSON
+  client_ids          VARCHAR(36)[] NOT NULL,
+  send_at             TIMESTAMP WITH TIME ZONE NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS multi_broadcast_owner_idx ON multi_broadcast (owner_id, created_at);
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS multi_id VARCHAR(36) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS broadcast_multi_idx ON broadcast (multi_id);
+`
+
+type MultiBroadcast struct {
+	MultiID   string            `json:"multi_id"`
+	OwnerID   string            `json:"owner_id"`
+	Category  string            `json:"category"`
+	Data      string            `json:"data"`
+	Variants  map[string]string `json:"variants,omitempty"` // 语言到内容，社群语言没有对应内容时使用 data
+	ClientIDs []string          `json:"client_ids"`
+	SendAt    time.Time         `json:"send_at"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+type OwnerClient struct {
+	ClientID string `json:"client_id"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+}
+
+// 每个社群的发送情况和汇总
+type MultiBroadcastReport struct {
+	MultiBroadcast
+	Clients []*MultiBroadcastClientReport `json:"clients"`
+	Total   MessageStat                   `json:"total"`
+}
+
+type MultiBroadcastClientReport struct {
+	ClientID  string       `json:"client_id"`
+	Name      string       `json:"name"`
+	MessageID string       `json:"message_id"`
+	Status    int          `json:"status"`
+	Stat      *MessageStat `json:"stat"`
+}
+
+// 当前用户创建的社群
+func GetOwnerClients(ctx context.Context, u *ClientUser) ([]*OwnerClient, error) {
+	if !checkIsOwner(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list := make([]*OwnerClient, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id,name,lang FROM client WHERE owner_id=$1 ORDER BY created_at
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var c OwnerClient
+			if err := rows.Scan(&c.ClientID, &c.Name, &c.Lang); err != nil {
+				return err
+			}
+			if c.Lang == "" {
+				c.Lang = config.Config.Lang
+			}
+			list = append(list, &c)
+		}
+		return nil
+	}, u.UserID)
+	return list, err
+}
+
+// 在每个社群创建一条定时公告，由各社群的机器人发送，send_at 为空时马上发送
+func CreateMultiBroadcast(ctx context.Context, u *ClientUser, b *MultiBroadcast) (*MultiBroadcast, error) {
+	clients, err := GetOwnerClients(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]*OwnerClient, len(clients))
+	for _, c := range clients {
+		owned[c.ClientID] = c
+	}
+	if b.Data == "" || len(b.ClientIDs) == 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	for _, clientID := range b.ClientIDs {
+		if owned[clientID] == nil {
+			return nil, session.ForbiddenError(ctx)
+		}
+	}
+	now := time.Now()
+	if b.SendAt.IsZero() {
+		b.SendAt = now
+	} else if !checkBroadcastSendAt(b.SendAt) {
+		return nil, session.BadDataError(ctx)
+	}
+	if b.Category == "" {
+		b.Category = mixin.MessageCategoryPlainText
+	}
+	b.MultiID = tools.GetUUID()
+	b.OwnerID = u.UserID
+	b.CreatedAt = now
+	variants := ""
+	if len(b.Variants) > 0 {
+		data, _ := json.Marshal(b.Variants)
+		variants = string(data)
+	}
+	err = session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO multi_broadcast(multi_id,owner_id,category,data,variants,client_ids,send_at,created_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8)
+`, b.MultiID, b.OwnerID, b.Category, tools.Base64Encode([]byte(b.Data)), variants, b.ClientIDs, b.SendAt, b.CreatedAt); err != nil {
+			return err
+		}
+		for _, clientID := range b.ClientIDs {
+			data := b.Data
+			if v := b.Variants[owned[clientID].Lang]; v != "" {
+				data = v
+			}
+			if _, err := tx.Exec(ctx, `
+INSERT INTO broadcast(client_id,message_id,status,category,data,created_by,send_at,created_at,multi_id)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)
+`, clientID, tools.GetUUID(), BroadcastStatusScheduled, b.Category, tools.Base64Encode([]byte(data)), u.UserID, b.SendAt, now, b.MultiID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func GetMultiBroadcasts(ctx context.Context, u *ClientUser) ([]*MultiBroadcast, error) {
+	if !checkIsOwner(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getMultiBroadcasts(ctx, `WHERE owner_id=$1 ORDER BY created_at DESC LIMIT 100`, u.UserID)
+}
+
+func getMultiBroadcasts(ctx context.Context, where string, args ...interface{}) ([]*MultiBroadcast, error) {
+	list := make([]*MultiBroadcast, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT multi_id,owner_id,category,data,variants,client_ids,send_at,created_at FROM multi_broadcast `+where, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var b MultiBroadcast
+			var variants string
+			if err := rows.Scan(&b.MultiID, &b.OwnerID, &b.Category, &b.Data, &variants, &b.ClientIDs, &b.SendAt, &b.CreatedAt); err != nil {
+				return err
+			}
+			b.Data = string(tools.Base64Decode(b.Data))
+			if variants != "" {
+				_ = json.Unmarshal([]byte(variants), &b.Variants)
+			}
+			list = append(list, &b)
+		}
+		return nil
+	}, args...)
+	return list, err
+}
+
+// 汇总每个社群公告的分发、送达和阅读统计
+func GetMultiBroadcastReport(ctx context.Context, u *ClientUser, multiID string) (*MultiBroadcastReport, error) {
+	if !checkIsOwner(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list, err := getMultiBroadcasts(ctx, `WHERE owner_id=$1 AND multi_id=$2`, u.UserID, multiID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	r := &MultiBroadcastReport{MultiBroadcast: *list[0], Clients: make([]*MultiBroadcastClientReport, 0)}
+	err = session.Database(ctx).ConnQuery(ctx, `
+SELECT b.client_id,COALESCE(c.name,''),b.message_id,b.status
+FROM broadcast b
+LEFT JOIN client c ON c.client_id=b.client_id
+WHERE b.multi_id=$1
+ORDER BY b.client_id
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var c MultiBroadcastClientReport
+			if err := rows.Scan(&c.ClientID, &c.Name, &c.MessageID, &c.Status); err != nil {
+				return err
+			}
+			r.Clients = append(r.Clients, &c)
+		}
+		return nil
+	}, multiID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range r.Clients {
+		if c.Stat, err = getMessageStat(ctx, c.ClientID, c.MessageID); err != nil {
+			return nil, err
+		}
+		r.Total.DistributedCount += c.Stat.DistributedCount
+		r.Total.DeliveredCount += c.Stat.DeliveredCount
+		r.Total.ReadCount += c.Stat.ReadCount
+		r.Total.PendingCount += c.Stat.PendingCount
+	}
+	r.Total.Approximate = true
+	if r.Total.DistributedCount > 0 {
+		total := decimal.NewFromInt(r.Total.DistributedCount)
+		r.Total.DeliveryRate = decimal.NewFromInt(r.Total.DeliveredCount).Div(total).Round(4)
+		r.Total.ReadRate = decimal.NewFromInt(r.Total.ReadCount).Div(total).Round(4)
+	}
+	return r, nil
+}
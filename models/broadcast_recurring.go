@@ -0,0 +1,324 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+	"github.com/robfig/cron/v3"
+)
+
+const broadcast_recurring_DDL = `
+-- 周期公告，按 cron 表达式生成定时公告
+CREATE TABLE IF NOT EXISTS broadcast_recurring (
+  recurring_id        VARCHAR(36) NOT NULL PRIMARY KEY,
+  client_id           VARCHAR(36) NOT NULL,
+  category            VARCHAR NOT NULL,
+  data                TEXT NOT NULL,
+  cron                VARCHAR NOT NULL,
+  timezone            VARCHAR NOT NULL DEFAULT 'UTC',
+  end_at              TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '1970-1-1', -- 1970-1-1 表示不结束
+  status              SMALLINT NOT NULL DEFAULT 1, -- 1 生效 2 暂停 3 已结束
+  next_at             TIMESTAMP WITH TIME ZONE NOT NULL,
+  last_at             TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT '1970-1-1',
+  created_by          VARCHAR(36) NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS broadcast_recurring_client_idx ON broadcast_recurring (client_id);
+CREATE INDEX IF NOT EXISTS broadcast_recurring_next_idx ON broadcast_recurring (status, next_at);
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS recurring_id VARCHAR(36) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS broadcast_recurring_idx ON broadcast (recurring_id, created_at);
+`
+
+type BroadcastRecurring struct {
+	RecurringID string    `json:"recurring_id"`
+	ClientID    string    `json:"client_id"`
+	Category    string    `json:"category"`
+	Data        string    `json:"data"`
+	Cron        string    `json:"cron"`
+	Timezone    string    `json:"timezone"`
+	EndAt       time.Time `json:"end_at"`
+	Status      int       `json:"status"`
+	NextAt      time.Time `json:"next_at"`
+	LastAt      time.Time `json:"last_at"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const (
+	BroadcastRecurringActive = 1
+	BroadcastRecurringPaused = 2
+	BroadcastRecurringEnded  = 3
+)
+
+// 两次发送之间至少间隔一小时
+const minBroadcastRecurringInterval = time.Hour
+
+// 检查接下来一年内的发送间隔，最多检查 1000 次
+const (
+	broadcastRecurringCheckPeriod = 366 * 24 * time.Hour
+	broadcastRecurringCheckRuns   = 1000
+)
+
+// 按时区解析 cron 表达式，返回 now 之后的下一次发送时间
+func parseBroadcastRecurring(r *BroadcastRecurring, now time.Time) (time.Time, error) {
+	if r.Timezone == "" {
+		r.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		return time.Time{}, err
+	}
+	s, err := cron.ParseStandard(fmt.Sprintf("CRON_TZ=%s %s", r.Timezone, r.Cron))
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := s.Next(now)
+	if next.IsZero() || !checkBroadcastRecurringInterval(s, next) {
+		return time.Time{}, fmt.Errorf("invalid cron %s", r.Cron)
+	}
+	return next, nil
+}
+
+// 像 "0,30 9 * * 1" 这样的表达式只有部分时间间隔太短，所以要检查多次
+func checkBroadcastRecurringInterval(s cron.Schedule, next time.Time) bool {
+	end := next.Add(broadcastRecurringCheckPeriod)
+	for i := 0; i < broadcastRecurringCheckRuns && next.Before(end); i++ {
+		t := s.Next(next)
+		if t.IsZero() {
+			return true
+		}
+		if t.Sub(next) < minBroadcastRecurringInterval {
+			return false
+		}
+		next = t
+	}
+	return true
+}
+
+// 没有传时区时使用管理员设置的时区（接收方式中的 timezone），都没有时使用 UTC
+func getBroadcastRecurringTimezone(ctx context.Context, u *ClientUser) string {
+	d, err := GetClientUserDelivery(ctx, u)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return "UTC"
+	}
+	if d.Timezone == "" {
+		return "UTC"
+	}
+	return d.Timezone
+}
+
+func hasBroadcastRecurringEnd(r *BroadcastRecurring) bool {
+	return r.EndAt.After(time.Unix(0, 0))
+}
+
+func CreateBroadcastRecurring(ctx context.Context, u *ClientUser, r *BroadcastRecurring) (*BroadcastRecurring, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	if r.Data == "" {
+		return nil, session.BadDataError(ctx)
+	}
+	if r.Category == "" {
+		r.Category = mixin.MessageCategoryPlainText
+	}
+	if r.Timezone == "" {
+		r.Timezone = getBroadcastRecurringTimezone(ctx, u)
+	}
+	now := time.Now()
+	next, err := parseBroadcastRecurring(r, now)
+	if err != nil {
+		return nil, session.BadDataError(ctx)
+	}
+	if hasBroadcastRecurringEnd(r) && !r.EndAt.After(next) {
+		return nil, session.BadDataError(ctx)
+	}
+	r.RecurringID = tools.GetUUID()
+	r.ClientID = u.ClientID
+	r.Status = BroadcastRecurringActive
+	r.NextAt = next
+	r.CreatedBy = u.UserID
+	r.CreatedAt = now
+	r.UpdatedAt = now
+	if _, err := session.Database(ctx).Exec(ctx, `
+INSERT INTO broadcast_recurring(recurring_id,client_id,category,data,cron,timezone,end_at,status,next_at,created_by,created_at,updated_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+`, r.RecurringID, r.ClientID, r.Category, tools.Base64Encode([]byte(r.Data)), r.Cron, r.Timezone, r.EndAt, r.Status, r.NextAt, r.CreatedBy, r.CreatedAt, r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func GetBroadcastRecurringList(ctx context.Context, u *ClientUser) ([]*BroadcastRecurring, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getBroadcastRecurrings(ctx, `WHERE client_id=$1 ORDER BY created_at DESC`, u.ClientID)
+}
+
+func getBroadcastRecurring(ctx context.Context, clientID, recurringID string) (*BroadcastRecurring, error) {
+	list, err := getBroadcastRecurrings(ctx, `WHERE client_id=$1 AND recurring_id=$2`, clientID, recurringID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	return list[0], nil
+}
+
+func getBroadcastRecurrings(ctx context.Context, where string, args ...interface{}) ([]*BroadcastRecurring, error) {
+	list := make([]*BroadcastRecurring, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT recurring_id,client_id,category,data,cron,timezone,end_at,status,next_at,last_at,created_by,created_at,updated_at
+FROM broadcast_recurring `+where, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var r BroadcastRecurring
+			if err := rows.Scan(&r.RecurringID, &r.ClientID, &r.Category, &r.Data, &r.Cron, &r.Timezone, &r.EndAt, &r.Status, &r.NextAt, &r.LastAt, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt); err != nil {
+				return err
+			}
+			r.Data = string(tools.Base64Decode(r.Data))
+			list = append(list, &r)
+		}
+		return nil
+	}, args...)
+	return list, err
+}
+
+// 修改内容和规则，已结束的周期公告不能修改
+func UpdateBroadcastRecurring(ctx context.Context, u *ClientUser, recurringID string, body *BroadcastRecurring) (*BroadcastRecurring, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	r, err := getBroadcastRecurring(ctx, u.ClientID, recurringID)
+	if err != nil {
+		return nil, err
+	}
+	if r.Status == BroadcastRecurringEnded || body.Data == "" {
+		return nil, session.BadDataError(ctx)
+	}
+	r.Data, r.Cron, r.EndAt = body.Data, body.Cron, body.EndAt
+	if body.Timezone != "" {
+		r.Timezone = body.Timezone
+	}
+	if body.Category != "" {
+		r.Category = body.Category
+	}
+	if r.NextAt, err = parseBroadcastRecurring(r, time.Now()); err != nil {
+		return nil, session.BadDataError(ctx)
+	}
+	if hasBroadcastRecurringEnd(r) && !r.EndAt.After(r.NextAt) {
+		return nil, session.BadDataError(ctx)
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE broadcast_recurring SET category=$3,data=$4,cron=$5,timezone=$6,end_at=$7,next_at=$8,updated_at=NOW()
+WHERE client_id=$1 AND recurring_id=$2
+`, u.ClientID, recurringID, r.Category, tools.Base64Encode([]byte(r.Data)), r.Cron, r.Timezone, r.EndAt, r.NextAt); err != nil {
+		return nil, err
+	}
+	return getBroadcastRecurring(ctx, u.ClientID, recurringID)
+}
+
+// 暂停和恢复，恢复后从现在开始计算下一次发送时间，暂停期间错过的不补发
+func UpdateBroadcastRecurringStatus(ctx context.Context, u *ClientUser, recurringID string, status int) (*BroadcastRecurring, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	r, err := getBroadcastRecurring(ctx, u.ClientID, recurringID)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status == BroadcastRecurringPaused && r.Status == BroadcastRecurringActive:
+	case status == BroadcastRecurringActive && r.Status == BroadcastRecurringPaused:
+		if r.NextAt, err = parseBroadcastRecurring(r, time.Now()); err != nil {
+			return nil, session.BadDataError(ctx)
+		}
+		if hasBroadcastRecurringEnd(r) && !r.EndAt.After(r.NextAt) {
+			return nil, session.BadDataError(ctx)
+		}
+	case status == BroadcastRecurringEnded && r.Status != BroadcastRecurringEnded:
+	default:
+		return nil, session.BadDataError(ctx)
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE broadcast_recurring SET status=$3,next_at=$4,updated_at=NOW() WHERE client_id=$1 AND recurring_id=$2
+`, u.ClientID, recurringID, status, r.NextAt); err != nil {
+		return nil, err
+	}
+	return getBroadcastRecurring(ctx, u.ClientID, recurringID)
+}
+
+// 周期公告每次发送对应的公告记录
+func GetBroadcastRecurringHistory(ctx context.Context, u *ClientUser, recurringID string) ([]*Broadcast, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list := make([]*Broadcast, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id,message_id,status,send_at,created_at FROM broadcast
+WHERE client_id=$1 AND recurring_id=$2
+ORDER BY created_at DESC LIMIT 100
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var b Broadcast
+			if err := rows.Scan(&b.ClientID, &b.MessageID, &b.Status, &b.SendAt, &b.CreatedAt); err != nil {
+				return err
+			}
+			list = append(list, &b)
+		}
+		return nil
+	}, u.ClientID, recurringID)
+	return list, err
+}
+
+// 到时间的周期公告生成一条马上发送的定时公告，由定时公告的流程发送
+// 服务停止期间错过的多次只发送一次
+func createRecurringBroadcasts(ctx context.Context) error {
+	for {
+		created := false
+		err := session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+			var r BroadcastRecurring
+			err := tx.QueryRow(ctx, `
+SELECT recurring_id,client_id,category,data,cron,timezone,end_at,created_by
+FROM broadcast_recurring WHERE status=$1 AND next_at<=NOW()
+ORDER BY next_at LIMIT 1 FOR UPDATE SKIP LOCKED
+`, BroadcastRecurringActive).Scan(&r.RecurringID, &r.ClientID, &r.Category, &r.Data, &r.Cron, &r.Timezone, &r.EndAt, &r.CreatedBy)
+			if err == pgx.ErrNoRows {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			created = true
+			now := time.Now()
+			status := BroadcastRecurringActive
+			next, err := parseBroadcastRecurring(&r, now)
+			if err != nil {
+				session.Logger(ctx).Println(r.RecurringID, err)
+				status = BroadcastRecurringEnded
+				next = now
+			} else if hasBroadcastRecurringEnd(&r) && next.After(r.EndAt) {
+				status = BroadcastRecurringEnded
+			}
+			if _, err := tx.Exec(ctx, `
+INSERT INTO broadcast(client_id,message_id,status,category,data,created_by,send_at,created_at,recurring_id)
+VALUES($1,$2,$3,$4,$5,$6,$7,$7,$8)
+`, r.ClientID, tools.GetUUID(), BroadcastStatusScheduled, r.Category, r.Data, r.CreatedBy, now, r.RecurringID); err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `
+UPDATE broadcast_recurring SET status=$2,next_at=$3,last_at=$4,updated_at=$4 WHERE recurring_id=$1
+`, r.RecurringID, status, next, now)
+			return err
+		})
+		if err != nil || !created {
+			return err
+		}
+	}
+}
@@ -0,0 +1,33 @@
+//go:build integration
+// +build integration
+
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBroadcastRecurringInterval(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		cron string
+		ok   bool
+	}{
+		{"0 9 * * *", true},
+		{"0 9 * * 1", true},
+		{"0 */2 * * *", true},
+		{"*/30 * * * *", false},
+		// 只有周一两次发送间隔 30 分钟
+		{"0,30 9 * * 1", false},
+		// 5 个月后才出现间隔太短的两次发送
+		{"0,30 9 1 6 *", false},
+	}
+	for _, c := range cases {
+		r := &BroadcastRecurring{Cron: c.cron, Timezone: "Asia/Shanghai"}
+		_, err := parseBroadcastRecurring(r, now)
+		if (err == nil) != c.ok {
+			t.Fatalf("cron %q: got err %v, want ok %v", c.cron, err, c.ok)
+		}
+	}
+}
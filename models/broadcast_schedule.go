@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+)
+
+// 定时公告最多提前一年创建
+const maxBroadcastScheduleTime = 365 * 24 * time.Hour
+
+const (
+	broadcastSendingTimeout = 30 * time.Minute
+	broadcastMaxAttempts    = 3
+)
+
+func checkBroadcastSendAt(sendAt time.Time) bool {
+	now := time.Now()
+	return sendAt.After(now) && sendAt.Before(now.Add(maxBroadcastScheduleTime))
+}
+
+// 创建定时公告，到 send_at 之后由 http 服务发送
+func CreateScheduledBroadcast(ctx context.Context, u *ClientUser, data, category string, sendAt time.Time, segment *BroadcastSegment) (*Broadcast, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	if !checkBroadcastSendAt(sendAt) || data == "" || !checkBroadcastSegment(segment) {
+		return nil, session.BadDataError(ctx)
+	}
+	if category == "" {
+		category = mixin.MessageCategoryPlainText
+	}
+	b := &Broadcast{
+		ClientID:  u.ClientID,
+		MessageID: tools.GetUUID(),
+		Status:    BroadcastStatusScheduled,
+		Category:  category,
+		Data:      tools.Base64Encode([]byte(data)),
+		CreatedBy: u.UserID,
+		SendAt:    sendAt,
+		CreatedAt: time.Now(),
+		Segment:   segment,
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+INSERT INTO broadcast(client_id,message_id,status,category,data,created_by,send_at,created_at,segment)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)
+`, b.ClientID, b.MessageID, b.Status, b.Category, b.Data, b.CreatedBy, b.SendAt, b.CreatedAt, segment.encode()); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func GetScheduledBroadcasts(ctx context.Context, u *ClientUser) ([]*Broadcast, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list := make([]*Broadcast, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id,message_id,status,category,data,created_by,send_at,created_at,segment
+FROM broadcast WHERE client_id=$1 AND status IN ($2,$3)
+ORDER BY send_at
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var b Broadcast
+			var segment string
+			if err := rows.Scan(&b.ClientID, &b.MessageID, &b.Status, &b.Category, &b.Data, &b.CreatedBy, &b.SendAt, &b.CreatedAt, &segment); err != nil {
+				return err
+			}
+			b.Data = string(tools.Base64Decode(b.Data))
+			b.Segment = decodeBroadcastSegment(segment)
+			list = append(list, &b)
+		}
+		return nil
+	}, u.ClientID, BroadcastStatusScheduled, BroadcastStatusSending)
+	return list, err
+}
+
+// 只能修改还没有开始发送的定时公告
+func UpdateScheduledBroadcast(ctx context.Context, u *ClientUser, broadcastID, data, category string, sendAt time.Time, segment *BroadcastSegment) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	if !checkBroadcastSendAt(sendAt) || data == "" || !checkBroadcastSegment(segment) {
+		return session.BadDataError(ctx)
+	}
+	if category == "" {
+		category = mixin.MessageCategoryPlainText
+	}
+	tag, err := session.Database(ctx).Exec(ctx, `
+UPDATE broadcast SET category=$4,data=$5,send_at=$6,created_by=$7,segment=$8
+WHERE client_id=$1 AND message_id=$2 AND status=$3
+`, u.ClientID, broadcastID, BroadcastStatusScheduled, category, tools.Base64Encode([]byte(data)), sendAt, u.UserID, segment.encode())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return session.BadDataError(ctx)
+	}
+	return nil
+}
+
+func cancelScheduledBroadcast(ctx context.Context, clientID, broadcastID string) (bool, error) {
+	tag, err := session.Database(ctx).Exec(ctx, `
+UPDATE broadcast SET status=$4 WHERE client_id=$1 AND message_id=$2 AND status=$3
+`, clientID, broadcastID, BroadcastStatusScheduled, BroadcastStatusCanceled)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func taskSendScheduledBroadcasts() {
+	for {
+		if err := createRecurringBroadcasts(_ctx); err != nil {
+			session.Logger(_ctx).Println(err)
+		}
+		if err := resetStuckScheduledBroadcasts(_ctx); err != nil {
+			session.Logger(_ctx).Println(err)
+		}
+		if err := sendScheduledBroadcasts(_ctx); err != nil {
+			session.Logger(_ctx).Println(err)
+		}
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// 取出到时间的定时公告并标记为发送中，多个 http 服务同时运行时不会重复发送
+func sendScheduledBroadcasts(ctx context.Context) error {
+	list := make([]*Broadcast, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+UPDATE broadcast SET status=$2,sending_at=NOW(),attempts=attempts+1
+WHERE (client_id,message_id) IN (
+  SELECT client_id,message_id FROM broadcast WHERE status=$1 AND send_at<=NOW()
+  ORDER BY send_at LIMIT 20 FOR UPDATE SKIP LOCKED
+)
+RETURNING client_id,message_id,category,data,created_by,send_at,segment
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var b Broadcast
+			var segment string
+			if err := rows.Scan(&b.ClientID, &b.MessageID, &b.Category, &b.Data, &b.CreatedBy, &b.SendAt, &segment); err != nil {
+				return err
+			}
+			b.Segment = decodeBroadcastSegment(segment)
+			list = append(list, &b)
+		}
+		return nil
+	}, BroadcastStatusScheduled, BroadcastStatusSending)
+	if err != nil {
+		return err
+	}
+	for _, b := range list {
+		sendScheduledBroadcast(ctx, b)
+	}
+	return nil
+}
+
+// 发送中超时的定时公告（服务重启或者发送失败）重新发送，超过次数后标记为失败
+func resetStuckScheduledBroadcasts(ctx context.Context) error {
+	tag, err := session.Database(ctx).Exec(ctx, `
+UPDATE broadcast SET status=CASE WHEN attempts<$3 THEN $1 ELSE $4 END
+WHERE status=$2 AND sending_at<$5
+`, BroadcastStatusScheduled, BroadcastStatusSending, broadcastMaxAttempts, BroadcastStatusFailed, time.Now().Add(-broadcastSendingTimeout))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		session.Logger(ctx).Println("reset stuck scheduled broadcasts", tag.RowsAffected())
+	}
+	return nil
+}
+
+// 和立即发送的公告一样创建消息并分发，发送完成后状态变为 finished
+// 消息的时间固定为 send_at，重新发送时和已创建的消息主键冲突
+func sendScheduledBroadcast(ctx context.Context, b *Broadcast) {
+	now := time.Now()
+	msg := &mixin.MessageView{
+		ConversationID: mixin.UniqueConversationID(b.ClientID, b.CreatedBy),
+		UserID:         b.CreatedBy,
+		MessageID:      b.MessageID,
+		Category:       b.Category,
+		Data:           b.Data,
+		Status:         mixin.MessageStatusSent,
+		CreatedAt:      b.SendAt,
+		UpdatedAt:      now,
+	}
+	if err := createMessage(ctx, b.ClientID, msg, getBroadcastMessageStatus(b.Segment.encode())); err != nil && !durable.CheckIsPKRepeatError(err) {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	SendBroadcast(ctx, &ClientUser{ClientID: b.ClientID, UserID: b.CreatedBy}, b.MessageID, b.Category, b.Data, now)
+}
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+	"github.com/shopspring/decimal"
+)
+
+const broadcast_segment_DDL = `
+-- 公告的目标成员，为空发给所有成员
+ALTER TABLE broadcast ADD COLUMN IF NOT EXISTS segment TEXT NOT NULL DEFAULT '';
+`
+
+// 公告的目标成员，所有条件同时满足
+type BroadcastSegment struct {
+	Status       []int           `json:"status,omitempty"`     // 成员身份
+	PayStatus    []int           `json:"pay_status,omitempty"` // 付费成员的身份，只包括没有过期的
+	JoinedAfter  time.Time       `json:"joined_after,omitempty"`
+	JoinedBefore time.Time       `json:"joined_before,omitempty"`
+	ActiveAfter  time.Time       `json:"active_after,omitempty"` // 按 read_at 判断活跃
+	ActiveBefore time.Time       `json:"active_before,omitempty"`
+	AssetID      string          `json:"asset_id,omitempty"`
+	AssetAmount  decimal.Decimal `json:"asset_amount,omitempty"` // 持有 asset_id 的最少数量
+	UserIDs      []string        `json:"user_ids,omitempty"`     // 上传的用户列表
+}
+
+const maxBroadcastSegmentUsers = 10000
+
+var broadcastSegmentStatus = map[int]bool{
+	ClientUserStatusAudience: true,
+	ClientUserStatusFresh:    true,
+	ClientUserStatusSenior:   true,
+	ClientUserStatusLarge:    true,
+	ClientUserStatusGuest:    true,
+	ClientUserStatusAdmin:    true,
+}
+
+func (s *BroadcastSegment) isEmpty() bool {
+	return s == nil || (len(s.Status) == 0 && len(s.PayStatus) == 0 &&
+		s.JoinedAfter.IsZero() && s.JoinedBefore.IsZero() &&
+		s.ActiveAfter.IsZero() && s.ActiveBefore.IsZero() &&
+		s.AssetID == "" && len(s.UserIDs) == 0)
+}
+
+func (s *BroadcastSegment) encode() string {
+	if s.isEmpty() {
+		return ""
+	}
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func decodeBroadcastSegment(data string) *BroadcastSegment {
+	if data == "" {
+		return nil
+	}
+	var s BroadcastSegment
+	if err := json.Unmarshal([]byte(data), &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+func checkBroadcastSegment(s *BroadcastSegment) bool {
+	if s.isEmpty() {
+		return true
+	}
+	for _, status := range s.Status {
+		if !broadcastSegmentStatus[status] {
+			return false
+		}
+	}
+	for _, status := range s.PayStatus {
+		if status != ClientUserStatusFresh && status != ClientUserStatusSenior && status != ClientUserStatusLarge {
+			return false
+		}
+	}
+	if s.AssetID != "" {
+		if _, err := uuid.FromString(s.AssetID); err != nil || s.AssetAmount.IsNegative() {
+			return false
+		}
+	}
+	if len(s.UserIDs) > maxBroadcastSegmentUsers {
+		return false
+	}
+	for _, userID := range s.UserIDs {
+		if _, err := uuid.FromString(userID); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+type BroadcastPreview struct {
+	Count   int  `json:"count"`
+	Pending bool `json:"pending"` // 按持币筛选时在后台统计，完成前返回 pending
+}
+
+const (
+	broadcastPreviewTTL     = 10 * time.Minute
+	broadcastAssetWorkers   = 10
+	userWalletAssetCacheTTL = 5 * time.Minute
+)
+
+// 发送前预览目标成员的数量，按持币筛选的结果保存在 redis 中，再次请求时返回
+func PreviewBroadcastSegment(ctx context.Context, u *ClientUser, s *BroadcastSegment) (*BroadcastPreview, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	if !checkBroadcastSegment(s) {
+		return nil, session.BadDataError(ctx)
+	}
+	if s.isEmpty() {
+		users, err := GetClientUserByPriority(ctx, u.ClientID, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, false, true)
+		return &BroadcastPreview{Count: len(users)}, err
+	}
+	if s.AssetID == "" {
+		users, err := getBroadcastSegmentUsers(ctx, u.ClientID, s)
+		return &BroadcastPreview{Count: len(users)}, err
+	}
+	key := "broadcast_preview:" + mixin.UniqueConversationID(u.ClientID, s.encode())
+	count, err := session.Redis(ctx).Get(ctx, key).Int()
+	if err == nil {
+		return &BroadcastPreview{Count: count}, nil
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	// 同一个条件只在后台统计一次
+	started, err := session.Redis(ctx).SetNX(ctx, key+":pending", 1, broadcastPreviewTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if started {
+		go func(clientID string, s BroadcastSegment) {
+			defer session.Redis(_ctx).Del(_ctx, key+":pending")
+			users, err := getBroadcastSegmentUsers(_ctx, clientID, &s)
+			if err != nil {
+				session.Logger(_ctx).Println(err)
+				return
+			}
+			if err := session.Redis(_ctx).Set(_ctx, key, len(users), broadcastPreviewTTL).Err(); err != nil {
+				session.Logger(_ctx).Println(err)
+			}
+		}(u.ClientID, *s)
+	}
+	return &BroadcastPreview{Pending: true}, nil
+}
+
+// 公告的接收成员，没有设置目标成员时发给所有人
+func getBroadcastUsers(ctx context.Context, clientID, msgID string) ([]string, error) {
+	var segment string
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT segment FROM broadcast WHERE client_id=$1 AND message_id=$2
+`, clientID, msgID).Scan(&segment)
+	if err != nil && !durable.IsEmpty(err) {
+		return nil, err
+	}
+	if s := decodeBroadcastSegment(segment); !s.isEmpty() {
+		return getBroadcastSegmentUsers(ctx, clientID, s)
+	}
+	return GetClientUserByPriority(ctx, clientID, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, false, true)
+}
+
+func getBroadcastSegmentUsers(ctx context.Context, clientID string, s *BroadcastSegment) ([]string, error) {
+	where := "client_id=$1 AND priority=ANY($2) AND status!=$3"
+	args := []interface{}{clientID, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, ClientUserStatusExit}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where += fmt.Sprintf(cond, len(args))
+	}
+	if len(s.Status) > 0 {
+		add(" AND status=ANY($%d)", s.Status)
+	}
+	if len(s.PayStatus) > 0 {
+		add(" AND pay_status=ANY($%d) AND pay_expired_at>NOW()", s.PayStatus)
+	}
+	if !s.JoinedAfter.IsZero() {
+		add(" AND created_at>=$%d", s.JoinedAfter)
+	}
+	if !s.JoinedBefore.IsZero() {
+		add(" AND created_at<$%d", s.JoinedBefore)
+	}
+	if !s.ActiveAfter.IsZero() {
+		add(" AND read_at>=$%d", s.ActiveAfter)
+	}
+	if !s.ActiveBefore.IsZero() {
+		add(" AND COALESCE(read_at,created_at)<$%d", s.ActiveBefore)
+	}
+	if len(s.UserIDs) > 0 {
+		add(" AND user_id=ANY($%d)", s.UserIDs)
+	}
+	users := make([]string, 0)
+	tokens := make(map[string]string)
+	err := session.Database(ctx).ConnQuery(ctx, fmt.Sprintf(`
+SELECT user_id,COALESCE(access_token,'') FROM client_users WHERE %s ORDER BY created_at
+`, where), func(rows pgx.Rows) error {
+		for rows.Next() {
+			var userID, token string
+			if err := rows.Scan(&userID, &token); err != nil {
+				return err
+			}
+			users = append(users, userID)
+			tokens[userID] = token
+		}
+		return nil
+	}, args...)
+	if err != nil || s.AssetID == "" {
+		return users, err
+	}
+	return filterBroadcastAssetHolders(ctx, users, tokens, s.AssetID, s.AssetAmount), nil
+}
+
+// 持币需要通过成员的授权查询，最多 broadcastAssetWorkers 个同时查询，保持成员的顺序
+func filterBroadcastAssetHolders(ctx context.Context, users []string, tokens map[string]string, assetID string, amount decimal.Decimal) []string {
+	holds := make([]bool, len(users))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < broadcastAssetWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				holds[i] = checkUserHoldsAsset(ctx, users[i], tokens[users[i]], assetID, amount)
+			}
+		}()
+	}
+	for i := range users {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	holders := make([]string, 0, len(users))
+	for i, userID := range users {
+		if holds[i] {
+			holders = append(holders, userID)
+		}
+	}
+	return holders
+}
+
+var cacheUserWalletAssets = tools.NewMutex()
+
+// 钱包余额缓存 5 分钟，预览和发送时不重复查询
+func checkUserHoldsAsset(ctx context.Context, userID, token, assetID string, amount decimal.Decimal) bool {
+	if token == "" {
+		return false
+	}
+	holdings, ok := cacheUserWalletAssets.Read(userID).(durable.AssetMap)
+	if !ok {
+		var err error
+		holdings, err = walletHoldingProvider{}.Holdings(ctx, &ClientUser{UserID: userID, AccessToken: token})
+		if err != nil {
+			return false
+		}
+		cacheUserWalletAssets.WriteWithTTL(userID, holdings, userWalletAssetCacheTTL)
+	}
+	balance := holdings[assetID]
+	return balance.IsPositive() && balance.GreaterThanOrEqual(amount)
+}
+
+// 定向公告不是所有成员都能看到，消息不进入历史消息、摘要、重新发送和补发
+func getBroadcastMessageStatus(segment string) int {
+	if segment != "" {
+		return MessageStatusSegmentMsg
+	}
+	return MessageStatusBroadcast
+}
@@ -177,6 +177,14 @@ WHERE client_id=ANY($1)
 }
 
 func GetFirstClient(ctx context.Context) *mixin.Client {
+	client := getFirstMixinClient(ctx)
+	if client == nil {
+		return nil
+	}
+	return client.Client
+}
+
+func getFirstMixinClient(ctx context.Context) *MixinClient {
 	c, err := getAllClient(ctx)
 	if err != nil {
 		return nil
@@ -185,12 +193,14 @@ func GetFirstClient(ctx context.Context) *mixin.Client {
 	if err != nil {
 		return nil
 	}
-	return client.Client
+	return client
 }
 
 type MixinClient struct {
 	*mixin.Client
 	C Client
+
+	Transport durable.Transport
 }
 
 var cacheClientMap *tools.Mutex
@@ -209,19 +219,26 @@ func GetMixinClientByIDOrHost(ctx context.Context, clientIDOrHost string) (*Mixi
 			}
 			return nil, err
 		}
-		client, err := mixin.NewFromKeystore(&mixin.Keystore{
+		keystore := &mixin.Keystore{
 			ClientID:   c.ClientID,
 			SessionID:  c.SessionID,
 			PinToken:   c.PinToken,
 			PrivateKey: c.PrivateKey,
-		})
+		}
+		client, err := mixin.NewFromKeystore(keystore)
+		if err != nil {
+			session.Logger(ctx).Println(err)
+			return nil, err
+		}
+		transport, err := durable.NewTransport(keystore)
 		if err != nil {
 			session.Logger(ctx).Println(err)
 			return nil, err
 		}
 		_client := MixinClient{
-			Client: client,
-			C:      c,
+			Client:    client,
+			C:         c,
+			Transport: transport,
 		}
 		cacheClientMap.Write(clientIDOrHost, &_client)
 		return &_client, nil
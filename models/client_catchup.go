@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+const client_catchup_policy_DDL = `
+-- 新成员入群和失活成员重新激活时补发消息的方式
+CREATE TABLE IF NOT EXISTS client_catchup_policy (
+  client_id           VARCHAR(36) NOT NULL PRIMARY KEY,
+  join_policy         SMALLINT NOT NULL DEFAULT 1, -- 0 不补发 1 最近 N 条 2 未读消息 3 置顶和公告 4 摘要
+  return_policy       SMALLINT NOT NULL DEFAULT 0,
+  latest_count        INTEGER NOT NULL DEFAULT 20, -- 最近 N 条的条数
+  max_count           INTEGER NOT NULL DEFAULT 200, -- 未读消息、置顶和公告最多补发的条数
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+`
+
+type ClientCatchupPolicy struct {
+	ClientID     string    `json:"client_id"`
+	JoinPolicy   int       `json:"join_policy"`
+	ReturnPolicy int       `json:"return_policy"`
+	LatestCount  int       `json:"latest_count"`
+	MaxCount     int       `json:"max_count"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+const (
+	CatchupPolicyNone       = 0 // 不补发
+	CatchupPolicyLatest     = 1 // 最近 N 条消息和置顶消息
+	CatchupPolicySinceRead  = 2 // 上次阅读之后的消息
+	CatchupPolicyHighlights = 3 // 只补发置顶和公告
+	CatchupPolicySummary    = 4 // 只发一条摘要和历史消息的链接
+)
+
+const (
+	maxCatchupLatestCount = 100
+	maxCatchupMaxCount    = 1000
+
+	// 补发较多消息时分批发送
+	catchupBatchSize     = 20
+	catchupBatchInterval = 2 * time.Second
+)
+
+func getClientCatchupPolicy(ctx context.Context, clientID string) (*ClientCatchupPolicy, error) {
+	p := ClientCatchupPolicy{
+		ClientID:     clientID,
+		JoinPolicy:   CatchupPolicyLatest,
+		ReturnPolicy: CatchupPolicyNone,
+		LatestCount:  20,
+		MaxCount:     200,
+	}
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT join_policy,return_policy,latest_count,max_count,updated_at
+FROM client_catchup_policy WHERE client_id=$1
+`, clientID).Scan(&p.JoinPolicy, &p.ReturnPolicy, &p.LatestCount, &p.MaxCount, &p.UpdatedAt)
+	if durable.IsEmpty(err) {
+		return &p, nil
+	}
+	return &p, err
+}
+
+func GetClientCatchupPolicyByAdmin(ctx context.Context, u *ClientUser) (*ClientCatchupPolicy, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getClientCatchupPolicy(ctx, u.ClientID)
+}
+
+func UpdateClientCatchupPolicy(ctx context.Context, u *ClientUser, p *ClientCatchupPolicy) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	for _, policy := range []int{p.JoinPolicy, p.ReturnPolicy} {
+		if policy < CatchupPolicyNone || policy > CatchupPolicySummary {
+			return session.BadDataError(ctx)
+		}
+	}
+	if p.LatestCount < 1 || p.LatestCount > maxCatchupLatestCount ||
+		p.MaxCount < 1 || p.MaxCount > maxCatchupMaxCount {
+		return session.BadDataError(ctx)
+	}
+	query := durable.InsertQueryOrUpdate("client_catchup_policy", "client_id", "join_policy,return_policy,latest_count,max_count,updated_at")
+	_, err := session.Database(ctx).Exec(ctx, query, u.ClientID, p.JoinPolicy, p.ReturnPolicy, p.LatestCount, p.MaxCount, time.Now())
+	return err
+}
+
+// 失活用户重新激活之前的阅读时间
+func getClientUserReadAt(ctx context.Context, clientID, userID string) time.Time {
+	var readAt time.Time
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT COALESCE(read_at,created_at) FROM client_users WHERE client_id=$1 AND user_id=$2
+`, clientID, userID).Scan(&readAt); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	return readAt
+}
+
+// 失活用户重新激活后，按社群的设置补发离开期间的消息
+func catchUpReturningMember(clientID, userID string, readAt time.Time) {
+	if readAt.IsZero() {
+		return
+	}
+	p, err := getClientCatchupPolicy(_ctx, clientID)
+	if err != nil {
+		session.Logger(_ctx).Println(err)
+		return
+	}
+	if p.ReturnPolicy == CatchupPolicyNone {
+		return
+	}
+	// 激活可能同时被多条消息回执触发，只补发一次
+	key := fmt.Sprintf("catchup:%s:%s", clientID, userID)
+	if ok, err := session.Redis(_ctx).SetNX(_ctx, key, "1", time.Hour).Result(); err != nil || !ok {
+		return
+	}
+	c, err := GetClientUserByClientIDAndUserID(_ctx, clientID, userID)
+	if err != nil {
+		session.Logger(_ctx).Println(err)
+		return
+	}
+	_ = UpdateClientUserPriority(_ctx, clientID, userID, ClientUserPriorityPending)
+	catchUpMember(_ctx, clientID, userID, p, p.ReturnPolicy, readAt)
+	_ = UpdateClientUserPriority(_ctx, clientID, userID, c.Priority)
+}
+
+// since 之后的消息按 policy 补发给用户，调用方负责把用户设置为补发中
+func catchUpMember(ctx context.Context, clientID, userID string, p *ClientCatchupPolicy, policy int, since time.Time) {
+	if policy == CatchupPolicyLatest {
+		// 已经补发了期间新产生的消息
+		sendPendingMsgByCount(ctx, clientID, userID, p.LatestCount)
+		return
+	}
+	startAt := time.Now()
+	switch policy {
+	case CatchupPolicySinceRead:
+		sendCatchupMsgsByStatus(ctx, clientID, userID, p, since, startAt, []int{MessageStatusPrivilege, MessageStatusFinished, MessageStatusBroadcast, MessageStatusPINMsg})
+	case CatchupPolicyHighlights:
+		sendCatchupMsgsByStatus(ctx, clientID, userID, p, since, startAt, []int{MessageStatusBroadcast, MessageStatusPINMsg})
+	case CatchupPolicySummary:
+		sendCatchupSummary(ctx, clientID, userID, since)
+	default:
+		return
+	}
+	// 补发期间用户处于补发中，群里新产生的消息不会发给用户
+	lastCreatedAt := startAt
+	var err error
+	for !lastCreatedAt.IsZero() {
+		if lastCreatedAt, err = sendLeftMsg(ctx, clientID, userID, lastCreatedAt); err != nil {
+			session.Logger(ctx).Println(err)
+			return
+		}
+	}
+}
+
+// 补发 since 到 until 之间指定状态的消息，until 之后的消息由 sendLeftMsg 补发
+func sendCatchupMsgsByStatus(ctx context.Context, clientID, userID string, p *ClientCatchupPolicy, since, until time.Time, status []int) {
+	msgs, err := getMsgWithSQL(ctx, clientID, userID, `
+SELECT user_id,message_id,category,data,status,created_at
+FROM messages
+WHERE client_id=$1
+AND created_at>$2
+AND created_at<=$3
+AND status=ANY($4)
+AND category!='MESSAGE_RECALL'
+AND category!='MESSAGE_PIN'
+ORDER BY created_at DESC
+LIMIT $5`, clientID, since, until, status, p.MaxCount)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	if len(msgs) == p.MaxCount {
+		// 超出上限的部分只能在历史消息中查看
+		sendCatchupSummary(ctx, clientID, userID, since)
+	}
+	if err := sendCatchupMsgs(ctx, clientID, userID, msgs); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
+
+// msgs 按时间倒序，从最早的消息开始分批发送
+func sendCatchupMsgs(ctx context.Context, clientID, userID string, msgs []*Message) error {
+	for end := len(msgs); end > 0; end -= catchupBatchSize {
+		start := end - catchupBatchSize
+		if start < 0 {
+			start = 0
+		}
+		if _, err := distributeMsg(ctx, msgs[start:end], clientID, userID); err != nil {
+			return err
+		}
+		if start > 0 {
+			time.Sleep(catchupBatchInterval)
+		}
+	}
+	return nil
+}
+
+func sendCatchupSummary(ctx context.Context, clientID, userID string, since time.Time) {
+	var count int
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT COUNT(1) FROM messages
+WHERE client_id=$1 AND created_at>$2 AND status=ANY($3) AND category!='MESSAGE_RECALL' AND category!='MESSAGE_PIN'
+`, clientID, since, historyMessageStatus).Scan(&count); err != nil {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	if count == 0 {
+		return
+	}
+	c, err := GetClientByIDOrHost(ctx, clientID)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	if err := SendTextMsg(ctx, clientID, userID, strings.ReplaceAll(config.Text.CatchupSummary, "{count}", strconv.Itoa(count))); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	if err := SendBtnMsg(ctx, clientID, userID, mixin.AppButtonGroupMessage{
+		{Label: config.Text.History, Action: fmt.Sprintf("%s/history", c.Host), Color: "#5979F0"},
+	}); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
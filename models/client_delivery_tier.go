@@ -0,0 +1,323 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+)
+
+const client_delivery_tier_DDL = `
+-- 社群的分发梯队，按 tier_index 从小到大依次创建分发消息
+CREATE TABLE IF NOT EXISTS client_delivery_tier (
+  client_id          VARCHAR(36) NOT NULL,
+  tier_index         SMALLINT NOT NULL,
+  name               VARCHAR NOT NULL DEFAULT '',
+  priority           SMALLINT[] NOT NULL DEFAULT '{}', -- 匹配的用户优先级，为空不限制
+  status             SMALLINT[] NOT NULL DEFAULT '{}', -- 匹配的用户身份，为空不限制
+  is_paid            BOOLEAN NOT NULL DEFAULT false,   -- 只匹配付费未过期的用户
+  active_days        INTEGER NOT NULL DEFAULT 0,       -- 只匹配 N 天内阅读过消息的用户，0 不限制
+  delay              INTEGER NOT NULL DEFAULT 0,       -- 上一个梯队创建后延迟多少秒，单位秒
+  PRIMARY KEY(client_id, tier_index)
+);
+`
+
+type ClientDeliveryTier struct {
+	ClientID   string `json:"client_id,omitempty"`
+	TierIndex  int    `json:"tier_index"`
+	Name       string `json:"name"`
+	Priority   []int  `json:"priority"`
+	Status     []int  `json:"status"`
+	IsPaid     bool   `json:"is_paid"`
+	ActiveDays int    `json:"active_days"`
+	Delay      int    `json:"delay"`
+}
+
+const maxDeliveryTierCount = 10
+
+// 没有配置梯队的社群，沿用高优先级、低优先级两个梯队
+func defaultDeliveryTiers(clientID string) []*ClientDeliveryTier {
+	return []*ClientDeliveryTier{
+		{ClientID: clientID, TierIndex: 0, Name: "high", Priority: []int{ClientUserPriorityHigh}, Status: []int{}},
+		{ClientID: clientID, TierIndex: 1, Name: "low", Priority: []int{ClientUserPriorityLow}, Status: []int{}},
+	}
+}
+
+var cacheDeliveryTiers = tools.NewMutex()
+
+func GetClientDeliveryTiers(ctx context.Context, clientID string) ([]*ClientDeliveryTier, error) {
+	if tiers, ok := cacheDeliveryTiers.Read(clientID).([]*ClientDeliveryTier); ok {
+		return tiers, nil
+	}
+	tiers := make([]*ClientDeliveryTier, 0)
+	if err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id, tier_index, name, priority, status, is_paid, active_days, delay
+FROM client_delivery_tier
+WHERE client_id=$1
+ORDER BY tier_index
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var t ClientDeliveryTier
+			if err := rows.Scan(&t.ClientID, &t.TierIndex, &t.Name, &t.Priority, &t.Status, &t.IsPaid, &t.ActiveDays, &t.Delay); err != nil {
+				return err
+			}
+			tiers = append(tiers, &t)
+		}
+		return nil
+	}, clientID); err != nil {
+		return nil, err
+	}
+	if len(tiers) == 0 {
+		tiers = defaultDeliveryTiers(clientID)
+	}
+	cacheDeliveryTiers.Write(clientID, tiers)
+	go func() {
+		time.Sleep(time.Minute)
+		cacheDeliveryTiers.Delete(clientID)
+	}()
+	return tiers, nil
+}
+
+func GetClientDeliveryTiersByAdmin(ctx context.Context, u *ClientUser) ([]*ClientDeliveryTier, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return GetClientDeliveryTiers(ctx, u.ClientID)
+}
+
+// 整体替换社群的分发梯队，梯队的顺序即分发的顺序
+func UpdateClientDeliveryTiers(ctx context.Context, u *ClientUser, tiers []*ClientDeliveryTier) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	if len(tiers) == 0 || len(tiers) > maxDeliveryTierCount {
+		return session.BadDataError(ctx)
+	}
+	for _, t := range tiers {
+		if t.Delay < 0 || t.ActiveDays < 0 {
+			return session.BadDataError(ctx)
+		}
+		for _, p := range t.Priority {
+			if p != ClientUserPriorityHigh && p != ClientUserPriorityLow {
+				return session.BadDataError(ctx)
+			}
+		}
+		for _, s := range t.Status {
+			if s == ClientUserStatusExit || s == ClientUserStatusBlock {
+				return session.BadDataError(ctx)
+			}
+		}
+		if t.Priority == nil {
+			t.Priority = []int{}
+		}
+		if t.Status == nil {
+			t.Status = []int{}
+		}
+	}
+	err := session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM client_delivery_tier WHERE client_id=$1`, u.ClientID); err != nil {
+			return err
+		}
+		for i, t := range tiers {
+			if _, err := tx.Exec(ctx, `
+INSERT INTO client_delivery_tier(client_id, tier_index, name, priority, status, is_paid, active_days, delay)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+`, u.ClientID, i, t.Name, t.Priority, t.Status, t.IsPaid, t.ActiveDays, t.Delay); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cacheDeliveryTiers.Delete(u.ClientID)
+	return nil
+}
+
+func (t *ClientDeliveryTier) match(u *ClientUser, now time.Time) bool {
+	if len(t.Priority) > 0 && !containsInt(t.Priority, u.Priority) {
+		return false
+	}
+	if len(t.Status) > 0 && !containsInt(t.Status, u.Status) {
+		return false
+	}
+	if t.IsPaid && u.PayExpiredAt.Before(now) {
+		return false
+	}
+	if t.ActiveDays > 0 && u.ReadAt.Before(now.Add(-time.Duration(t.ActiveDays)*24*time.Hour)) {
+		return false
+	}
+	return true
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
+// 一次查询把用户分到各个梯队，用户只属于第一个匹配的梯队，都不匹配的用户归到最后一个梯队
+func getClientUserByDeliveryTiers(ctx context.Context, clientID string, tiers []*ClientDeliveryTier, modes []int) ([][]string, error) {
+	userLists := make([][]string, len(tiers))
+	for i := range userLists {
+		userLists[i] = make([]string, 0)
+	}
+	now := time.Now()
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT user_id, priority, status, pay_expired_at, read_at FROM client_users
+WHERE client_id=$1 AND priority=ANY($2) AND is_received=true AND status!=$3 AND delivery_mode=ANY($4)
+ORDER BY created_at
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var u ClientUser
+			if err := rows.Scan(&u.UserID, &u.Priority, &u.Status, &u.PayExpiredAt, &u.ReadAt); err != nil {
+				return err
+			}
+			index := len(tiers) - 1
+			for i, t := range tiers {
+				if t.match(&u, now) {
+					index = i
+					break
+				}
+			}
+			userLists[index] = append(userLists[index], u.UserID)
+		}
+		return nil
+	}, clientID, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, ClientUserStatusExit, modes)
+	return userLists, err
+}
+
+func msgTierUsersKey(msgID string) string {
+	return "msg_tier_users:" + msgID
+}
+
+// 第一个梯队创建时分好所有梯队的用户，后面的梯队直接从 redis 中读取
+func getMessageTierUsers(ctx context.Context, clientID string, msg *Message, tiers []*ClientDeliveryTier, tierIndex int) ([]string, error) {
+	key := msgTierUsersKey(msg.MessageID)
+	if tierIndex > 0 {
+		res, err := session.Redis(ctx).HGet(ctx, key, strconv.Itoa(tierIndex)).Result()
+		if err == nil {
+			if res == "" {
+				return []string{}, nil
+			}
+			return strings.Split(res, ","), nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+	modes := deliveryModesBySender(ctx, clientID, msg.UserID)
+	userLists, err := getClientUserByDeliveryTiers(ctx, clientID, tiers, modes)
+	if err != nil {
+		return nil, err
+	}
+	if tierIndex < len(tiers)-1 {
+		if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+			for i := tierIndex + 1; i < len(tiers); i++ {
+				if err := p.HSet(ctx, key, strconv.Itoa(i), strings.Join(userLists[i], ",")).Err(); err != nil {
+					return err
+				}
+			}
+			return p.Expire(ctx, key, 7*24*time.Hour).Err()
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return userLists[tierIndex], nil
+}
+
+// 消息分发到了第几个梯队
+type MessageTierProgress struct {
+	Next      int       // 下一个要创建的梯队
+	CreatedAt time.Time // 上一个梯队的创建时间
+	Done      bool
+}
+
+func GetMessageTierProgress(ctx context.Context, msgID string) (*MessageTierProgress, error) {
+	res, err := session.Redis(ctx).Get(ctx, "msg_tier:"+msgID).Result()
+	if err == nil {
+		tmp := strings.Split(res, ",")
+		if len(tmp) == 2 {
+			next, _ := strconv.Atoi(tmp[0])
+			createdAt, _ := strconv.ParseInt(tmp[1], 10, 64)
+			return &MessageTierProgress{Next: next, CreatedAt: time.Unix(0, createdAt)}, nil
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	// 兼容只有 msg_status 的消息
+	status, err := session.Redis(ctx).Get(ctx, "msg_status:"+msgID).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	switch status {
+	case 0:
+		return &MessageTierProgress{}, nil
+	case MessageStatusPrivilege:
+		return &MessageTierProgress{Next: 1}, nil
+	default:
+		return &MessageTierProgress{Done: true}, nil
+	}
+}
+
+// 按梯队创建分发消息，并记录梯队进度
+func CreateDistributeMsgByTier(ctx context.Context, clientID string, msg *Message, tiers []*ClientDeliveryTier, tierIndex int) error {
+	userList, err := getMessageTierUsers(ctx, clientID, msg, tiers, tierIndex)
+	if err != nil {
+		return err
+	}
+	// level 只区分高低优先级，梯队的进度保存在 redis 的 msg_tier 中
+	level := DistributeMessageLevelLower
+	if tierIndex == 0 {
+		level = DistributeMessageLevelHigher
+	}
+	isLast := tierIndex == len(tiers)-1
+	status := MessageStatusPrivilege
+	if isLast {
+		status = MessageStatusFinished
+	}
+	if err := createDistributeMsgByUserList(ctx, clientID, &mixin.MessageView{
+		UserID:         msg.UserID,
+		MessageID:      msg.MessageID,
+		Category:       msg.Category,
+		Data:           msg.Data,
+		QuoteMessageID: msg.QuoteMessageID,
+		CreatedAt:      msg.CreatedAt,
+	}, userList, level, status, ""); err != nil {
+		return err
+	}
+	if isLast {
+		return FinishMessageTiers(ctx, clientID, msg.MessageID)
+	}
+	return session.Redis(ctx).Set(ctx, "msg_tier:"+msg.MessageID, fmt.Sprintf("%d,%d", tierIndex+1, time.Now().UnixNano()), 7*24*time.Hour).Err()
+}
+
+// 所有梯队都创建完成，如果分发消息已经全部发送，直接把消息标记为完成
+func FinishMessageTiers(ctx context.Context, clientID, msgID string) error {
+	if err := session.Redis(ctx).Del(ctx, "msg_tier:"+msgID, msgTierUsersKey(msgID)).Err(); err != nil {
+		return err
+	}
+	balance, err := session.Redis(ctx).Get(ctx, "l_msg:"+msgID).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	if balance > 0 {
+		return session.Redis(ctx).Set(ctx, "msg_status:"+msgID, strconv.Itoa(MessageStatusFinished), -1).Err()
+	}
+	if err := session.Redis(ctx).Set(ctx, "msg_status:"+msgID, strconv.Itoa(MessageRedisStatusFinished), time.Minute).Err(); err != nil {
+		return err
+	}
+	return updateMessageStatus(ctx, clientID, msgID, MessageStatusFinished)
+}
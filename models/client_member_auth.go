@@ -128,7 +128,7 @@ WHERE client_id=$1 AND user_status=$2
 	return err
 }
 
-func checkHasClientMemberAuth(ctx context.Context, clientID, category string, userStatus int) bool {
+func checkHasClientMemberAuth(ctx context.Context, clientID, userID, category string, userStatus int) bool {
 	if strings.HasPrefix(category, "ENCRYPTED_") {
 		category = strings.Replace(category, "ENCRYPTED_", "PLAIN_", 1)
 	}
@@ -139,6 +139,10 @@ func checkHasClientMemberAuth(ctx context.Context, clientID, category string, us
 		session.Logger(ctx).Println(category)
 		return false
 	}
+	// 有等级的成员使用等级的权限
+	if t := getClientUserTier(ctx, clientID, userID, userStatus); t != nil {
+		return t.Permissions[category]
+	}
 	if userStatus > 5 {
 		userStatus = 5
 	}
@@ -0,0 +1,306 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const client_member_tier_DDL = `
+-- 社群自定义的会员等级，设置后代替 client_asset_level 的固定等级
+CREATE TABLE IF NOT EXISTS client_member_tier (
+  client_id           VARCHAR(36) NOT NULL,
+  level               SMALLINT NOT NULL, -- 从 1 开始，越大等级越高
+  name                VARCHAR(32) NOT NULL,
+  amount              VARCHAR NOT NULL DEFAULT '0', -- 持有社群币的数量
+  usd_amount          VARCHAR NOT NULL DEFAULT '0', -- 持仓的美元价值
+  price               VARCHAR NOT NULL DEFAULT '0', -- 付费价格，0 不能付费
+  duration            INTEGER NOT NULL DEFAULT 365, -- 付费的有效天数
+  msg_limit           INTEGER NOT NULL DEFAULT 10, -- 每分钟最多发送的消息数
+  permissions         TEXT NOT NULL DEFAULT '', -- 可以发送的消息类型，JSON
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(client_id, level)
+);
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS level SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS pay_level SMALLINT NOT NULL DEFAULT 0;
+`
+
+type ClientMemberTier struct {
+	ClientID    string          `json:"client_id,omitempty"`
+	Level       int             `json:"level"`
+	Name        string          `json:"name"`
+	Amount      decimal.Decimal `json:"amount"`
+	UsdAmount   decimal.Decimal `json:"usd_amount"`
+	Price       decimal.Decimal `json:"price"`
+	Duration    int             `json:"duration"`
+	MsgLimit    int             `json:"msg_limit"`
+	Permissions map[string]bool `json:"permissions"`
+	UpdatedAt   time.Time       `json:"updated_at,omitempty"`
+}
+
+const (
+	maxMemberTierCount    = 20
+	maxMemberTierDuration = 10 * 365
+)
+
+// 有等级的成员使用资深的身份，权限和发言频率由等级决定
+const ClientUserStatusTier = ClientUserStatusSenior
+
+var cacheClientMemberTiers = tools.NewMutex()
+
+// 按等级从低到高排列
+func getClientMemberTiers(ctx context.Context, clientID string) ([]*ClientMemberTier, error) {
+	if tiers, ok := cacheClientMemberTiers.Read(clientID).([]*ClientMemberTier); ok {
+		return tiers, nil
+	}
+	tiers := make([]*ClientMemberTier, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id,level,name,amount,usd_amount,price,duration,msg_limit,permissions,updated_at
+FROM client_member_tier WHERE client_id=$1 ORDER BY level
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var t ClientMemberTier
+			var permissions string
+			if err := rows.Scan(&t.ClientID, &t.Level, &t.Name, &t.Amount, &t.UsdAmount, &t.Price, &t.Duration, &t.MsgLimit, &permissions, &t.UpdatedAt); err != nil {
+				return err
+			}
+			t.Permissions = make(map[string]bool)
+			if permissions != "" {
+				_ = json.Unmarshal([]byte(permissions), &t.Permissions)
+			}
+			tiers = append(tiers, &t)
+		}
+		return nil
+	}, clientID)
+	if err != nil {
+		return nil, err
+	}
+	cacheClientMemberTiers.WriteWithTTL(clientID, tiers, time.Minute)
+	return tiers, nil
+}
+
+func getClientMemberTier(ctx context.Context, clientID string, level int) *ClientMemberTier {
+	if level <= 0 {
+		return nil
+	}
+	tiers, err := getClientMemberTiers(ctx, clientID)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return nil
+	}
+	for _, t := range tiers {
+		if t.Level == level {
+			return t
+		}
+	}
+	return nil
+}
+
+// 网页中展示的等级
+func GetClientMemberTiersByHost(ctx context.Context, host string) ([]*ClientMemberTier, error) {
+	c, err := GetClientInfoByHostOrID(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return getClientMemberTiers(ctx, c.ClientID)
+}
+
+// 整体替换社群的等级，为空时恢复使用 client_asset_level 的固定等级
+func UpdateClientMemberTiers(ctx context.Context, u *ClientUser, tiers []*ClientMemberTier) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	c, err := GetClientByIDOrHost(ctx, u.ClientID)
+	if err != nil {
+		return err
+	}
+	if len(tiers) > maxMemberTierCount {
+		return session.BadDataError(ctx)
+	}
+	levels := make(map[int]bool)
+	for _, t := range tiers {
+		t.Name = strings.TrimSpace(t.Name)
+		if t.Level < 1 || t.Level > maxMemberTierCount || levels[t.Level] || t.Name == "" || len(t.Name) > 32 ||
+			t.Amount.IsNegative() || t.UsdAmount.IsNegative() || t.Price.IsNegative() ||
+			(t.Amount.IsPositive() && c.AssetID == "") ||
+			t.MsgLimit < 1 || t.MsgLimit > statusLimitMap[ClientUserStatusGuest] {
+			return session.BadDataError(ctx)
+		}
+		if t.Price.IsPositive() && (t.Duration < 1 || t.Duration > maxMemberTierDuration) {
+			return session.BadDataError(ctx)
+		}
+		for category := range t.Permissions {
+			if !checkCategoryIsValid(category) {
+				return session.BadDataError(ctx)
+			}
+		}
+		levels[t.Level] = true
+	}
+	err = session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM client_member_tier WHERE client_id=$1`, u.ClientID); err != nil {
+			return err
+		}
+		for _, t := range tiers {
+			permissions, _ := json.Marshal(t.Permissions)
+			if _, err := tx.Exec(ctx, `
+INSERT INTO client_member_tier(client_id,level,name,amount,usd_amount,price,duration,msg_limit,permissions,updated_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,NOW())
+`, u.ClientID, t.Level, t.Name, t.Amount.String(), t.UsdAmount.String(), t.Price.String(), t.Duration, t.MsgLimit, string(permissions)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cacheClientMemberTiers.Delete(u.ClientID)
+	return nil
+}
+
+// 按持仓计算等级，和付费等级取较高的一个，保存到 client_users.level
+func getClientUserTierStatus(ctx context.Context, client *MixinClient, u *ClientUser, holdings map[string]durable.AssetMap, providers []*ClientHoldingProvider, tiers []*ClientMemberTier) (int, error) {
+	top := ClientAssetLevel{Large: tiers[len(tiers)-1].Amount}
+	assetAmount, usdAmount := decimal.Zero, decimal.Zero
+	for _, p := range providers {
+		h, ok := holdings[p.Provider]
+		if !ok {
+			continue
+		}
+		if client.C.AssetID != "" {
+			amount, err := getHasAssetUserStatus(ctx, client, h, top)
+			if err != nil {
+				session.Logger(ctx).Println(err)
+				return ClientUserStatusAudience, nil
+			}
+			assetAmount = assetAmount.Add(amount.Mul(p.Weight))
+		}
+		amount, _ := getNoAssetUserStatus(ctx, client, h)
+		usdAmount = usdAmount.Add(amount.Mul(p.Weight))
+	}
+	level := 0
+	for _, t := range tiers {
+		if (t.Amount.IsPositive() && assetAmount.GreaterThanOrEqual(t.Amount)) ||
+			(t.UsdAmount.IsPositive() && usdAmount.GreaterThanOrEqual(t.UsdAmount)) {
+			level = t.Level
+		}
+	}
+	var payLevel, current int
+	var payExpiredAt time.Time
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT level,pay_level,pay_expired_at FROM client_users WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID).Scan(&current, &payLevel, &payExpiredAt); err != nil && !durable.IsEmpty(err) {
+		return ClientUserStatusAudience, err
+	}
+	if payExpiredAt.After(time.Now()) && payLevel > level {
+		level = payLevel
+	}
+	if level != current {
+		if err := updateClientUserLevel(ctx, u.ClientID, u.UserID, level); err != nil {
+			return ClientUserStatusAudience, err
+		}
+	}
+	if level > 0 {
+		return ClientUserStatusTier, nil
+	}
+	return ClientUserStatusAudience, nil
+}
+
+func updateClientUserLevel(ctx context.Context, clientID, userID string, level int) error {
+	_, err := session.Database(ctx).Exec(ctx, `
+UPDATE client_users SET level=$3 WHERE client_id=$1 AND user_id=$2
+`, clientID, userID, level)
+	session.Redis(ctx).Del(ctx, fmt.Sprintf("client_user:%s:%s", clientID, userID))
+	return err
+}
+
+// 成员当前的等级，管理员、嘉宾和没有等级的成员返回 nil
+func getClientUserTier(ctx context.Context, clientID, userID string, status int) *ClientMemberTier {
+	if status == ClientUserStatusAdmin || status == ClientUserStatusGuest || status == ClientUserStatusAudience {
+		return nil
+	}
+	if tiers, err := getClientMemberTiers(ctx, clientID); err != nil || len(tiers) == 0 {
+		return nil
+	}
+	// 等级和成员一起缓存在 redis 中
+	u, err := GetClientUserByClientIDAndUserID(ctx, clientID, userID)
+	if err != nil {
+		if !durable.IsEmpty(err) {
+			session.Logger(ctx).Println(err)
+		}
+		return nil
+	}
+	return getClientMemberTier(ctx, clientID, u.Level)
+}
+
+// 有等级的成员使用等级的名称，没有时使用身份的名称
+func getClientUserLevelName(tiers []*ClientMemberTier, status, level int) string {
+	if status != ClientUserStatusAdmin && status != ClientUserStatusGuest && status != ClientUserStatusAudience {
+		for _, t := range tiers {
+			if t.Level == level {
+				return t.Name
+			}
+		}
+	}
+	return config.Text.MemberLevel[status]
+}
+
+// 每分钟最多发送的消息数，有等级时使用等级的设置
+func getUserMessageLimit(ctx context.Context, clientID, userID string, status int) int {
+	if t := getClientUserTier(ctx, clientID, userID, status); t != nil {
+		return t.MsgLimit
+	}
+	return statusLimitMap[status]
+}
+
+// 付费购买等级，同一等级在有效期内续费时从到期时间开始延长
+func handleTierSnapshot(ctx context.Context, c *Client, tiers []*ClientMemberTier, s *mixin.Snapshot) error {
+	assetID := c.AssetID
+	if assetID == "" {
+		assetID = USDTAssetID
+	}
+	var tier *ClientMemberTier
+	for _, t := range tiers {
+		if t.Price.IsPositive() && s.AssetID == assetID && s.Amount.Equal(t.Price) {
+			tier = t
+		}
+	}
+	if tier == nil {
+		session.Logger(ctx).Println("member to tier amount error...")
+		tools.PrintJson(s)
+		return nil
+	}
+	var payLevel int
+	var payExpiredAt time.Time
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT pay_level,pay_expired_at FROM client_users WHERE client_id=$1 AND user_id=$2
+`, c.ClientID, s.OpponentID).Scan(&payLevel, &payExpiredAt); err != nil {
+		return err
+	}
+	start := s.CreatedAt
+	if payLevel == tier.Level && payExpiredAt.After(start) {
+		start = payExpiredAt
+	}
+	expiredAt := start.Add(time.Duration(tier.Duration) * 24 * time.Hour)
+	session.Redis(ctx).Del(ctx, fmt.Sprintf("client_user:%s:%s", c.ClientID, s.OpponentID))
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE client_users SET status=$3,priority=1,pay_status=$3,pay_expired_at=$4,pay_level=$5,level=GREATEST(level,$5)
+WHERE client_id=$1 AND user_id=$2
+`, c.ClientID, s.OpponentID, ClientUserStatusTier, expiredAt, tier.Level); err != nil {
+		return err
+	}
+	msg := strings.ReplaceAll(config.Text.PayForTier, "{tier}", tier.Name)
+	msg = strings.ReplaceAll(msg, "{expired_at}", expiredAt.Format("2006-01-02"))
+	go SendTextMsg(_ctx, c.ClientID, s.OpponentID, msg)
+	return nil
+}
@@ -0,0 +1,62 @@
+//go:build integration
+// +build integration
+
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/shopspring/decimal"
+)
+
+func TestGetClientUserStatusWeightedTiers(t *testing.T) {
+	durable.UseFakeTransport()
+	clientID := createTestClient(t, "zh")
+	assetID := setTestClientAsset(t, clientID)
+	for _, tier := range []struct {
+		level  int
+		name   string
+		amount string
+	}{{1, "Bronze", "10"}, {2, "Gold", "100"}} {
+		if _, err := session.Database(_ctx).Exec(_ctx, `
+INSERT INTO client_member_tier(client_id,level,name,amount) VALUES($1,$2,$3,$4)
+`, clientID, tier.level, tier.name, tier.amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheClientMemberTiers.Delete(clientID)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, session.Database(_ctx))
+		if _, err := session.Database(ctx).Exec(ctx, `DELETE FROM client_member_tier WHERE client_id=$1`, clientID); err != nil {
+			t.Log(err)
+		}
+		cacheClientMemberTiers.Delete(clientID)
+	})
+
+	n := decimal.NewFromInt
+	cases := []*weightedStatusCase{
+		{a: n(5), b: n(4), want: ClientUserStatusAudience},
+		{a: n(5), b: n(10), want: ClientUserStatusTier},
+		{a: n(60), b: n(80), want: ClientUserStatusTier},
+		{a: n(0), b: n(150), want: ClientUserStatusTier},
+	}
+	// 和 cases 一一对应，按权重折算后达到的最高等级
+	levels := []int{0, 1, 2, 1}
+	setupWeightedStatusCases(t, clientID, assetID, cases)
+	checkWeightedStatus(t, clientID, cases)
+	for i, c := range cases {
+		var level int
+		if err := session.Database(_ctx).QueryRow(_ctx, `
+SELECT level FROM client_users WHERE client_id=$1 AND user_id=$2
+`, clientID, c.userID).Scan(&level); err != nil {
+			t.Fatal(err)
+		}
+		if level != levels[i] {
+			t.Fatalf("a=%s b=%s: got level %d, want %d", c.a, c.b, level, levels[i])
+		}
+	}
+}
@@ -50,7 +50,7 @@ func SendJoinMsg(clientID, userID string) {
 		session.Logger(_ctx).Println(err)
 		return
 	}
-	if err := SendTextMsg(_ctx, clientID, userID, c.JoinMsg); err != nil {
+	if err := SendTextMsg(_ctx, clientID, userID, renderJoinTemplateText(_ctx, &c, userID, c.JoinMsg)); err != nil {
 		session.Logger(_ctx).Println(err)
 		return
 	}
@@ -75,7 +75,14 @@ func SendCategoryMsg(clientID, userID, category string, status int) {
 	}
 	msg := strings.ReplaceAll(config.Text.CategoryReject, "{category}", config.Text.Category[category])
 	isFreshMember := status < ClientUserStatusLarge
-	if isFreshMember {
+	// 有等级的成员提示当前等级的名称，最高等级不再提示
+	if t := getClientUserTier(_ctx, clientID, userID, status); t != nil {
+		tiers, _ := getClientMemberTiers(_ctx, clientID)
+		isFreshMember = len(tiers) > 0 && t.Level < tiers[len(tiers)-1].Level
+		if isFreshMember {
+			msg += strings.ReplaceAll(config.Text.TierTips, "{tier}", t.Name)
+		}
+	} else if isFreshMember {
 		msg += config.Text.MemberTips
 	}
 	if err := SendTextMsg(_ctx, clientID, userID, msg); err != nil {
@@ -222,7 +229,7 @@ func handleLeaveMsg(clientID, userID, originMsgID string, msg *mixin.MessageView
 	if err != nil {
 		return
 	}
-	_ = SendMessages(_ctx, client.Client, msgList)
+	_ = SendMessages(_ctx, client.Transport, msgList)
 }
 
 // 处理 用户的 链接 或 二维码的消息
@@ -282,7 +289,7 @@ func rejectMsgAndDeliverManagerWithOperationBtns(clientID string, msg *mixin.Mes
 	if err != nil {
 		return
 	}
-	client := c.Client
+	client := c.Transport
 	err = SendMessages(_ctx, client, oriMsg)
 	if err != nil {
 		session.Logger(_ctx).Println(err)
@@ -360,7 +367,7 @@ func SendClientTextMsg(clientID, msg, userID string, isJoinMsg bool) {
 		}
 	}
 
-	if err := SendBatchMessages(_ctx, c.Client, msgList); err != nil {
+	if err := SendBatchMessages(_ctx, c.Transport, msgList); err != nil {
 		session.Logger(_ctx).Println(err)
 		return
 	}
@@ -400,7 +407,7 @@ func SendClientMsg(clientID, category, data string) {
 		})
 	}
 
-	if err := SendBatchMessages(_ctx, c.Client, msgList); err != nil {
+	if err := SendBatchMessages(_ctx, c.Transport, msgList); err != nil {
 		session.Logger(_ctx).Println(err)
 		return
 	}
@@ -416,7 +423,7 @@ func SendTextMsg(ctx context.Context, clientID, userID, data string) error {
 		return errors.New("client is nil")
 	}
 	conversationID := mixin.UniqueConversationID(client.ClientID, userID)
-	if err := SendMessage(ctx, client.Client, &mixin.MessageRequest{
+	if err := SendMessage(ctx, client.Transport, &mixin.MessageRequest{
 		ConversationID: conversationID,
 		RecipientID:    userID,
 		MessageID:      tools.GetUUID(),
@@ -437,7 +444,7 @@ func SendTextMsgWithQuote(ctx context.Context, clientID, userID, data, quoteMsgI
 		return errors.New("client is nil")
 	}
 	conversationID := mixin.UniqueConversationID(client.ClientID, userID)
-	if err := SendMessage(ctx, client.Client, &mixin.MessageRequest{
+	if err := SendMessage(ctx, client.Transport, &mixin.MessageRequest{
 		ConversationID: conversationID,
 		RecipientID:    userID,
 		MessageID:      tools.GetUUID(),
@@ -456,7 +463,7 @@ func SendBtnMsg(ctx context.Context, clientID, userID string, data mixin.AppButt
 		return errors.New("client is nil")
 	}
 	conversationID := mixin.UniqueConversationID(client.ClientID, userID)
-	if err := SendMessage(ctx, client.Client, &mixin.MessageRequest{
+	if err := SendMessage(ctx, client.Transport, &mixin.MessageRequest{
 		ConversationID: conversationID,
 		RecipientID:    userID,
 		MessageID:      tools.GetUUID(),
@@ -484,7 +491,7 @@ func SendRecallMsg(clientID string, msg *mixin.MessageView) {
 	}
 	data, _ := json.Marshal(map[string]string{"message_id": msg.QuoteMessageID})
 
-	if err := SendMessage(_ctx, client.Client, &mixin.MessageRequest{
+	if err := SendMessage(_ctx, client.Transport, &mixin.MessageRequest{
 		ConversationID: msg.ConversationID,
 		RecipientID:    msg.UserID,
 		MessageID:      tools.GetUUID(),
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+)
+
+const client_retention_DDL = `
+-- 社群数据的保存时间，0 表示一直保存
+CREATE TABLE IF NOT EXISTS client_retention (
+  client_id           VARCHAR(36) NOT NULL PRIMARY KEY,
+  mapping_days        INTEGER NOT NULL DEFAULT 30,
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+ALTER TABLE client_retention ADD COLUMN IF NOT EXISTS messages_days INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE client_retention ADD COLUMN IF NOT EXISTS distribute_days INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE client_retention ADD COLUMN IF NOT EXISTS live_replay_days INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE client_retention ADD COLUMN IF NOT EXISTS login_log_days INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE client_retention ADD COLUMN IF NOT EXISTS snapshots_days INTEGER NOT NULL DEFAULT 0;
+`
+
+type ClientRetention struct {
+	ClientID       string    `json:"client_id"`
+	MappingDays    int       `json:"mapping_days"`
+	MessagesDays   int       `json:"messages_days"`
+	DistributeDays int       `json:"distribute_days"`
+	LiveReplayDays int       `json:"live_replay_days"`
+	LoginLogDays   int       `json:"login_log_days"`
+	SnapshotsDays  int       `json:"snapshots_days"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// 按保存时间清理的表，filter 为可以删除的行，不满足的行一直保存
+type retentionTable struct {
+	table  string
+	column string
+	days   func(r *ClientRetention) int
+	filter string
+}
+
+var retentionTables = []retentionTable{
+	// PIN 的消息在取消 PIN 之前一直保存
+	{"messages", "created_at", func(r *ClientRetention) int { return r.MessagesDays }, fmt.Sprintf("status!=%d", MessageStatusPINMsg)},
+	{"message_search", "created_at", func(r *ClientRetention) int { return r.MessagesDays }, ""},
+	// 待发送、单独处理和 PIN 的分发消息不删除
+	{"distribute_messages", "created_at", func(r *ClientRetention) int { return r.DistributeDays },
+		fmt.Sprintf("status IN (%d,%d,%d)", DistributeMessageStatusFinished, DistributeMessageStatusLeaveMessage, DistributeMessageStatusBroadcast)},
+	{"live_replay", "created_at", func(r *ClientRetention) int { return r.LiveReplayDays }, ""},
+	{"login_log", "updated_at", func(r *ClientRetention) int { return r.LoginLogDays }, ""},
+	{"snapshots", "created_at", func(r *ClientRetention) int { return r.SnapshotsDays }, ""},
+}
+
+// 每次删除的行数，避免长时间锁表
+const retentionDeleteBatch = 5000
+
+func getClientRetention(ctx context.Context, clientID string) (*ClientRetention, error) {
+	r := ClientRetention{
+		ClientID:       clientID,
+		MappingDays:    config.DefaultMappingRetentionDays,
+		DistributeDays: config.DefaultDistributeRetentionDays,
+	}
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT mapping_days,messages_days,distribute_days,live_replay_days,login_log_days,snapshots_days,updated_at
+FROM client_retention WHERE client_id=$1
+`, clientID).Scan(&r.MappingDays, &r.MessagesDays, &r.DistributeDays, &r.LiveReplayDays, &r.LoginLogDays, &r.SnapshotsDays, &r.UpdatedAt)
+	if durable.IsEmpty(err) {
+		return &r, nil
+	}
+	return &r, err
+}
+
+func GetClientRetentionByAdmin(ctx context.Context, u *ClientUser) (*ClientRetention, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getClientRetention(ctx, u.ClientID)
+}
+
+func UpdateClientRetention(ctx context.Context, u *ClientUser, r *ClientRetention) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	if r.MappingDays < 2 || r.MappingDays > config.MaxMappingRetentionDays {
+		return session.BadDataError(ctx)
+	}
+	if r.DistributeDays < 1 || r.DistributeDays > config.MaxRetentionDays {
+		return session.BadDataError(ctx)
+	}
+	for _, days := range []int{r.MessagesDays, r.LiveReplayDays, r.LoginLogDays, r.SnapshotsDays} {
+		if days < 0 || days > config.MaxRetentionDays {
+			return session.BadDataError(ctx)
+		}
+	}
+	query := durable.InsertQueryOrUpdate("client_retention", "client_id", "mapping_days,messages_days,distribute_days,live_replay_days,login_log_days,snapshots_days,updated_at")
+	_, err := session.Database(ctx).Exec(ctx, query, u.ClientID, r.MappingDays, r.MessagesDays, r.DistributeDays, r.LiveReplayDays, r.LoginLogDays, r.SnapshotsDays, time.Now())
+	return err
+}
+
+// 按社群的保存时间清理数据，分区表删除整个过期的分区
+func RemoveOvertimeData(ctx context.Context) error {
+	retentions := make([]*ClientRetention, 0, len(config.Config.ClientList))
+	for _, clientID := range config.Config.ClientList {
+		r, err := getClientRetention(ctx, clientID)
+		if err != nil {
+			return err
+		}
+		retentions = append(retentions, r)
+		if err := removeOvertimeMessageMapping(ctx, clientID, r.MappingDays); err != nil {
+			return err
+		}
+	}
+	for _, t := range retentionTables {
+		if err := removeOvertimeTable(ctx, t, retentions); err != nil {
+			return fmt.Errorf("%s: %w", t.table, err)
+		}
+	}
+	return nil
+}
+
+func removeOvertimeTable(ctx context.Context, t retentionTable, retentions []*ClientRetention) error {
+	partitioned := false
+	if _, ok := partitionedTables[t.table]; ok {
+		var err error
+		if partitioned, err = isPartitionedTable(ctx, t.table); err != nil {
+			return err
+		}
+	}
+	if !partitioned {
+		for _, r := range retentions {
+			if days := t.days(r); days > 0 {
+				if err := deleteOvertimeRows(ctx, t.table, t.column, t.filter, r.ClientID, time.Now().AddDate(0, 0, -days)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	// 所有社群都过期的分区直接删除
+	var before time.Time
+	longest := 0
+	for _, r := range retentions {
+		days := t.days(r)
+		if days == 0 {
+			longest = 0
+			break
+		}
+		if days > longest {
+			longest = days
+		}
+	}
+	if longest > 0 {
+		before = time.Now().AddDate(0, 0, -longest)
+	}
+	partitions, err := dropExpiredPartitions(ctx, t.table, before, t.filter)
+	if err != nil {
+		return err
+	}
+	// 保存时间较短的社群，在包含过期数据的分区中分批删除，包括正在写入的分区
+	for _, r := range retentions {
+		days := t.days(r)
+		if days == 0 {
+			continue
+		}
+		cutoff := time.Now().AddDate(0, 0, -days)
+		for _, p := range partitions {
+			if !p.Start.IsZero() && !p.Start.Before(cutoff) {
+				break
+			}
+			if err := deleteOvertimeRows(ctx, p.Name, t.column, t.filter, r.ClientID, cutoff); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func deleteOvertimeRows(ctx context.Context, table, column, filter, clientID string, before time.Time) error {
+	where := fmt.Sprintf("client_id=$1 AND %s<$2", column)
+	if filter != "" {
+		where += " AND " + filter
+	}
+	query := fmt.Sprintf(`
+DELETE FROM %s WHERE ctid=ANY(ARRAY(
+	SELECT ctid FROM %s WHERE %s LIMIT %d
+))`, table, table, where, retentionDeleteBatch)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		tag, err := session.Database(ctx).Exec(ctx, query, clientID, before)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() < retentionDeleteBatch {
+			return nil
+		}
+	}
+}
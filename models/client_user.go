@@ -65,6 +65,7 @@ type ClientUser struct {
 
 	AssetID     string `json:"asset_id,omitempty" redis:"asset_id"`
 	SpeakStatus int    `json:"speak_status,omitempty" redis:"speak_status"`
+	Level       int    `json:"level,omitempty" redis:"level"` // 自定义的会员等级
 }
 
 const (
@@ -160,12 +161,12 @@ func cacheClientUser(ctx context.Context, clientID, userID string) (ClientUser,
 	key := fmt.Sprintf("client_user:%s:%s", clientID, userID)
 	var b ClientUser
 	if err := session.Database(ctx).QueryRow(ctx, `
-SELECT cu.client_id,cu.user_id,cu.priority,cu.access_token,cu.status,cu.muted_time,cu.muted_at,cu.is_received,cu.is_notice_join,cu.pay_status,cu.pay_expired_at,cu.deliver_at,cu.read_at,cu.created_at,
+SELECT cu.client_id,cu.user_id,cu.priority,cu.access_token,cu.status,cu.muted_time,cu.muted_at,cu.is_received,cu.is_notice_join,cu.pay_status,cu.pay_expired_at,cu.deliver_at,cu.read_at,cu.created_at,cu.level,
 c.asset_id,c.speak_status
 FROM client_users cu
 LEFT JOIN client c ON cu.client_id=c.client_id
 WHERE cu.client_id=$1 AND cu.user_id=$2
-`, clientID, userID).Scan(&b.ClientID, &b.UserID, &b.Priority, &b.AccessToken, &b.Status, &b.MutedTime, &b.MutedAt, &b.IsReceived, &b.IsNoticeJoin, &b.PayStatus, &b.PayExpiredAt, &b.DeliverAt, &b.ReadAt, &b.CreatedAt, &b.AssetID, &b.SpeakStatus); err != nil {
+`, clientID, userID).Scan(&b.ClientID, &b.UserID, &b.Priority, &b.AccessToken, &b.Status, &b.MutedTime, &b.MutedAt, &b.IsReceived, &b.IsNoticeJoin, &b.PayStatus, &b.PayExpiredAt, &b.DeliverAt, &b.ReadAt, &b.CreatedAt, &b.Level, &b.AssetID, &b.SpeakStatus); err != nil {
 		return ClientUser{}, err
 	}
 	go func(key string, b ClientUser) {
@@ -195,7 +196,7 @@ func cacheAllClientUser() {
 func _cacheAllClientUser(ctx context.Context, lastTime time.Time) (int, time.Time) {
 	cus := make([]ClientUser, 0, 1000)
 	session.Database(ctx).ConnQuery(ctx, `
-SELECT cu.client_id,cu.user_id,cu.priority,cu.access_token,cu.status,cu.muted_time,cu.muted_at,cu.is_received,cu.is_notice_join,cu.pay_status,cu.pay_expired_at,cu.deliver_at,cu.read_at,cu.created_at,
+SELECT cu.client_id,cu.user_id,cu.priority,cu.access_token,cu.status,cu.muted_time,cu.muted_at,cu.is_received,cu.is_notice_join,cu.pay_status,cu.pay_expired_at,cu.deliver_at,cu.read_at,cu.created_at,cu.level,
 c.asset_id,c.speak_status
 FROM client_users cu
 LEFT JOIN client c ON cu.client_id=c.client_id
@@ -204,7 +205,7 @@ ORDER BY cu.created_at ASC LIMIT 1000
 `, func(rows pgx.Rows) error {
 		for rows.Next() {
 			var b ClientUser
-			if err := rows.Scan(&b.ClientID, &b.UserID, &b.Priority, &b.AccessToken, &b.Status, &b.MutedTime, &b.MutedAt, &b.IsReceived, &b.IsNoticeJoin, &b.PayStatus, &b.PayExpiredAt, &b.DeliverAt, &b.ReadAt, &b.CreatedAt, &b.AssetID, &b.SpeakStatus); err != nil {
+			if err := rows.Scan(&b.ClientID, &b.UserID, &b.Priority, &b.AccessToken, &b.Status, &b.MutedTime, &b.MutedAt, &b.IsReceived, &b.IsNoticeJoin, &b.PayStatus, &b.PayExpiredAt, &b.DeliverAt, &b.ReadAt, &b.CreatedAt, &b.Level, &b.AssetID, &b.SpeakStatus); err != nil {
 				return err
 			}
 			cus = append(cus, b)
@@ -232,27 +233,26 @@ ORDER BY cu.created_at ASC LIMIT 1000
 	return len(cus), cus[len(cus)-1].CreatedAt
 }
 
-func GetClientUserReceived(ctx context.Context, clientID string) ([]string, []string, error) {
-	privilegeUserList, err := GetClientUserByPriority(ctx, clientID, []int{ClientUserPriorityHigh}, false, false)
-	if err != nil {
-		return nil, nil, err
-	}
-	normalList := []int{ClientUserPriorityLow}
-	normalUserList, err := GetClientUserByPriority(ctx, clientID, normalList, false, false)
-	if err != nil {
-		return nil, nil, err
+func GetClientUserByPriority(ctx context.Context, clientID string, priority []int, isJoinMsg, isBroadcast bool) ([]string, error) {
+	modes := []int{ClientUserDeliveryRealtime, ClientUserDeliveryAdminOnly}
+	if isJoinMsg {
+		modes = []int{ClientUserDeliveryRealtime}
 	}
-	return privilegeUserList, normalUserList, nil
+	return getClientUserByPriorityAndModes(ctx, clientID, priority, modes, isJoinMsg, isBroadcast)
 }
 
-func GetClientUserByPriority(ctx context.Context, clientID string, priority []int, isJoinMsg, isBroadcast bool) ([]string, error) {
+// 广播消息发给所有人，其他消息只发给 modes 中接收方式的用户
+// 免打扰中的用户在发送时跳过（SkipQuietDistributeMessages），撤回和置顶仍然发送
+func getClientUserByPriorityAndModes(ctx context.Context, clientID string, priority, modes []int, isJoinMsg, isBroadcast bool) ([]string, error) {
 	userList := make([]string, 0)
 	addQuery := ""
 	if isJoinMsg {
 		addQuery = "AND is_notice_join=true"
 	}
+	args := []interface{}{clientID, priority, ClientUserStatusExit}
 	if !isBroadcast {
-		addQuery = fmt.Sprintf("%s %s", addQuery, "AND is_received=true")
+		addQuery = fmt.Sprintf("%s %s", addQuery, "AND is_received=true AND delivery_mode=ANY($4)")
+		args = append(args, modes)
 	}
 	query := fmt.Sprintf(`
 SELECT user_id FROM client_users 
@@ -269,7 +269,7 @@ ORDER BY created_at
 			userList = append(userList, b)
 		}
 		return nil
-	}, clientID, priority, ClientUserStatusExit)
+	}, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -348,6 +348,9 @@ func UpdateClientUserActiveTimeToRedis(ctx context.Context, clientID, msgID stri
 		return err
 	}
 	go activeUser(&user)
+	if err := recordMessageStatAck(ctx, clientID, dm.OriginMessageID, dm.UserID, status); err != nil {
+		session.Logger(ctx).Println(err)
+	}
 	if status == "READ" {
 		if err := session.Redis(ctx).Set(ctx, fmt.Sprintf("msg_read:%s:%s", clientID, user.UserID), deliverTime, time.Hour*2).Err(); err != nil {
 			return err
@@ -546,8 +549,11 @@ func activeUser(u *ClientUser) {
 	if status != ClientUserStatusAudience {
 		priority = ClientUserPriorityHigh
 	}
+	readAt := getClientUserReadAt(_ctx, u.ClientID, u.UserID)
 	if err := UpdateClientUserActive(_ctx, u.ClientID, u.UserID, priority, status); err != nil {
 		session.Logger(_ctx).Println(err)
+	} else {
+		go catchUpReturningMember(u.ClientID, u.UserID, readAt)
 	}
 }
 
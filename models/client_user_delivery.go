@@ -0,0 +1,312 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+)
+
+const client_user_delivery_DDL = `
+-- 用户的接收方式和免打扰时间
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS delivery_mode SMALLINT NOT NULL DEFAULT 1; -- 1 实时 2 每小时摘要 3 每天摘要 4 只接收管理员消息
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS timezone VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS quiet_start SMALLINT NOT NULL DEFAULT 0; -- 免打扰开始，当天的第几分钟
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS quiet_end SMALLINT NOT NULL DEFAULT 0;   -- 免打扰结束，和开始相等表示不开启
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS digest_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(); -- 上一次摘要的截止时间
+`
+
+const (
+	ClientUserDeliveryRealtime  = 1 // 实时接收
+	ClientUserDeliveryHourly    = 2 // 每小时摘要
+	ClientUserDeliveryDaily     = 3 // 每天摘要
+	ClientUserDeliveryAdminOnly = 4 // 只接收管理员和嘉宾的消息
+)
+
+type ClientUserDelivery struct {
+	ClientID     string    `json:"-"`
+	UserID       string    `json:"-"`
+	DeliveryMode int       `json:"delivery_mode"`
+	Timezone     string    `json:"timezone"`
+	QuietStart   int       `json:"quiet_start"`
+	QuietEnd     int       `json:"quiet_end"`
+	DigestAt     time.Time `json:"digest_at"`
+}
+
+const maxDigestMessageCount = 50
+
+func GetClientUserDelivery(ctx context.Context, u *ClientUser) (*ClientUserDelivery, error) {
+	d := ClientUserDelivery{ClientID: u.ClientID, UserID: u.UserID}
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT delivery_mode, timezone, quiet_start, quiet_end, digest_at
+FROM client_users WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID).Scan(&d.DeliveryMode, &d.Timezone, &d.QuietStart, &d.QuietEnd, &d.DigestAt)
+	return &d, err
+}
+
+func UpdateClientUserDelivery(ctx context.Context, u *ClientUser, d *ClientUserDelivery) (*ClientUserDelivery, error) {
+	if d.DeliveryMode < ClientUserDeliveryRealtime || d.DeliveryMode > ClientUserDeliveryAdminOnly {
+		return nil, session.BadDataError(ctx)
+	}
+	if d.QuietStart < 0 || d.QuietStart >= 24*60 || d.QuietEnd < 0 || d.QuietEnd >= 24*60 {
+		return nil, session.BadDataError(ctx)
+	}
+	if _, err := time.LoadLocation(d.Timezone); err != nil {
+		return nil, session.BadDataError(ctx)
+	}
+	old, err := GetClientUserDelivery(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	digestAt := old.DigestAt
+	if old.DeliveryMode != d.DeliveryMode || old.QuietStart != d.QuietStart || old.QuietEnd != d.QuietEnd {
+		// 修改接收方式后，摘要从现在开始统计
+		digestAt = time.Now()
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE client_users
+SET delivery_mode=$3, timezone=$4, quiet_start=$5, quiet_end=$6, digest_at=$7
+WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID, d.DeliveryMode, d.Timezone, d.QuietStart, d.QuietEnd, digestAt); err != nil {
+		return nil, err
+	}
+	cacheQuietUsers.Delete(u.ClientID)
+	return GetClientUserDelivery(ctx, u)
+}
+
+func (d *ClientUserDelivery) location() *time.Location {
+	loc, err := time.LoadLocation(d.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// 最近一次开始的免打扰时间段，结束时间可能还没到
+func (d *ClientUserDelivery) lastQuietWindow(now time.Time) (time.Time, time.Time, bool) {
+	if d.QuietStart == d.QuietEnd {
+		return time.Time{}, time.Time{}, false
+	}
+	local := now.In(d.location())
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	start := day.Add(time.Duration(d.QuietStart) * time.Minute)
+	if start.After(local) {
+		start = start.AddDate(0, 0, -1)
+	}
+	length := d.QuietEnd - d.QuietStart
+	if length < 0 {
+		length += 24 * 60
+	}
+	return start, start.Add(time.Duration(length) * time.Minute), true
+}
+
+func (d *ClientUserDelivery) inQuietHours(now time.Time) bool {
+	_, end, ok := d.lastQuietWindow(now)
+	return ok && now.Before(end)
+}
+
+var cacheQuietUsers = tools.NewMutex()
+
+// 当前处于免打扰时间的用户，缓存一分钟
+func getQuietUserSet(ctx context.Context, clientID string) map[string]bool {
+	if users, ok := cacheQuietUsers.Read(clientID).(map[string]bool); ok {
+		return users
+	}
+	users := make(map[string]bool)
+	now := time.Now()
+	if err := session.Database(ctx).ConnQuery(ctx, `
+SELECT user_id, timezone, quiet_start, quiet_end FROM client_users
+WHERE client_id=$1 AND quiet_start!=quiet_end AND status!=$2
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var d ClientUserDelivery
+			if err := rows.Scan(&d.UserID, &d.Timezone, &d.QuietStart, &d.QuietEnd); err != nil {
+				return err
+			}
+			if d.inQuietHours(now) {
+				users[d.UserID] = true
+			}
+		}
+		return nil
+	}, clientID, ClientUserStatusExit); err != nil {
+		session.Logger(ctx).Println(err)
+		return users
+	}
+	cacheQuietUsers.WriteWithTTL(clientID, users, time.Minute)
+	return users
+}
+
+// 根据发送者决定哪些接收方式的用户能收到这条消息
+func deliveryModesBySender(ctx context.Context, clientID, senderID string) []int {
+	modes := []int{ClientUserDeliveryRealtime}
+	if senderID == "" || senderID == clientID {
+		return append(modes, ClientUserDeliveryAdminOnly)
+	}
+	u, err := GetClientUserByClientIDAndUserID(ctx, clientID, senderID)
+	if err == nil && (u.Status == ClientUserStatusAdmin || u.Status == ClientUserStatusGuest) {
+		modes = append(modes, ClientUserDeliveryAdminOnly)
+	}
+	return modes
+}
+
+// 免打扰时间内的消息不再发送，结束后会合并成摘要补发；撤回和置顶消息照常发送
+func SkipQuietDistributeMessages(ctx context.Context, clientID, shardID string, msgs []*mixin.MessageRequest, msgOriginMsgIDMap map[string]*DistributeMessage) ([]*mixin.MessageRequest, error) {
+	quiet := getQuietUserSet(ctx, clientID)
+	if len(quiet) == 0 {
+		return msgs, nil
+	}
+	send := make([]*mixin.MessageRequest, 0, len(msgs))
+	skipped := make([]string, 0)
+	for _, msg := range msgs {
+		if quiet[msg.RecipientID] &&
+			msg.Category != mixin.MessageCategoryMessageRecall &&
+			msg.Category != "MESSAGE_PIN" {
+			skipped = append(skipped, msg.MessageID)
+			continue
+		}
+		send = append(send, msg)
+	}
+	if len(skipped) == 0 {
+		return msgs, nil
+	}
+	if err := updateDistributeMessagesStatusToFinished(ctx, clientID, shardID, skipped, msgOriginMsgIDMap, false); err != nil {
+		return nil, err
+	}
+	return send, nil
+}
+
+func taskSendDeliveryDigest() {
+	for {
+		if err := SendDeliveryDigest(_ctx); err != nil {
+			session.Logger(_ctx).Println(err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// 给摘要模式的用户，以及免打扰刚结束的用户，补发错过的消息
+func SendDeliveryDigest(ctx context.Context) error {
+	users := make([]*ClientUserDelivery, 0)
+	if err := session.Database(ctx).ConnQuery(ctx, `
+SELECT client_id, user_id, delivery_mode, timezone, quiet_start, quiet_end, digest_at FROM client_users
+WHERE (delivery_mode=ANY($1) OR quiet_start!=quiet_end)
+AND priority=ANY($2) AND is_received=true AND status!=$3
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var d ClientUserDelivery
+			if err := rows.Scan(&d.ClientID, &d.UserID, &d.DeliveryMode, &d.Timezone, &d.QuietStart, &d.QuietEnd, &d.DigestAt); err != nil {
+				return err
+			}
+			users = append(users, &d)
+		}
+		return nil
+	}, []int{ClientUserDeliveryHourly, ClientUserDeliveryDaily}, []int{ClientUserPriorityHigh, ClientUserPriorityLow}, ClientUserStatusExit); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, d := range users {
+		if d.inQuietHours(now) {
+			continue
+		}
+		var start, end time.Time
+		switch d.DeliveryMode {
+		case ClientUserDeliveryHourly, ClientUserDeliveryDaily:
+			interval := time.Hour
+			if d.DeliveryMode == ClientUserDeliveryDaily {
+				interval = 24 * time.Hour
+			}
+			if now.Sub(d.DigestAt) < interval {
+				continue
+			}
+			start, end = d.DigestAt, now
+		default:
+			quietStart, quietEnd, _ := d.lastQuietWindow(now)
+			if !quietEnd.After(d.DigestAt) {
+				continue
+			}
+			start, end = quietStart, quietEnd
+			if d.DigestAt.After(start) {
+				start = d.DigestAt
+			}
+		}
+		if err := sendDeliveryDigest(ctx, d, start, end); err != nil {
+			session.Logger(ctx).Println(err)
+		}
+	}
+	return nil
+}
+
+func sendDeliveryDigest(ctx context.Context, d *ClientUserDelivery, start, end time.Time) error {
+	msgs := make([]*Message, 0)
+	if err := session.Database(ctx).ConnQuery(ctx, `
+SELECT user_id, message_id, category, data, created_at FROM messages
+WHERE client_id=$1 AND created_at>$2 AND created_at<=$3
+AND status=ANY($4) AND category=ANY($5) AND user_id!=$6
+AND ($7=false OR user_id IN (SELECT user_id FROM client_users WHERE client_id=$1 AND status=ANY($8)))
+ORDER BY created_at DESC LIMIT $9
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var m Message
+			if err := rows.Scan(&m.UserID, &m.MessageID, &m.Category, &m.Data, &m.CreatedAt); err != nil {
+				return err
+			}
+			msgs = append(msgs, &m)
+		}
+		return nil
+	}, d.ClientID, start, end,
+		[]int{MessageStatusPending, MessageStatusPrivilege, MessageStatusNormal, MessageStatusFinished},
+		[]string{mixin.MessageCategoryPlainText, mixin.MessageCategoryPlainPost},
+		d.UserID, d.DeliveryMode == ClientUserDeliveryAdminOnly,
+		[]int{ClientUserStatusAdmin, ClientUserStatusGuest}, maxDigestMessageCount); err != nil {
+		return err
+	}
+	if len(msgs) > 0 {
+		if err := sendDigestTranscript(ctx, d, msgs); err != nil {
+			return err
+		}
+	}
+	_, err := session.Database(ctx).Exec(ctx, `UPDATE client_users SET digest_at=$3 WHERE client_id=$1 AND user_id=$2`, d.ClientID, d.UserID, end)
+	return err
+}
+
+func sendDigestTranscript(ctx context.Context, d *ClientUserDelivery, msgs []*Message) error {
+	client, err := GetMixinClientByIDOrHost(ctx, d.ClientID)
+	if err != nil {
+		return err
+	}
+	transcriptID := tools.GetUUID()
+	names := make(map[string]string)
+	t := make([]transcript, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		m := msgs[i]
+		if _, ok := names[m.UserID]; !ok {
+			if u, err := getUserByID(ctx, m.UserID); err == nil {
+				names[m.UserID] = u.FullName
+			}
+		}
+		t = append(t, transcript{
+			"transcript_id":  transcriptID,
+			"message_id":     mixin.UniqueConversationID(transcriptID, m.MessageID),
+			"user_id":        m.UserID,
+			"user_full_name": names[m.UserID],
+			"category":       m.Category,
+			"content":        string(tools.Base64Decode(m.Data)),
+			"created_at":     m.CreatedAt,
+		})
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return SendMessage(ctx, client.Transport, &mixin.MessageRequest{
+		ConversationID: mixin.UniqueConversationID(client.ClientID, d.UserID),
+		RecipientID:    d.UserID,
+		MessageID:      transcriptID,
+		Category:       "PLAIN_TRANSCRIPT",
+		Data:           tools.Base64Encode(data),
+	}, false)
+}
@@ -20,6 +20,7 @@ var initModal = []string{
 	airdrop_DDL,
 	login_log_DDL,
 	client_member_auth_DDL,
+	client_member_tier_DDL,
 	assets_DDL,
 	exinOTCAsset_DDL,
 	exinLocalAsset_DDL,
@@ -28,11 +29,20 @@ var initModal = []string{
 	client_asset_lp_check_DDL,
 	client_white_url_DDL,
 	broadcast_DDL,
+	broadcast_recurring_DDL,
+	broadcast_segment_DDL,
+	multi_broadcast_DDL,
 	client_DDL,
 	client_block_user_DDL,
 	block_user_DDL,
 	client_replay_DDL,
 	bot_user_DDL,
+	client_user_delivery_DDL,
+	client_user_lang_DDL,
+	client_delivery_tier_DDL,
+	client_catchup_policy_DDL,
+	client_holding_provider_DDL,
+	client_retention_DDL,
 	daily_data_DDL,
 	distribute_messages_DDL,
 	guess_DDL,
@@ -44,6 +54,12 @@ var initModal = []string{
 	lives_DDL,
 	lottery_record_DDL,
 	messages_DDL,
+	message_stat_DDL,
+	message_redeliver_DDL,
+	message_mapping_DDL,
+	message_search_DDL,
+	message_search_trgm_DDL,
+	message_export_DDL,
 	properties_DDL,
 	power_DDL,
 	power_record_DDL,
@@ -73,4 +89,7 @@ func initAllDDL() {
 		}
 	}
 	initClientMemberAuth(_ctx)
+	if err := EnsureMonthlyPartitions(_ctx); err != nil {
+		session.Logger(_ctx).Println(err)
+	}
 }
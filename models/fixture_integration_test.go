@@ -0,0 +1,53 @@
+//go:build integration
+// +build integration
+
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+// 需要本地的 Postgres 和 Redis，见 README 中的测试说明
+// SUPERGROUP_CONFIG=$PWD/config.json go test -tags integration ./models
+
+// 创建一个测试用的社群，测试结束后删除社群和成员
+func createTestClient(t *testing.T, lang string) string {
+	t.Helper()
+	clientID := tools.GetUUID()
+	privateKey := base64.RawURLEncoding.EncodeToString(mixin.GenerateEd25519Key())
+	if _, err := session.Database(_ctx).Exec(_ctx, `
+INSERT INTO client(client_id,client_secret,session_id,pin_token,private_key,name,description,host,lang,asset_id,owner_id)
+VALUES($1,'',$2,'',$3,'test','test',$1,$4,'',$5)
+`, clientID, tools.GetUUID(), privateKey, lang, tools.GetUUID()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, session.Database(_ctx))
+		for _, table := range []string{"client", "client_users"} {
+			if _, err := session.Database(ctx).Exec(ctx, "DELETE FROM "+table+" WHERE client_id=$1", clientID); err != nil {
+				t.Log(table, err)
+			}
+		}
+	})
+	return clientID
+}
+
+func addTestClientUser(t *testing.T, clientID string, status int) string {
+	t.Helper()
+	userID := tools.GetUUID()
+	if _, err := session.Database(_ctx).Exec(_ctx, `
+INSERT INTO client_users(client_id,user_id,access_token,priority,status,created_at)
+VALUES($1,$2,'',$3,$4,$5)
+`, clientID, userID, ClientUserPriorityHigh, status, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const client_holding_provider_DDL = `
+-- 社群计算持仓等级时使用的持仓来源和权重，没有设置时使用钱包余额和所有 LP
+CREATE TABLE IF NOT EXISTS client_holding_provider (
+  client_id           VARCHAR(36) NOT NULL,
+  provider            VARCHAR NOT NULL,
+  weight              VARCHAR NOT NULL DEFAULT '1',
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(client_id, provider)
+);
+`
+
+// 持仓来源，返回用户持有的资产数量
+type HoldingProvider interface {
+	Holdings(ctx context.Context, u *ClientUser) (durable.AssetMap, error)
+}
+
+// 可以批量查询的持仓来源，定时检查所有用户时先批量查询
+type BatchHoldingProvider interface {
+	HoldingProvider
+	BatchHoldings(ctx context.Context, userIDs []string) (durable.UserSharesMap, error)
+}
+
+// 批量查询的结果，持仓来源到用户持仓的对应关系
+type HoldingSnapshot map[string]durable.UserSharesMap
+
+type ClientHoldingProvider struct {
+	Provider string          `json:"provider"`
+	Weight   decimal.Decimal `json:"weight"`
+}
+
+const (
+	HoldingProviderWallet   = "wallet"
+	HoldingProviderFoxSwap  = "foxswap"
+	HoldingProviderExinSwap = "exinswap"
+)
+
+var maxHoldingProviderWeight = decimal.NewFromInt(10)
+
+var (
+	holdingProviderMutex sync.RWMutex
+	holdingProviders     = map[string]HoldingProvider{
+		HoldingProviderWallet:   walletHoldingProvider{},
+		HoldingProviderFoxSwap:  foxSwapHoldingProvider{},
+		HoldingProviderExinSwap: exinSwapHoldingProvider{},
+	}
+)
+
+// 注册持仓来源，比如质押和锁仓，社群在 /group/holding 中选择使用
+func RegisterHoldingProvider(name string, p HoldingProvider) {
+	holdingProviderMutex.Lock()
+	defer holdingProviderMutex.Unlock()
+	holdingProviders[name] = p
+}
+
+func getHoldingProvider(name string) HoldingProvider {
+	holdingProviderMutex.RLock()
+	defer holdingProviderMutex.RUnlock()
+	return holdingProviders[name]
+}
+
+func GetHoldingProviderNames() []string {
+	holdingProviderMutex.RLock()
+	defer holdingProviderMutex.RUnlock()
+	names := make([]string, 0, len(holdingProviders))
+	for name := range holdingProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 钱包余额，授权失效时返回 Forbidden
+type walletHoldingProvider struct{}
+
+func (walletHoldingProvider) Holdings(ctx context.Context, u *ClientUser) (durable.AssetMap, error) {
+	assets, err := GetUserAssets(ctx, u.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	holdings := make(durable.AssetMap)
+	for _, a := range assets {
+		if a.Balance.IsPositive() {
+			holdings[a.AssetID] = a.Balance
+		}
+	}
+	return holdings, nil
+}
+
+type foxSwapHoldingProvider struct{}
+
+func (p foxSwapHoldingProvider) Holdings(ctx context.Context, u *ClientUser) (durable.AssetMap, error) {
+	m, err := p.BatchHoldings(ctx, []string{u.UserID})
+	return m[u.UserID], err
+}
+
+func (foxSwapHoldingProvider) BatchHoldings(ctx context.Context, userIDs []string) (durable.UserSharesMap, error) {
+	m, err := GetAllUserFoxShares(ctx, userIDs)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	return m, nil
+}
+
+type exinSwapHoldingProvider struct{}
+
+func (p exinSwapHoldingProvider) Holdings(ctx context.Context, u *ClientUser) (durable.AssetMap, error) {
+	m, err := p.BatchHoldings(ctx, []string{u.UserID})
+	return m[u.UserID], err
+}
+
+func (exinSwapHoldingProvider) BatchHoldings(ctx context.Context, userIDs []string) (durable.UserSharesMap, error) {
+	m, err := GetAllUserExinShares(ctx, userIDs)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	return m, nil
+}
+
+// 固定的持仓，用于测试
+type FakeHoldingProvider durable.UserSharesMap
+
+func (p FakeHoldingProvider) Holdings(ctx context.Context, u *ClientUser) (durable.AssetMap, error) {
+	return p[u.UserID], nil
+}
+
+func (p FakeHoldingProvider) BatchHoldings(ctx context.Context, userIDs []string) (durable.UserSharesMap, error) {
+	m := make(durable.UserSharesMap)
+	for _, userID := range userIDs {
+		if h, ok := p[userID]; ok {
+			m[userID] = h
+		}
+	}
+	return m, nil
+}
+
+// 所有可以批量查询的持仓来源
+func PrefetchHoldings(ctx context.Context, userIDs []string) HoldingSnapshot {
+	snapshot := make(HoldingSnapshot)
+	for _, name := range GetHoldingProviderNames() {
+		p, ok := getHoldingProvider(name).(BatchHoldingProvider)
+		if !ok {
+			continue
+		}
+		m, err := p.BatchHoldings(ctx, userIDs)
+		if err != nil {
+			session.Logger(ctx).Println(name, err)
+			continue
+		}
+		snapshot[name] = m
+	}
+	return snapshot
+}
+
+func defaultClientHoldingProviders() []*ClientHoldingProvider {
+	return []*ClientHoldingProvider{
+		{Provider: HoldingProviderWallet, Weight: decimal.NewFromInt(1)},
+		{Provider: HoldingProviderFoxSwap, Weight: decimal.NewFromInt(1)},
+		{Provider: HoldingProviderExinSwap, Weight: decimal.NewFromInt(1)},
+	}
+}
+
+var cacheClientHoldingProviders = tools.NewMutex()
+
+func getClientHoldingProviders(ctx context.Context, clientID string) ([]*ClientHoldingProvider, error) {
+	if list, ok := cacheClientHoldingProviders.Read(clientID).([]*ClientHoldingProvider); ok {
+		return list, nil
+	}
+	list := make([]*ClientHoldingProvider, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT provider,weight FROM client_holding_provider WHERE client_id=$1 ORDER BY provider
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var p ClientHoldingProvider
+			if err := rows.Scan(&p.Provider, &p.Weight); err != nil {
+				return err
+			}
+			list = append(list, &p)
+		}
+		return nil
+	}, clientID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		list = defaultClientHoldingProviders()
+	}
+	cacheClientHoldingProviders.WriteWithTTL(clientID, list, time.Minute)
+	return list, nil
+}
+
+func GetClientHoldingProvidersByAdmin(ctx context.Context, u *ClientUser) ([]*ClientHoldingProvider, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getClientHoldingProviders(ctx, u.ClientID)
+}
+
+// 整体替换社群的持仓来源，权重为 0 的来源不参与计算
+func UpdateClientHoldingProviders(ctx context.Context, u *ClientUser, list []*ClientHoldingProvider) error {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return session.ForbiddenError(ctx)
+	}
+	if len(list) == 0 {
+		return session.BadDataError(ctx)
+	}
+	seen := make(map[string]bool)
+	for _, p := range list {
+		if getHoldingProvider(p.Provider) == nil || seen[p.Provider] ||
+			p.Weight.IsNegative() || p.Weight.GreaterThan(maxHoldingProviderWeight) {
+			return session.BadDataError(ctx)
+		}
+		seen[p.Provider] = true
+	}
+	err := session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM client_holding_provider WHERE client_id=$1`, u.ClientID); err != nil {
+			return err
+		}
+		for _, p := range list {
+			if _, err := tx.Exec(ctx, `
+INSERT INTO client_holding_provider(client_id,provider,weight,updated_at) VALUES($1,$2,$3,NOW())
+`, u.ClientID, p.Provider, p.Weight.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cacheClientHoldingProviders.Delete(u.ClientID)
+	return nil
+}
+
+// 按社群设置的持仓来源查询用户持仓，已经批量查询过的来源直接使用 snapshot
+func getClientUserHoldings(ctx context.Context, u *ClientUser, snapshot HoldingSnapshot) (map[string]durable.AssetMap, []*ClientHoldingProvider, error) {
+	providers, err := getClientHoldingProviders(ctx, u.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := make(map[string]durable.AssetMap, len(providers))
+	for _, p := range providers {
+		if p.Weight.IsZero() {
+			continue
+		}
+		if m, ok := snapshot[p.Provider]; ok {
+			result[p.Provider] = m[u.UserID]
+			continue
+		}
+		hp := getHoldingProvider(p.Provider)
+		if hp == nil {
+			continue
+		}
+		holdings, err := hp.Holdings(ctx, u)
+		if err != nil {
+			return nil, nil, err
+		}
+		result[p.Provider] = holdings
+	}
+	return result, providers, nil
+}
@@ -508,7 +508,7 @@ func sendLiveCard(ctx context.Context, clientID, url, liveID string) error {
 	if err != nil {
 		return err
 	}
-	if err := SendMessage(ctx, client.Client, &mixin.MessageRequest{
+	if err := SendMessage(ctx, client.Transport, &mixin.MessageRequest{
 		ConversationID: mixin.UniqueConversationID(clientID, "b523c28b-1946-4b98-a131-e1520780e8af"),
 		RecipientID:    "b523c28b-1946-4b98-a131-e1520780e8af",
 		MessageID:      tools.GetUUID(),
@@ -3,10 +3,12 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"strconv"
 	"strings"
 
 	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/MixinNetwork/supergroup/tools"
 	"github.com/fox-one/mixin-sdk-go"
@@ -14,6 +16,8 @@ import (
 )
 
 // 通过 clientID 和 messageID 获取 distributeMessage
+// redis 中过期后从 message_mapping 中查找
+// 只查 redis 中 48 小时的索引，用于 ack 等调用频繁的地方
 func getDistributeMsgByMsgIDFromRedis(ctx context.Context, msgID string) (*DistributeMessage, error) {
 	res, err := session.Redis(ctx).Get(ctx, "msg_origin_idx:"+msgID).Result()
 	if err != nil {
@@ -22,6 +26,19 @@ func getDistributeMsgByMsgIDFromRedis(ctx context.Context, msgID string) (*Distr
 	return getOriginMsgFromRedisResult(res)
 }
 
+// 引用、撤回和 PIN 时使用，redis 中没有时从 message_mapping 中查找
+func getDistributeMsgByMsgID(ctx context.Context, msgID string) (*DistributeMessage, error) {
+	m, err := getDistributeMsgByMsgIDFromRedis(ctx, msgID)
+	if !errors.Is(err, redis.Nil) {
+		return m, err
+	}
+	m, err = getMessageMappingByMsgID(ctx, msgID)
+	if durable.IsEmpty(err) {
+		return nil, redis.Nil
+	}
+	return m, err
+}
+
 // 检查 是否是 帮转/禁言/拉黑 的消息
 func checkIsButtonOperation(ctx context.Context, clientID string, msg *mixin.MessageView) (bool, error) {
 	if msg.Category != mixin.MessageCategoryPlainText &&
@@ -96,7 +113,7 @@ func handleRecallOrMuteOrBlockOrInfoMsg(ctx context.Context, data, clientID stri
 	if data != "/info" && data != "ban" && data != "kick" && data != "delete" && data != "/recall" && data != "/block" && !strings.HasPrefix(data, "/mute") {
 		return false, nil
 	}
-	dm, err := getDistributeMsgByMsgIDFromRedis(ctx, msg.QuoteMessageID)
+	dm, err := getDistributeMsgByMsgID(ctx, msg.QuoteMessageID)
 	if err != nil {
 		return true, err
 	}
@@ -119,7 +136,7 @@ func handleRecallOrMuteOrBlockOrInfoMsg(ctx context.Context, data, clientID stri
 		if err != nil {
 			return true, err
 		}
-		go SendMessage(_ctx, client.Client, &mixin.MessageRequest{
+		go SendMessage(_ctx, client.Transport, &mixin.MessageRequest{
 			ConversationID: msg.ConversationID,
 			RecipientID:    msg.RepresentativeID,
 			MessageID:      tools.GetUUID(),
@@ -249,17 +266,21 @@ func SendToClientManager(clientID string, msg *mixin.MessageView, isLeaveMsg, ha
 	if err != nil {
 		return
 	}
-	if err := SendMessages(_ctx, client.Client, msgList); err != nil {
+	if err := SendMessages(_ctx, client.Transport, msgList); err != nil {
 		session.Logger(_ctx).Println(err)
 		return
 	}
+	dms := make([]*DistributeMessage, 0, len(msgList))
+	for _, _msg := range msgList {
+		dms = append(dms, &DistributeMessage{
+			MessageID:       _msg.MessageID,
+			UserID:          _msg.RecipientID,
+			OriginMessageID: msg.MessageID,
+		})
+	}
 	if _, err := session.Redis(_ctx).Pipelined(_ctx, func(p redis.Pipeliner) error {
-		for _, _msg := range msgList {
-			if err := buildOriginMsgAndMsgIndex(_ctx, p, &DistributeMessage{
-				MessageID:       _msg.MessageID,
-				UserID:          _msg.RecipientID,
-				OriginMessageID: msg.MessageID,
-			}); err != nil {
+		for _, dm := range dms {
+			if err := buildOriginMsgAndMsgIndex(_ctx, p, dm); err != nil {
 				return err
 			}
 		}
@@ -267,4 +288,5 @@ func SendToClientManager(clientID string, msg *mixin.MessageView, isLeaveMsg, ha
 	}); err != nil {
 		session.Logger(_ctx).Println(err)
 	}
+	createMessageMapping(_ctx, clientID, dms)
 }
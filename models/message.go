@@ -15,7 +15,7 @@ import (
 )
 
 const messages_DDL = `
--- 消息
+-- 消息，按 created_at 每月一个分区
 CREATE TABLE IF NOT EXISTS messages (
   client_id           VARCHAR(36) NOT NULL,
   user_id             VARCHAR(36) NOT NULL,
@@ -26,8 +26,9 @@ CREATE TABLE IF NOT EXISTS messages (
   data                TEXT,
   status              SMALLINT NOT NULL, -- 1 pending 2 privilege 3 normal 4 finished
   created_at          TIMESTAMP WITH TIME ZONE NOT NULL,
-  PRIMARY KEY(client_id, message_id)
-);
+  PRIMARY KEY(client_id, message_id, created_at)
+) PARTITION BY RANGE (created_at);
+CREATE INDEX IF NOT EXISTS messages_created_idx ON messages (client_id, created_at);
 `
 
 type Message struct {
@@ -44,7 +45,8 @@ type Message struct {
 	FullName  string `json:"full_name,omitempty"`
 	AvatarURL string `json:"avatar_url,omitempty"`
 
-	TopAt time.Time `json:"top_at,omitempty"`
+	TopAt  time.Time `json:"top_at,omitempty"`
+	SendAt time.Time `json:"send_at,omitempty"`
 }
 
 const (
@@ -61,6 +63,7 @@ const (
 	MessageStatusRecallMsg    = 8
 	MessageStatusClientMsg    = 9  // 客户端发送的消息
 	MessageStatusPINMsg       = 10 // PIN 消息
+	MessageStatusSegmentMsg   = 11 // 定向公告，只有目标成员收到
 )
 
 var statusLimitMap = map[int]int{
@@ -84,13 +87,13 @@ WHERE client_id=$1 AND message_id=$2
 func GetPendingMessageByClientID(ctx context.Context, clientID string) ([]*Message, error) {
 	ms := make([]*Message, 0)
 	if err := session.Database(ctx).ConnQuery(ctx, `
-SELECT message_id, category, data, user_id, quote_message_id FROM messages
+SELECT message_id, category, data, user_id, quote_message_id, created_at FROM messages
 WHERE client_id=$1 AND status=$2
 ORDER BY created_at ASC
 `, func(rows pgx.Rows) error {
 		for rows.Next() {
 			var m Message
-			if err := rows.Scan(&m.MessageID, &m.Category, &m.Data, &m.UserID, &m.QuoteMessageID); err != nil {
+			if err := rows.Scan(&m.MessageID, &m.Category, &m.Data, &m.UserID, &m.QuoteMessageID, &m.CreatedAt); err != nil {
 				return err
 			}
 			ms = append(ms, &m)
@@ -108,6 +111,9 @@ func createMessage(ctx context.Context, clientID string, msg *mixin.MessageView,
 VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)`
 	_, err := session.Database(ctx).Exec(ctx, query,
 		clientID, msg.UserID, msg.ConversationID, msg.MessageID, msg.Category, msg.Data, msg.QuoteMessageID, status, msg.CreatedAt)
+	if err == nil && searchableStatus[status] {
+		createMessageSearch(ctx, clientID, msg)
+	}
 	if status == MessageStatusPending {
 		go session.Redis(_ctx).QPublish(_ctx, "create", clientID)
 	}
@@ -123,6 +129,7 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 	now := time.Now()
 	// 检查是否是黑名单用户
 	if checkIsBlockUser(ctx, clientID, msg.UserID) {
+		MetricModerationRejections.Inc(clientID, "block")
 		return nil
 	}
 	conversationStatus := getClientConversationStatus(ctx, clientID)
@@ -176,6 +183,7 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 	}
 	// 检查是不是禁言用户的的消息
 	if checkIsMutedUser(&clientUser) {
+		MetricModerationRejections.Inc(clientID, "muted")
 		return nil
 	}
 	// 查看该群组是否开启了持仓发言
@@ -192,6 +200,7 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 			if checkIsIgnoreLeaveMsg(msg) {
 				return nil
 			}
+			MetricModerationRejections.Inc(clientID, "speak_status")
 			go SendAssetsNotPassMsg(clientID, msg.UserID, msg.MessageID, false)
 			if checkMessageCountLimit(ctx, clientID, msg.UserID, ClientUserStatusAudience) {
 				go SendToClientManager(clientID, msg, true, true)
@@ -208,10 +217,12 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 	// 大户
 	case ClientUserStatusLarge:
 		if checkMsgIsForbid(&clientUser, msg) {
+			MetricModerationRejections.Inc(clientID, "forbid")
 			return nil
 		}
 		// 检查语言是否符合大群
 		if checkMsgLanguage(msg, clientID) {
+			MetricModerationRejections.Inc(clientID, "language")
 			go rejectMsgAndDeliverManagerWithOperationBtns(clientID, msg, config.Text.LanguageReject, config.Text.LanguageAdmin)
 			return nil
 		}
@@ -219,11 +230,12 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 		if conversationStatus == ClientConversationStatusMute ||
 			conversationStatus == ClientConversationStatusAudioLive {
 			// 给用户发一条禁言中...
+			MetricModerationRejections.Inc(clientID, "conversation_mute")
 			go SendClientMuteMsg(clientID, msg.UserID)
 			return nil
 		}
 		// 检测是否含有链接
-		if !checkHasClientMemberAuth(ctx, clientID, "url", clientUser.Status) &&
+		if !checkHasClientMemberAuth(ctx, clientID, msg.UserID, "url", clientUser.Status) &&
 			checkHasURLMsg(ctx, clientID, msg) {
 			var rejectMsg string
 			if msg.Category == mixin.MessageCategoryPlainText ||
@@ -232,11 +244,13 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 			} else if msg.Category == mixin.MessageCategoryPlainImage || msg.Category == "ENCRYPTED_IMAGE" {
 				rejectMsg = config.Text.QrcodeReject
 			}
+			MetricModerationRejections.Inc(clientID, "url")
 			go rejectMsgAndDeliverManagerWithOperationBtns(clientID, msg, rejectMsg, config.Text.URLAdmin)
 			return nil
 		}
 		// 检测最近5s是否发了多个 sticker
 		if checkStickerLimit(ctx, clientID, msg) {
+			MetricModerationRejections.Inc(clientID, "sticker")
 			go muteClientUser(ctx, clientID, msg.UserID, "2")
 			return nil
 		}
@@ -274,11 +288,13 @@ func ReceivedMessage(ctx context.Context, clientID string, msg *mixin.MessageVie
 	case ClientUserStatusGuest:
 		if !checkMessageCountLimit(ctx, clientID, msg.UserID, clientUser.Status) {
 			// 达到限制
-			go SendLimitMsg(clientID, msg.UserID, statusLimitMap[clientUser.Status])
+			MetricModerationRejections.Inc(clientID, "limit")
+			go SendLimitMsg(clientID, msg.UserID, getUserMessageLimit(ctx, clientID, msg.UserID, clientUser.Status))
 			return nil
 		}
 		// 检测是否是需要忽略的消息类型
-		if !checkCategory(ctx, clientID, msg.Category, clientUser.Status) {
+		if !checkCategory(ctx, clientID, msg.UserID, msg.Category, clientUser.Status) {
+			MetricModerationRejections.Inc(clientID, "category")
 			go SendCategoryMsg(clientID, msg.UserID, msg.Category, clientUser.Status)
 			return nil
 		}
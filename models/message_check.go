@@ -23,7 +23,7 @@ func checkIsQuoteLeaveMessage(ctx context.Context, u *ClientUser, msg *mixin.Mes
 	if msg.QuoteMessageID == "" {
 		return false, nil
 	}
-	dm, err := getDistributeMsgByMsgIDFromRedis(ctx, msg.QuoteMessageID)
+	dm, err := getDistributeMsgByMsgID(ctx, msg.QuoteMessageID)
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return false, nil
@@ -142,7 +142,7 @@ func checkIsContact(ctx context.Context, clientID, conversationID string) bool {
 		session.Logger(ctx).Println(err)
 		return false
 	}
-	c, err := client.ReadConversation(ctx, conversationID)
+	c, err := client.Transport.ReadConversation(ctx, conversationID)
 	if err != nil {
 		session.Logger(ctx).Println(err)
 		return false
@@ -179,7 +179,7 @@ func checkCanNotSendLuckyCoin(ctx context.Context, clientID, data, status string
 		session.Logger(ctx).Println(err, user)
 		return true
 	}
-	if !checkHasClientMemberAuth(ctx, clientID, "lucky_coin", user.Status) {
+	if !checkHasClientMemberAuth(ctx, clientID, uid, "lucky_coin", user.Status) {
 		return true
 	}
 	if (status == ClientConversationStatusMute ||
@@ -290,16 +290,16 @@ AND now()-created_at<interval '1 minutes'
 `, clientID, userID).Scan(&count); err != nil {
 		return false
 	}
-	limit := statusLimitMap[status]
+	limit := getUserMessageLimit(ctx, clientID, userID, status)
 	return count < limit
 }
 
 // 检查用户是否可以发送目标的消息类型
-func checkCategory(ctx context.Context, clientID, category string, status int) bool {
+func checkCategory(ctx context.Context, clientID, userID, category string, status int) bool {
 	if category == mixin.MessageCategoryMessageRecall ||
 		status == ClientUserStatusAdmin ||
 		status == ClientUserStatusGuest {
 		return true
 	}
-	return checkHasClientMemberAuth(ctx, clientID, category, status)
+	return checkHasClientMemberAuth(ctx, clientID, userID, category, status)
 }
@@ -4,7 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"hash/crc32"
 	"strconv"
 	"strings"
 	"time"
@@ -16,7 +16,6 @@ import (
 	"github.com/fox-one/mixin-sdk-go"
 	"github.com/go-redis/redis/v8"
 	"github.com/jackc/pgx/v4"
-	"github.com/shopspring/decimal"
 )
 
 type transcript map[string]interface{}
@@ -40,7 +39,8 @@ func createAndDistributeMessage(ctx context.Context, clientID string, msg *mixin
 
 // 创建分发消息 标记 并把消息标记
 func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg *mixin.MessageView, priorityList []int) error {
-	userList, err := GetClientUserByPriority(ctx, clientID, priorityList, false, false)
+	modes := deliveryModesBySender(ctx, clientID, msg.UserID)
+	userList, err := getClientUserByPriorityAndModes(ctx, clientID, priorityList, modes, false, false)
 	if err != nil {
 		return err
 	}
@@ -51,6 +51,13 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 	} else if level == ClientUserPriorityLow {
 		status = MessageStatusFinished
 	}
+	return createDistributeMsgByUserList(ctx, clientID, msg, userList, level, status, "")
+}
+
+// 给 userList 创建分发消息，并把消息标记为 status
+// redeliverID 不为空时是重新投递，消息 ID 加上 redeliverID，且不修改消息的状态
+func createDistributeMsgByUserList(ctx context.Context, clientID string, msg *mixin.MessageView, userList []string, level, status int, redeliverID string) error {
+	var err error
 	// 处理 撤回 消息
 	recallMsgIDMap := make(map[string]string)
 	if msg.Category == mixin.MessageCategoryMessageRecall {
@@ -106,7 +113,7 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 	msgs := make([]*DistributeMessage, 0, len(userList))
 	quoteMessageIDMap := make(map[string]string)
 	if msg.QuoteMessageID != "" {
-		originMsg, _ := getDistributeMsgByMsgIDFromRedis(ctx, msg.QuoteMessageID)
+		originMsg, _ := getDistributeMsgByMsgID(ctx, msg.QuoteMessageID)
 		if originMsg != nil && originMsg.OriginMessageID != "" {
 			quoteMessageIDMap, _, err = getDistributeMessageIDMapByOriginMsgID(ctx, clientID, originMsg.OriginMessageID)
 			if err != nil {
@@ -136,6 +143,12 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 	}
 
 	now := time.Now()
+	// 按原消息的时间排序，保证同一个用户的消息按顺序发送
+	createdAt := msg.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+	translatedData := getTranslatedDataMap(ctx, clientID, msg, userList)
 	for _, userID := range userList {
 		if userID == msg.UserID || userID == msg.RepresentativeID || checkIsBlockUser(ctx, clientID, userID) {
 			continue
@@ -161,12 +174,16 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 			data, _ := json.Marshal(map[string]interface{}{"message_ids": pinMsgIDs[userID], "action": action})
 			_data = tools.Base64Encode(data)
 		}
+		// 处理 翻译 消息
+		if translatedData[userID] != "" {
+			_data = translatedData[userID]
+		}
 		if msg.QuoteMessageID != "" && quoteMessageIDMap[userID] == "" {
 			quoteMessageIDMap[userID] = msg.QuoteMessageID
 		}
 
 		// 处理 聊天记录 消息
-		msgID := mixin.UniqueConversationID(clientID+userID+msg.MessageID, userID+msg.MessageID+clientID)
+		msgID := mixin.UniqueConversationID(clientID+userID+msg.MessageID+redeliverID, userID+msg.MessageID+clientID+redeliverID)
 		if msg.Category == "PLAIN_TRANSCRIPT" ||
 			msg.Category == "ENCRYPTED_TRANSCRIPT" {
 			t := make([]transcript, 0)
@@ -196,13 +213,18 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 			RepresentativeID: sendUserID,
 			Level:            level,
 			Status:           DistributeMessageStatusPending,
-			CreatedAt:        time.Now(),
+			RedeliverID:      redeliverID,
+			CreatedAt:        createdAt,
 		})
 	}
 	if err := createDistributeMsgToRedis(ctx, msgs); err != nil {
 		session.Logger(ctx).Println(err)
 		return err
 	}
+	if redeliverID != "" {
+		tools.PrintTimeDuration(fmt.Sprintf("%d条重新投递消息入库%s", len(msgs), clientID), now)
+		return nil
+	}
 	if err := session.Redis(ctx).Set(ctx, fmt.Sprintf("msg_status:%s", msg.MessageID), strconv.Itoa(status), -1).Err(); err != nil {
 		return err
 	}
@@ -212,7 +234,8 @@ func CreateDistributeMsgAndMarkStatus(ctx context.Context, clientID string, msg
 
 func getOriginMsgIDMapAndUpdateMsg(ctx context.Context, clientID string, msg *mixin.MessageView) (map[string]string, error) {
 	originMsgID := getRecallOriginMsgID(ctx, msg.Data)
-	return getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, originMsgID)
+	deleteMessageSearch(ctx, clientID, originMsgID)
+	return getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, clientID, originMsgID)
 }
 
 func getPINMsgIDMapAndUpdateMsg(ctx context.Context, msg *mixin.MessageView, clientID string) (map[string][]string, string, error) {
@@ -223,7 +246,7 @@ func getPINMsgIDMapAndUpdateMsg(ctx context.Context, msg *mixin.MessageView, cli
 	var pinMsgIDMaps map[string][]string
 	var err error
 	if action == "PIN" {
-		pinMsgIDMaps, err = getQuoteMsgIDUserIDsMapsFromRedis(ctx, orginMsgIDs)
+		pinMsgIDMaps, err = getQuoteMsgIDUserIDsMapsFromRedis(ctx, clientID, orginMsgIDs)
 	} else if action == "UNPIN" {
 		pinMsgIDMaps, err = getUserIDMsgIDMapByOriginMsgIDFromPsql(ctx, orginMsgIDs)
 	}
@@ -245,12 +268,16 @@ func getPINMsgIDMapAndUpdateMsg(ctx context.Context, msg *mixin.MessageView, cli
 	return pinMsgIDMaps, action, nil
 }
 
-func getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx context.Context, originMsgID string) (map[string]string, error) {
+func getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx context.Context, clientID, originMsgID string) (map[string]string, error) {
 	recallMsgIDMap := make(map[string]string)
 	resList, err := session.Redis(ctx).SMembers(ctx, "origin_msg_idx:"+originMsgID).Result()
 	if err != nil {
 		return nil, err
 	}
+	if len(resList) == 0 {
+		// redis 中过期后从 message_mapping 中查找
+		return getMessageMappingByOriginMsgID(ctx, clientID, originMsgID)
+	}
 	for _, res := range resList {
 		msg, err := getMsgOriginFromRedisResult(res)
 		if err != nil {
@@ -261,10 +288,10 @@ func getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx context.Context, originMsg
 	return recallMsgIDMap, nil
 }
 
-func getQuoteMsgIDUserIDsMapsFromRedis(ctx context.Context, originMsgIDs []string) (map[string][]string, error) {
+func getQuoteMsgIDUserIDsMapsFromRedis(ctx context.Context, clientID string, originMsgIDs []string) (map[string][]string, error) {
 	quoteMsgIDMap := make(map[string][]string)
 	for _, originMsgID := range originMsgIDs {
-		msgIDMap, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, originMsgID)
+		msgIDMap, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, clientID, originMsgID)
 		if err != nil {
 			return nil, err
 		}
@@ -351,6 +378,7 @@ func createdPINDistributeMsg(ctx context.Context, clientID string, msgIDs []stri
 		session.Logger(ctx).Println(err)
 	}
 	// 2. 存入 psql 中
+	now := time.Now()
 	dataInserts := make([][]interface{}, 0, len(msgIDs))
 	for i, v := range result {
 		tmp, err := v.Result()
@@ -363,7 +391,7 @@ func createdPINDistributeMsg(ctx context.Context, clientID string, msgIDs []stri
 			session.Logger(ctx).Println(err)
 			continue
 		}
-		dataInserts = append(dataInserts, []interface{}{clientID, msg.UserID, msg.OriginMessageID, msgIDs[i], msg.Status})
+		dataInserts = append(dataInserts, []interface{}{clientID, msg.UserID, msg.OriginMessageID, msgIDs[i], msg.Status, now})
 	}
 	if err := createDistributeMsgList(ctx, dataInserts); err != nil {
 		session.Logger(ctx).Println(err)
@@ -379,7 +407,7 @@ func removePINDistributeMsg(ctx context.Context, msgIDs []string) {
 	}
 }
 
-var distributeCols = []string{"client_id", "user_id", "origin_message_id", "message_id", "status"}
+var distributeCols = []string{"client_id", "user_id", "origin_message_id", "message_id", "status", "created_at"}
 
 func createDistributeMsgList(ctx context.Context, insert [][]interface{}) error {
 	var ident = pgx.Identifier{"distribute_messages"}
@@ -395,12 +423,9 @@ func createDistributeMsgList(ctx context.Context, insert [][]interface{}) error
 	return nil
 }
 
+// 同一个用户的消息始终在同一个分片，保证按顺序发送
 func getShardID(clientID, userID string) string {
-	shardID := ClientShardIDMap[clientID][userID]
-	if shardID == "" {
-		shardID = strconv.Itoa(rand.Intn(int(config.MessageShardSize)))
-	}
-	return shardID
+	return strconv.Itoa(int(crc32.ChecksumIEEE([]byte(userID)) % uint32(config.MessageShardSize)))
 }
 
 func getRecallOriginMsgID(ctx context.Context, msgData string) string {
@@ -424,7 +449,7 @@ func getPinOriginMsgIDs(ctx context.Context, msgData string) (string, []string)
 		var m *DistributeMessage
 		var err error
 		if msg.Action == "PIN" {
-			m, err = getDistributeMsgByMsgIDFromRedis(ctx, msgID)
+			m, err = getDistributeMsgByMsgID(ctx, msgID)
 		} else if msg.Action == "UNPIN" {
 			m, err = getDistributeMsgByMsgIDFromPsql(ctx, msgID)
 		}
@@ -437,49 +462,3 @@ func getPinOriginMsgIDs(ctx context.Context, msgData string) (string, []string)
 	}
 	return msg.Action, msgIDs
 }
-
-var ClientShardIDMap = make(map[string]map[string]string)
-
-func InitShardID(ctx context.Context, clientID string) error {
-	ClientShardIDMap[clientID] = make(map[string]string)
-	// 1. 获取有多少个协程，就分配多少个编号
-	count := decimal.NewFromInt(config.MessageShardSize)
-	// 2. 获取优先级高/低的所有用户，及高低比例
-	high, low, err := GetClientUserReceived(ctx, clientID)
-	if err != nil {
-		return err
-	}
-	// 每个分组的平均人数
-	highCount := int(decimal.NewFromInt(int64(len(high))).Div(count).Ceil().IntPart())
-	lowCount := int(decimal.NewFromInt(int64(len(low))).Div(count).Ceil().IntPart())
-	// 3. 给这个大群里 每个用户进行 编号
-	for shardID := 0; shardID < int(config.MessageShardSize); shardID++ {
-		strShardID := strconv.Itoa(shardID)
-		cutCount := 0
-		hC := len(high)
-		for i := 0; i < highCount; i++ {
-			if i == hC {
-				break
-			}
-			cutCount++
-			ClientShardIDMap[clientID][high[i]] = strShardID
-		}
-		if cutCount > 0 {
-			high = high[cutCount:]
-		}
-
-		cutCount = 0
-		lC := len(low)
-		for i := 0; i < lowCount; i++ {
-			if i == lC {
-				break
-			}
-			cutCount++
-			ClientShardIDMap[clientID][low[i]] = strShardID
-		}
-		if cutCount > 0 {
-			low = low[cutCount:]
-		}
-	}
-	return nil
-}
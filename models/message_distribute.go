@@ -17,23 +17,23 @@ import (
 )
 
 const distribute_messages_DDL = `
--- 分发的消息
+-- 分发的消息，按 created_at 每月一个分区
 CREATE TABLE IF NOT EXISTS distribute_messages (
 	client_id           VARCHAR(36) NOT NULL,
 	user_id             VARCHAR(36) NOT NULL,
-  conversation_id     VARCHAR(36) NOT NULL,
-  shard_id            VARCHAR(36) NOT NULL,
+  conversation_id     VARCHAR(36) NOT NULL DEFAULT '',
+  shard_id            VARCHAR(36) NOT NULL DEFAULT '',
 	origin_message_id   VARCHAR(36) NOT NULL,
 	message_id          VARCHAR(36) NOT NULL,
 	quote_message_id    VARCHAR(36) NOT NULL DEFAULT '',
   data                TEXT NOT NULL DEFAULT '',
   category            VARCHAR NOT NULL DEFAULT '',
   representative_id   VARCHAR(36) NOT NULL DEFAULT '',
-	level               SMALLINT NOT NULL, -- 1 高优先级 2 低优先级 3 单独队列
+	level               SMALLINT NOT NULL DEFAULT 2, -- 1 高优先级 2 低优先级 3 单独队列
 	status              SMALLINT NOT NULL DEFAULT 1, -- 1 待分发 2 已分发
-	created_at          TIMESTAMP WITH TIME ZONE NOT NULL,
-	PRIMARY KEY(client_id, user_id, origin_message_id)
-);
+	created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+	PRIMARY KEY(client_id, user_id, origin_message_id, created_at)
+) PARTITION BY RANGE (created_at);
 CREATE INDEX IF NOT EXISTS distribute_messages_all_list_idx ON distribute_messages (client_id, shard_id, status, level, created_at);
 CREATE INDEX IF NOT EXISTS distribute_messages_id_idx ON distribute_messages (message_id);
 `
@@ -52,6 +52,8 @@ type DistributeMessage struct {
 	Level            int       `json:"level,omitempty"`
 	Status           int       `json:"status,omitempty"`
 	CreatedAt        time.Time `json:"created_at,omitempty"`
+
+	RedeliverID string `json:"redeliver_id,omitempty"` // 重新投递任务，只保存在 redis 中
 }
 
 const (
@@ -67,40 +69,55 @@ const (
 	DistributeMessageStatusPINMessage   = 10 // PIN 的 message
 )
 
-// 删除超时的消息
-func RemoveOvertimeDistributeMessages(ctx context.Context) error {
-	_, err := session.Database(ctx).Exec(ctx, `DELETE FROM distribute_messages WHERE status IN (2,3,6) AND now()-created_at>interval '1 days'`)
-	return err
-}
-
 // 获取指定的消息
+// 每个用户只取最早的一条待发送消息，保证同一个用户按原消息的时间顺序收到
 func PendingActiveDistributedMessages(ctx context.Context, clientID, shardID string) ([]*mixin.MessageRequest, map[string]*DistributeMessage, error) {
 	dms := make([]*mixin.MessageRequest, 0)
 	msgOriginMsgIDMap := make(map[string]*DistributeMessage)
-	msgIDs, err := session.Redis(ctx).ZRange(ctx, fmt.Sprintf("s_msg:%s:%s", clientID, shardID), 0, 99).Result()
+	shardKey := fmt.Sprintf("s_msg:%s:%s", clientID, shardID)
+	msgIDs, err := session.Redis(ctx).ZRange(ctx, shardKey, 0, 99).Result()
 	if err != nil {
 		return nil, nil, err
 	}
 
 	result := make([]*redis.StringStringMapCmd, 0, len(msgIDs))
-	for _, v := range msgIDs {
-		if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, v := range msgIDs {
 			result = append(result, p.HGetAll(ctx, fmt.Sprintf("d_msg:%s:%s", clientID, v)))
-			return nil
-		}); err != nil {
-			return nil, nil, err
 		}
+		return nil
+	}); err != nil {
+		return nil, nil, err
 	}
 	userIDs := make(map[string]bool)
-	for _, v := range result {
+	candidates := make([]map[string]string, 0, len(result))
+	sent := make([]interface{}, 0)
+	for i, v := range result {
 		msg, err := v.Result()
 		if err != nil {
 			return nil, nil, err
 		}
+		if len(msg) == 0 {
+			// 已经发送过的消息
+			sent = append(sent, msgIDs[i])
+			continue
+		}
 		if userIDs[msg["user_id"]] {
 			continue
 		}
 		userIDs[msg["user_id"]] = true
+		candidates = append(candidates, msg)
+	}
+	if len(sent) > 0 {
+		if err := session.Redis(ctx).ZRem(ctx, shardKey, sent...).Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	candidates, err = getUsersFirstPendingMsg(ctx, clientID, candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, msg := range candidates {
 		originMsg, err := getMessageByMsgID(ctx, clientID, msg["origin_message_id"])
 		if err != nil {
 			if errors.Is(err, pgx.ErrNoRows) {
@@ -114,8 +131,11 @@ func PendingActiveDistributedMessages(ctx context.Context, clientID, shardID str
 		}
 		l, _ := strconv.Atoi(msg["level"])
 		msgOriginMsgIDMap[msg["message_id"]] = &DistributeMessage{
+			UserID:          msg["user_id"],
 			Level:           l,
 			OriginMessageID: msg["origin_message_id"],
+			RedeliverID:     msg["redeliver_id"],
+			CreatedAt:       originMsg.CreatedAt,
 		}
 		mr := mixin.MessageRequest{
 			RepresentativeID: originMsg.UserID,
@@ -134,6 +154,70 @@ func PendingActiveDistributedMessages(ctx context.Context, clientID, shardID str
 	return dms, msgOriginMsgIDMap, err
 }
 
+func userPendingMsgKey(clientID, userID string) string {
+	return fmt.Sprintf("u_msg:%s:%s", clientID, userID)
+}
+
+// 换成每个用户最早的一条待发送消息，按原消息的创建时间排序
+// 最早的一条已经发送过时只清理，这个用户本轮不发送
+func getUsersFirstPendingMsg(ctx context.Context, clientID string, msgs []map[string]string) ([]map[string]string, error) {
+	if len(msgs) == 0 {
+		return msgs, nil
+	}
+	firsts := make([]*redis.StringSliceCmd, 0, len(msgs))
+	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, msg := range msgs {
+			firsts = append(firsts, p.ZRange(ctx, userPendingMsgKey(clientID, msg["user_id"]), 0, 0))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	res := make([]map[string]string, len(msgs))
+	earlier := make(map[int]*redis.StringStringMapCmd)
+	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, msg := range msgs {
+			first, err := firsts[i].Result()
+			if err != nil {
+				return err
+			}
+			if len(first) == 0 || first[0] == msg["message_id"] {
+				res[i] = msg
+				continue
+			}
+			earlier[i] = p.HGetAll(ctx, fmt.Sprintf("d_msg:%s:%s", clientID, first[0]))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, cmd := range earlier {
+			msg, err := cmd.Result()
+			if err != nil {
+				return err
+			}
+			if len(msg) > 0 {
+				res[i] = msg
+				continue
+			}
+			if err := p.ZRem(ctx, userPendingMsgKey(clientID, msgs[i]["user_id"]), firsts[i].Val()[0]).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	list := make([]map[string]string, 0, len(res))
+	for _, msg := range res {
+		if msg != nil {
+			list = append(list, msg)
+		}
+	}
+	return list, nil
+}
+
 var cacheMessageData *tools.Mutex
 
 func getMessageByMsgID(ctx context.Context, clientID, messageID string) (*Message, error) {
@@ -159,6 +243,11 @@ func init() {
 }
 
 func UpdateDistributeMessagesStatusToFinished(ctx context.Context, clientID, shardID string, msgIDs []string, msgOriginMsgIDMap map[string]*DistributeMessage) error {
+	return updateDistributeMessagesStatusToFinished(ctx, clientID, shardID, msgIDs, msgOriginMsgIDMap, true)
+}
+
+// sent 为 false 时消息没有真正发出（比如免打扰时跳过），不计入分发统计
+func updateDistributeMessagesStatusToFinished(ctx context.Context, clientID, shardID string, msgIDs []string, msgOriginMsgIDMap map[string]*DistributeMessage, sent bool) error {
 	_, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
 		members := make([]interface{}, 0, len(msgIDs))
 		for _, msgID := range msgIDs {
@@ -167,6 +256,22 @@ func UpdateDistributeMessagesStatusToFinished(ctx context.Context, clientID, sha
 				return err
 			}
 			msg := msgOriginMsgIDMap[msgID]
+			if err := p.ZRem(ctx, userPendingMsgKey(clientID, msg.UserID), msgID).Err(); err != nil {
+				return err
+			}
+			if distributeOrderCheck {
+				checkDistributeOrder(ctx, clientID, msg)
+			}
+			if sent {
+				if err := incrMessageStatDistributed(ctx, p, clientID, msg.OriginMessageID, 1); err != nil {
+					return err
+				}
+				if msg.RedeliverID != "" {
+					if err := incrRedeliverSent(ctx, p, msg.RedeliverID); err != nil {
+						return err
+					}
+				}
+			}
 			msgBalance, err := session.Redis(ctx).Decr(ctx, fmt.Sprintf("l_msg:%s", msg.OriginMessageID)).Result()
 			if err != nil {
 				return err
@@ -226,7 +331,7 @@ func UpdateDistributeMessagesStatusToFinished(ctx context.Context, clientID, sha
 
 func getDistributeMessageIDMapByOriginMsgID(ctx context.Context, clientID, originMsgID string) (map[string]string, string, error) {
 	// 2. 用 origin_message_id 和 user_id 找出 对应会话 里的 message_id ，这个 message_id 就是要 quote 的 id
-	mapList, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, originMsgID)
+	mapList, err := getQuoteMsgIDUserIDMapByOriginMsgIDFromRedis(ctx, clientID, originMsgID)
 	if err != nil {
 		session.Logger(ctx).Println(err)
 		return nil, "", err
@@ -255,8 +360,14 @@ DELETE FROM messages WHERE client_id=$1 AND status=ANY($2)`, clientID, []int{Mes
 		DeleteDistributeMsgByClientID(ctx, clientID)
 		return
 	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+DELETE FROM message_search s WHERE client_id=$1 AND NOT EXISTS (
+	SELECT 1 FROM messages m WHERE m.client_id=s.client_id AND m.message_id=s.message_id
+)`, clientID); err != nil {
+		session.Logger(ctx).Println(err)
+	}
 	_, err = session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
-		dMsgs, err := session.Redis(ctx).Keys(ctx, fmt.Sprintf("d_msg:%s:*", clientID)).Result()
+		dMsgs, err := scanRedisKeys(ctx, fmt.Sprintf("d_msg:%s:*", clientID))
 		if err != nil {
 			return err
 		}
@@ -267,7 +378,7 @@ DELETE FROM messages WHERE client_id=$1 AND status=ANY($2)`, clientID, []int{Mes
 			return nil
 		}
 
-		sMsgs, err := session.Redis(ctx).Keys(ctx, fmt.Sprintf("s_msg:%s:*", clientID)).Result()
+		sMsgs, err := scanRedisKeys(ctx, fmt.Sprintf("s_msg:%s:*", clientID))
 		if err != nil {
 			return err
 		}
@@ -276,6 +387,15 @@ DELETE FROM messages WHERE client_id=$1 AND status=ANY($2)`, clientID, []int{Mes
 				return err
 			}
 		}
+		uMsgs, err := scanRedisKeys(ctx, fmt.Sprintf("u_msg:%s:*", clientID))
+		if err != nil {
+			return err
+		}
+		if len(uMsgs) > 0 {
+			if err := p.Del(ctx, uMsgs...).Err(); err != nil {
+				return err
+			}
+		}
 
 		oMsgIDs := make(map[string]bool)
 		for _, res := range dMsgs {
@@ -312,6 +432,16 @@ DELETE FROM messages WHERE client_id=$1 AND status=ANY($2)`, clientID, []int{Mes
 	}
 }
 
+// 用 SCAN 代替 KEYS，避免阻塞 redis
+func scanRedisKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := session.Redis(ctx).Scan(ctx, 0, pattern, 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
 func createFinishedDistributeMsg(ctx context.Context, clientID, userID, originMessageID, conversationID, shardID, messageID, quoteMessageID string, createdAt time.Time) error {
 	return createDistributeMsgToRedis(ctx, []*DistributeMessage{{
 		ClientID:        clientID,
@@ -0,0 +1,379 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/jackc/pgx/v4"
+)
+
+const message_export_DDL = `
+-- 导出群聊天记录的任务
+CREATE TABLE IF NOT EXISTS message_export (
+  export_id           VARCHAR(36) NOT NULL PRIMARY KEY,
+  client_id           VARCHAR(36) NOT NULL,
+  format              VARCHAR(16) NOT NULL, -- jsonl, csv, html
+  start_at            TIMESTAMP WITH TIME ZONE NOT NULL,
+  end_at              TIMESTAMP WITH TIME ZONE NOT NULL,
+  state               SMALLINT NOT NULL DEFAULT 1, -- 1 等待 2 导出中 3 完成 4 失败 5 已过期
+  count               BIGINT NOT NULL DEFAULT 0,
+  size                BIGINT NOT NULL DEFAULT 0,
+  file_name           VARCHAR NOT NULL DEFAULT '',
+  error               VARCHAR NOT NULL DEFAULT '',
+  created_by          VARCHAR(36) NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS message_export_client_idx ON message_export (client_id, created_at);
+CREATE INDEX IF NOT EXISTS message_export_state_idx ON message_export (state, created_at);
+
+-- 导出的文件按块保存在数据库中，http 服务和 export 服务不需要共用目录
+CREATE TABLE IF NOT EXISTS message_export_chunk (
+  export_id           VARCHAR(36) NOT NULL,
+  seq                 INTEGER NOT NULL,
+  data                BYTEA NOT NULL,
+  PRIMARY KEY(export_id, seq)
+);
+`
+
+type MessageExport struct {
+	ExportID  string    `json:"export_id"`
+	ClientID  string    `json:"client_id"`
+	Format    string    `json:"format"`
+	StartAt   time.Time `json:"start_at"`
+	EndAt     time.Time `json:"end_at"`
+	State     int       `json:"state"`
+	Count     int64     `json:"count"`
+	Size      int64     `json:"size"`
+	FileName  string    `json:"file_name"`
+	Error     string    `json:"error,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const (
+	ExportFormatJSONL = "jsonl"
+	ExportFormatCSV   = "csv"
+	ExportFormatHTML  = "html"
+
+	ExportStatePending  = 1
+	ExportStateRunning  = 2
+	ExportStateFinished = 3
+	ExportStateFailed   = 4
+	ExportStateExpired  = 5
+)
+
+// 导出的文件保存 7 天
+const exportSavedTime = 7 * 24 * time.Hour
+
+const exportChunkSize = 1024 * 1024
+
+// 导出中的任务定时更新进度，超过 exportLeaseTime 没有更新说明执行的 export 服务已经退出
+const (
+	exportHeartbeatTime = 15 * time.Second
+	exportLeaseTime     = 2 * time.Minute
+)
+
+// 导出群里分发过的消息，不包括管理员留言等私聊消息
+var exportMessageStatus = []int{MessageStatusPending, MessageStatusPrivilege, MessageStatusNormal, MessageStatusFinished, MessageStatusBroadcast, MessageStatusClientMsg, MessageStatusPINMsg, MessageStatusSegmentMsg}
+
+func CreateMessageExportByAdmin(ctx context.Context, u *ClientUser, e *MessageExport) (*MessageExport, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	var running int
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT COUNT(1) FROM message_export WHERE client_id=$1 AND state IN ($2,$3)
+`, u.ClientID, ExportStatePending, ExportStateRunning).Scan(&running); err != nil {
+		return nil, err
+	}
+	if running > 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	e.ClientID = u.ClientID
+	e.CreatedBy = u.UserID
+	return CreateMessageExport(ctx, e)
+}
+
+// 创建导出任务，由 export 服务执行
+func CreateMessageExport(ctx context.Context, e *MessageExport) (*MessageExport, error) {
+	switch e.Format {
+	case ExportFormatJSONL, ExportFormatCSV, ExportFormatHTML:
+	default:
+		return nil, session.BadDataError(ctx)
+	}
+	if e.StartAt.IsZero() || !e.EndAt.After(e.StartAt) {
+		return nil, session.BadDataError(ctx)
+	}
+	e.ExportID = tools.GetUUID()
+	e.State = ExportStatePending
+	e.CreatedAt = time.Now()
+	e.UpdatedAt = e.CreatedAt
+	if _, err := session.Database(ctx).Exec(ctx, `
+INSERT INTO message_export(export_id,client_id,format,start_at,end_at,state,created_by,created_at,updated_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9)
+`, e.ExportID, e.ClientID, e.Format, e.StartAt, e.EndAt, e.State, e.CreatedBy, e.CreatedAt, e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func GetMessageExport(ctx context.Context, u *ClientUser, exportID string) (*MessageExport, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list, err := getMessageExports(ctx, `WHERE client_id=$1 AND export_id=$2`, u.ClientID, exportID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	return list[0], nil
+}
+
+func GetMessageExportList(ctx context.Context, u *ClientUser) ([]*MessageExport, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getMessageExports(ctx, `WHERE client_id=$1 ORDER BY created_at DESC LIMIT 50`, u.ClientID)
+}
+
+// 已完成的导出任务，用于下载
+func GetMessageExportFile(ctx context.Context, u *ClientUser, exportID string) (*MessageExport, error) {
+	e, err := GetMessageExport(ctx, u, exportID)
+	if err != nil {
+		return nil, err
+	}
+	if e.State != ExportStateFinished {
+		return nil, session.BadDataError(ctx)
+	}
+	return e, nil
+}
+
+// 按顺序把导出文件的每一块写入 w，每次只读取一块
+func CopyMessageExportFile(ctx context.Context, exportID string, w io.Writer) error {
+	for seq := 0; ; seq++ {
+		var data []byte
+		err := session.Database(ctx).QueryRow(ctx, `
+SELECT data FROM message_export_chunk WHERE export_id=$1 AND seq=$2
+`, exportID, seq).Scan(&data)
+		if durable.IsEmpty(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+}
+
+func getMessageExports(ctx context.Context, where string, args ...interface{}) ([]*MessageExport, error) {
+	list := make([]*MessageExport, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT export_id,client_id,format,start_at,end_at,state,count,size,file_name,error,created_by,created_at,updated_at
+FROM message_export `+where, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var e MessageExport
+			if err := rows.Scan(&e.ExportID, &e.ClientID, &e.Format, &e.StartAt, &e.EndAt, &e.State, &e.Count, &e.Size, &e.FileName, &e.Error, &e.CreatedBy, &e.CreatedAt, &e.UpdatedAt); err != nil {
+				return err
+			}
+			list = append(list, &e)
+		}
+		return nil
+	}, args...)
+	return list, err
+}
+
+// 取一个等待中的任务并标记为导出中，没有任务时返回 nil
+func ClaimMessageExport(ctx context.Context) (*MessageExport, error) {
+	list, err := getMessageExports(ctx, `WHERE export_id=(
+SELECT export_id FROM message_export WHERE state=$1 ORDER BY created_at LIMIT 1
+)`, ExportStatePending)
+	if err != nil || len(list) == 0 {
+		return nil, err
+	}
+	e := list[0]
+	tag, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_export SET state=$3,updated_at=NOW() WHERE export_id=$1 AND state=$2
+`, e.ExportID, ExportStatePending, ExportStateRunning)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		// 被其他 export 服务取走了
+		return nil, nil
+	}
+	e.State = ExportStateRunning
+	return e, nil
+}
+
+// 执行的 export 服务退出后，超过租约时间没有更新的任务重新导出
+func ResetStaleMessageExports(ctx context.Context) error {
+	_, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_export SET state=$2,updated_at=NOW() WHERE state=$1 AND updated_at<$3
+`, ExportStateRunning, ExportStatePending, time.Now().Add(-exportLeaseTime))
+	return err
+}
+
+// 导出消息并保存文件，任务的最终状态由这里更新
+func RunMessageExport(ctx context.Context, e *MessageExport) error {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		heartbeatMessageExport(ctx, e, stop)
+	}()
+	err := writeMessageExport(ctx, e)
+	close(stop)
+	<-done
+	state, errMsg := ExportStateFinished, ""
+	if err != nil {
+		state, errMsg = ExportStateFailed, err.Error()
+		e.FileName = ""
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_export SET state=$2,count=$3,size=$4,file_name=$5,error=$6,updated_at=NOW() WHERE export_id=$1
+`, e.ExportID, state, e.Count, e.Size, e.FileName, errMsg); err != nil {
+		return err
+	}
+	e.State = state
+	return err
+}
+
+// 定时更新进度和 updated_at，作为任务的租约
+func heartbeatMessageExport(ctx context.Context, e *MessageExport, stop chan struct{}) {
+	ticker := time.NewTicker(exportHeartbeatTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_export SET count=$2,updated_at=NOW() WHERE export_id=$1 AND state=$3
+`, e.ExportID, atomic.LoadInt64(&e.Count), ExportStateRunning); err != nil {
+				session.Logger(ctx).Println(err)
+			}
+		}
+	}
+}
+
+// 先写入临时文件，完成后再分块保存到数据库
+func writeMessageExport(ctx context.Context, e *MessageExport) error {
+	f, err := ioutil.TempFile("", "export-*."+e.Format)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	name := e.ClientID
+	if c, err := GetClientByIDOrHost(ctx, e.ClientID); err == nil && c.Name != "" {
+		name = c.Name
+	}
+	w := newExportWriter(e.Format, f)
+	if err := w.header(name, e.StartAt, e.EndAt); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&e.Count, 0)
+	err = session.Database(ctx).ConnQuery(ctx, `
+SELECT m.message_id,m.user_id,COALESCE(u.identity_number,''),COALESCE(u.full_name,''),m.category,m.data,m.quote_message_id,m.created_at
+FROM messages m
+LEFT JOIN users u ON u.user_id=m.user_id
+WHERE m.client_id=$1 AND m.created_at>=$2 AND m.created_at<$3 AND m.status=ANY($4)
+ORDER BY m.created_at
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var m ExportMessage
+			var data string
+			if err := rows.Scan(&m.MessageID, &m.UserID, &m.IdentityNumber, &m.FullName, &m.Category, &data, &m.QuoteMessageID, &m.CreatedAt); err != nil {
+				return err
+			}
+			m.Content, m.AttachmentID = getExportContent(m.Category, data)
+			if err := w.write(&m); err != nil {
+				return err
+			}
+			if atomic.AddInt64(&e.Count, 1)%1000 == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}, e.ClientID, e.StartAt, e.EndAt, exportMessageStatus)
+	if err != nil {
+		return err
+	}
+	if err := w.footer(e.Count); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	e.Size, err = saveMessageExportFile(ctx, e.ExportID, f)
+	if err != nil {
+		return err
+	}
+	e.FileName = fmt.Sprintf("%s-%s-%s.%s", e.ClientID, e.StartAt.Format("20060102"), e.ExportID[:8], e.Format)
+	return nil
+}
+
+// 分块保存导出文件，重新导出时替换之前保存的内容
+func saveMessageExportFile(ctx context.Context, exportID string, r io.Reader) (int64, error) {
+	var size int64
+	err := session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		size = 0
+		if _, err := tx.Exec(ctx, `DELETE FROM message_export_chunk WHERE export_id=$1`, exportID); err != nil {
+			return err
+		}
+		buf := make([]byte, exportChunkSize)
+		for seq := 0; ; seq++ {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if _, err := tx.Exec(ctx, `
+INSERT INTO message_export_chunk(export_id,seq,data) VALUES($1,$2,$3)
+`, exportID, seq, buf[:n]); err != nil {
+					return err
+				}
+				size += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+	return size, err
+}
+
+// 删除过期的导出文件
+func RemoveOvertimeMessageExports(ctx context.Context) error {
+	list, err := getMessageExports(ctx, `WHERE state=$1 AND created_at<$2`, ExportStateFinished, time.Now().Add(-exportSavedTime))
+	if err != nil {
+		return err
+	}
+	for _, e := range list {
+		if _, err := session.Database(ctx).Exec(ctx, `
+DELETE FROM message_export_chunk WHERE export_id=$1
+`, e.ExportID); err != nil {
+			return err
+		}
+		if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_export SET state=$2,updated_at=NOW() WHERE export_id=$1
+`, e.ExportID, ExportStateExpired); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/tools"
+)
+
+// 导出的一条消息，媒体消息只保存 attachment_id
+type ExportMessage struct {
+	MessageID      string    `json:"message_id"`
+	UserID         string    `json:"user_id"`
+	IdentityNumber string    `json:"identity_number"`
+	FullName       string    `json:"full_name"`
+	Category       string    `json:"category"`
+	Content        string    `json:"content,omitempty"`
+	AttachmentID   string    `json:"attachment_id,omitempty"`
+	QuoteMessageID string    `json:"quote_message_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// 文本和文章消息导出原文，其他消息导出去掉缩略图的 json
+func getExportContent(category, data string) (string, string) {
+	raw := strings.ToValidUTF8(string(tools.Base64Decode(data)), "")
+	if searchableCategories[category] {
+		return raw, ""
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &body); err != nil {
+		return "", ""
+	}
+	delete(body, "thumbnail")
+	attachmentID, _ := body["attachment_id"].(string)
+	content, _ := json.Marshal(body)
+	return string(content), attachmentID
+}
+
+type exportWriter interface {
+	header(name string, start, end time.Time) error
+	write(m *ExportMessage) error
+	footer(count int64) error
+}
+
+func newExportWriter(format string, w io.Writer) exportWriter {
+	switch format {
+	case ExportFormatCSV:
+		return &csvExportWriter{w: csv.NewWriter(w)}
+	case ExportFormatHTML:
+		return &htmlExportWriter{w: bufio.NewWriter(w)}
+	}
+	return &jsonlExportWriter{w: bufio.NewWriter(w)}
+}
+
+type jsonlExportWriter struct {
+	w *bufio.Writer
+}
+
+func (j *jsonlExportWriter) header(name string, start, end time.Time) error {
+	return nil
+}
+
+func (j *jsonlExportWriter) write(m *ExportMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonlExportWriter) footer(count int64) error {
+	return j.w.Flush()
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvExportWriter) header(name string, start, end time.Time) error {
+	return c.w.Write([]string{"message_id", "created_at", "user_id", "identity_number", "full_name", "category", "content", "attachment_id", "quote_message_id"})
+}
+
+func (c *csvExportWriter) write(m *ExportMessage) error {
+	return c.w.Write([]string{m.MessageID, m.CreatedAt.Format(time.RFC3339), m.UserID, m.IdentityNumber, m.FullName, m.Category, m.Content, m.AttachmentID, m.QuoteMessageID})
+}
+
+func (c *csvExportWriter) footer(count int64) error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// 不依赖外部资源的单个 html 文件
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body{font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",sans-serif;max-width:800px;margin:0 auto;padding:16px;color:#333}
+.msg{padding:8px 0;border-bottom:1px solid #eee}
+.meta{color:#999;font-size:12px}
+.content{white-space:pre-wrap;word-break:break-word;margin-top:4px}
+.attachment{color:#3d75e3;font-size:13px;margin-top:4px}
+</style>
+</head>
+<body>
+<h2>{{.Name}}</h2>
+<p class="meta">{{.Start}} - {{.End}}</p>
+{{end}}
+{{define "message"}}<div class="msg" id="{{.MessageID}}">
+<div class="meta">{{.FullName}} ({{.IdentityNumber}}) · {{.CreatedAt.Format "2006-01-02 15:04:05"}} · {{.Category}}{{if .QuoteMessageID}} · <a href="#{{.QuoteMessageID}}">quote</a>{{end}}</div>
+{{if .AttachmentID}}<div class="attachment">attachment: {{.AttachmentID}}</div>{{end}}{{if .Content}}<div class="content">{{.Content}}</div>{{end}}
+</div>
+{{end}}
+{{define "footer"}}<p class="meta">{{.}} messages</p>
+</body>
+</html>
+{{end}}
+`))
+
+type htmlExportWriter struct {
+	w *bufio.Writer
+}
+
+func (h *htmlExportWriter) header(name string, start, end time.Time) error {
+	return exportHTMLTemplate.ExecuteTemplate(h.w, "header", map[string]string{
+		"Name":  name,
+		"Start": start.Format(time.RFC3339),
+		"End":   end.Format(time.RFC3339),
+	})
+}
+
+func (h *htmlExportWriter) write(m *ExportMessage) error {
+	return exportHTMLTemplate.ExecuteTemplate(h.w, "message", m)
+}
+
+func (h *htmlExportWriter) footer(count int64) error {
+	if err := exportHTMLTemplate.ExecuteTemplate(h.w, "footer", count); err != nil {
+		return err
+	}
+	return h.w.Flush()
+}
@@ -0,0 +1,268 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+)
+
+type HistoryMessage struct {
+	MessageID      string    `json:"message_id"`
+	UserID         string    `json:"user_id"`
+	FullName       string    `json:"full_name"`
+	AvatarURL      string    `json:"avatar_url"`
+	Category       string    `json:"category"`
+	Data           string    `json:"data"`
+	QuoteMessageID string    `json:"quote_message_id,omitempty"`
+	Pinned         bool      `json:"pinned,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// 一页历史消息，按时间从旧到新排列，before 和 after 为继续翻页的游标，没有更多消息时为空
+type MessageHistory struct {
+	Messages []*HistoryMessage `json:"messages"`
+	Before   string            `json:"before,omitempty"`
+	After    string            `json:"after,omitempty"`
+}
+
+// 翻页的方式，只能选择一种，都为空时返回最新的消息
+type MessageHistoryParams struct {
+	Before string
+	After  string
+	Around string
+	Unread bool
+	Limit  int
+}
+
+const (
+	messageHistoryDefaultLimit = 50
+	messageHistoryMaxLimit     = 100
+)
+
+// 群里分发过的消息，不包括私聊、撤回和 PIN 操作的消息
+var historyMessageStatus = []int{MessageStatusPending, MessageStatusPrivilege, MessageStatusFinished, MessageStatusBroadcast, MessageStatusPINMsg}
+
+// 成员可以看到的消息范围，和搜索一致
+type historyScope struct {
+	where string
+	args  []interface{}
+}
+
+func getHistoryScope(ctx context.Context, u *ClientUser) (*historyScope, time.Time, error) {
+	var joinedAt, readAt time.Time
+	var status, mode int
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT created_at,status,delivery_mode,COALESCE(read_at,created_at) FROM client_users WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID).Scan(&joinedAt, &status, &mode, &readAt)
+	if durable.IsEmpty(err) || status == ClientUserStatusExit || status == ClientUserStatusBlock {
+		return nil, readAt, session.ForbiddenError(ctx)
+	} else if err != nil {
+		return nil, readAt, err
+	}
+	s := &historyScope{
+		where: "m.client_id=$1 AND m.status=ANY($2) AND m.category!=$3 AND m.category!=$4",
+		args:  []interface{}{u.ClientID, historyMessageStatus, mixin.MessageCategoryMessageRecall, "MESSAGE_PIN"},
+	}
+	if status == ClientUserStatusAdmin || status == ClientUserStatusGuest {
+		return s, readAt, nil
+	}
+	s.add(" AND m.created_at>=$%d", joinedAt)
+	if mode == ClientUserDeliveryAdminOnly {
+		s.add(" AND (m.user_id=$%d", u.UserID)
+		s.add(` OR m.user_id IN (SELECT user_id FROM client_users WHERE client_id=$1 AND status=ANY($%d)))`, []int{ClientUserStatusAdmin, ClientUserStatusGuest})
+	}
+	return s, readAt, nil
+}
+
+func (s *historyScope) add(cond string, arg interface{}) {
+	s.args = append(s.args, arg)
+	s.where += fmt.Sprintf(cond, len(s.args))
+}
+
+// 成员在网页中分页查看群里的历史消息，不会通过聊天重新发送
+func GetMessageHistory(ctx context.Context, u *ClientUser, p *MessageHistoryParams) (*MessageHistory, error) {
+	if p.Limit <= 0 {
+		p.Limit = messageHistoryDefaultLimit
+	} else if p.Limit > messageHistoryMaxLimit {
+		p.Limit = messageHistoryMaxLimit
+	}
+	scope, readAt, err := getHistoryScope(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	h := &MessageHistory{Messages: make([]*HistoryMessage, 0)}
+	switch {
+	case p.Before != "":
+		c, err := getHistoryCursor(ctx, scope, p.Before)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.loadOlder(ctx, scope, c, p.Limit); err != nil {
+			return nil, err
+		}
+	case p.After != "":
+		c, err := getHistoryCursor(ctx, scope, p.After)
+		if err != nil {
+			return nil, err
+		}
+		if err := h.loadNewer(ctx, scope, c, p.Limit); err != nil {
+			return nil, err
+		}
+	case p.Around != "":
+		c, err := getHistoryCursor(ctx, scope, p.Around)
+		if err != nil {
+			return nil, err
+		}
+		half := p.Limit / 2
+		if half > 0 {
+			if err := h.loadOlder(ctx, scope, c, half); err != nil {
+				return nil, err
+			}
+		}
+		c.Inclusive = true
+		if err := h.loadNewer(ctx, scope, c, p.Limit-half); err != nil {
+			return nil, err
+		}
+	case p.Unread:
+		if err := h.loadNewer(ctx, scope, &historyCursor{CreatedAt: readAt}, p.Limit); err != nil {
+			return nil, err
+		}
+		if len(h.Messages) > 0 {
+			h.Before = h.Messages[0].MessageID
+		}
+	default:
+		if err := h.loadOlder(ctx, scope, nil, p.Limit); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (h *MessageHistory) loadOlder(ctx context.Context, scope *historyScope, c *historyCursor, limit int) error {
+	list, next, err := getHistoryMessages(ctx, scope, c, false, limit)
+	if err != nil {
+		return err
+	}
+	h.Before = next
+	older := make([]*HistoryMessage, 0, len(list)+len(h.Messages))
+	for i := len(list) - 1; i >= 0; i-- {
+		older = append(older, list[i])
+	}
+	h.Messages = append(older, h.Messages...)
+	return nil
+}
+
+func (h *MessageHistory) loadNewer(ctx context.Context, scope *historyScope, c *historyCursor, limit int) error {
+	list, next, err := getHistoryMessages(ctx, scope, c, true, limit)
+	if err != nil {
+		return err
+	}
+	h.After = next
+	h.Messages = append(h.Messages, list...)
+	return nil
+}
+
+type historyCursor struct {
+	CreatedAt time.Time
+	MessageID string
+	Inclusive bool
+}
+
+// 游标消息必须是成员可以看到的消息
+func getHistoryCursor(ctx context.Context, scope *historyScope, msgID string) (*historyCursor, error) {
+	c := historyCursor{MessageID: msgID}
+	args := append(append([]interface{}{}, scope.args...), msgID)
+	err := session.Database(ctx).QueryRow(ctx, fmt.Sprintf(`
+SELECT m.created_at FROM messages m WHERE %s AND m.message_id=$%d
+`, scope.where, len(args)), args...).Scan(&c.CreatedAt)
+	if durable.IsEmpty(err) {
+		return nil, session.BadDataError(ctx)
+	}
+	return &c, err
+}
+
+// 从游标开始向前或向后查询消息，结果按查询方向排列，多查一条用来判断是否还有更多消息
+func getHistoryMessages(ctx context.Context, scope *historyScope, c *historyCursor, asc bool, limit int) ([]*HistoryMessage, string, error) {
+	where := scope.where
+	args := append([]interface{}{}, scope.args...)
+	op, order := "<", "DESC"
+	if asc {
+		op, order = ">", "ASC"
+	}
+	if c != nil {
+		if c.Inclusive {
+			op += "="
+		}
+		args = append(args, c.CreatedAt, c.MessageID)
+		where += fmt.Sprintf(" AND (m.created_at,m.message_id)%s($%d,$%d)", op, len(args)-1, len(args))
+	}
+	args = append(args, limit+1)
+	list := make([]*HistoryMessage, 0, limit+1)
+	err := session.Database(ctx).ConnQuery(ctx, fmt.Sprintf(`
+SELECT m.message_id,m.user_id,COALESCE(u.full_name,''),COALESCE(u.avatar_url,''),m.category,m.data,m.quote_message_id,m.status,m.created_at
+FROM messages m
+LEFT JOIN users u ON u.user_id=m.user_id
+WHERE %s
+ORDER BY m.created_at %s,m.message_id %s
+LIMIT $%d
+`, where, order, order, len(args)), func(rows pgx.Rows) error {
+		for rows.Next() {
+			var m HistoryMessage
+			var status int
+			if err := rows.Scan(&m.MessageID, &m.UserID, &m.FullName, &m.AvatarURL, &m.Category, &m.Data, &m.QuoteMessageID, &status, &m.CreatedAt); err != nil {
+				return err
+			}
+			m.Pinned = status == MessageStatusPINMsg
+			list = append(list, &m)
+		}
+		return nil
+	}, args...)
+	if err != nil || len(list) == 0 {
+		return list, "", err
+	}
+	next := ""
+	if len(list) > limit {
+		list = list[:limit]
+		next = list[limit-1].MessageID
+	}
+	list, err = filterRecalledHistory(ctx, scope.args[0].(string), list)
+	return list, next, err
+}
+
+// 撤回的消息不返回，撤回消息一定在原消息之后
+func filterRecalledHistory(ctx context.Context, clientID string, list []*HistoryMessage) ([]*HistoryMessage, error) {
+	oldest := list[0].CreatedAt
+	for _, m := range list {
+		if m.CreatedAt.Before(oldest) {
+			oldest = m.CreatedAt
+		}
+	}
+	recalled := make(map[string]bool)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT data FROM messages WHERE client_id=$1 AND category=$2 AND created_at>=$3
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var data string
+			if err := rows.Scan(&data); err != nil {
+				return err
+			}
+			recalled[getRecallOriginMsgID(ctx, data)] = true
+		}
+		return nil
+	}, clientID, mixin.MessageCategoryMessageRecall, oldest)
+	if err != nil || len(recalled) == 0 {
+		return list, err
+	}
+	result := make([]*HistoryMessage, 0, len(list))
+	for _, m := range list {
+		if !recalled[m.MessageID] {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
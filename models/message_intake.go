@@ -0,0 +1,83 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+)
+
+// blaze 重连后 Mixin 会重新推送未 ack 的消息，处理完成的消息 24 小时内不再处理
+const messageIntakeSavedTime = 24 * time.Hour
+
+// 正在处理的消息的租约，服务崩溃后租约过期，重新推送的消息可以再次处理
+const messageIntakeLeaseTime = 5 * time.Minute
+
+const (
+	ReceivedMessageClaimed = iota // 获得租约，需要处理
+	ReceivedMessageDone           // 已经处理完成，只需要 ack
+	ReceivedMessageBusy           // 正在由其他连接处理，不处理也不 ack
+)
+
+func msgIntakeKey(clientID, msgID string) string {
+	return fmt.Sprintf("msg_intake:%s:%s", clientID, msgID)
+}
+
+func msgIntakeDoneKey(clientID, msgID string) string {
+	return fmt.Sprintf("msg_intake_done:%s:%s", clientID, msgID)
+}
+
+func ackPendingKey(clientID string) string {
+	return fmt.Sprintf("ack_pending:%s", clientID)
+}
+
+// 占用一条收到的消息，返回 ReceivedMessageClaimed 时才需要处理
+func ClaimReceivedMessage(ctx context.Context, clientID, msgID string) (int, error) {
+	done, err := session.Redis(ctx).Exists(ctx, msgIntakeDoneKey(clientID, msgID)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if done > 0 {
+		return ReceivedMessageDone, nil
+	}
+	// 完成后不删除租约，避免在检查完成标记和占用之间完成的消息被重复处理
+	ok, err := session.Redis(ctx).SetNX(ctx, msgIntakeKey(clientID, msgID), "1", messageIntakeLeaseTime).Result()
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return ReceivedMessageBusy, nil
+	}
+	return ReceivedMessageClaimed, nil
+}
+
+// 处理成功后写入完成标记，之后重新推送的消息只 ack
+func FinishReceivedMessage(ctx context.Context, clientID, msgID string) error {
+	return session.Redis(ctx).Set(ctx, msgIntakeDoneKey(clientID, msgID), "1", messageIntakeSavedTime).Err()
+}
+
+// 处理失败时释放租约，消息重新推送后可以再次处理
+func ReleaseReceivedMessage(ctx context.Context, clientID, msgID string) error {
+	return session.Redis(ctx).Del(ctx, msgIntakeKey(clientID, msgID)).Err()
+}
+
+// 待 ack 的消息保存在 redis 中，服务重启后继续 ack
+func AddPendingAck(ctx context.Context, clientID, msgID string) error {
+	return session.Redis(ctx).SAdd(ctx, ackPendingKey(clientID), msgID).Err()
+}
+
+func GetPendingAcks(ctx context.Context, clientID string, limit int64) ([]string, error) {
+	return session.Redis(ctx).SRandMemberN(ctx, ackPendingKey(clientID), limit).Result()
+}
+
+func RemovePendingAcks(ctx context.Context, clientID string, msgIDs []string) error {
+	if len(msgIDs) == 0 {
+		return nil
+	}
+	members := make([]interface{}, 0, len(msgIDs))
+	for _, id := range msgIDs {
+		members = append(members, id)
+	}
+	return session.Redis(ctx).SRem(ctx, ackPendingKey(clientID), members...).Err()
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/jackc/pgx/v4"
+)
+
+const message_mapping_DDL = `
+-- 每个用户收到的消息对应的原消息，redis 过期后用于引用和撤回
+-- 副本的 message_id 由社群、用户和原消息确定，只保存反查需要的字段
+CREATE TABLE IF NOT EXISTS message_mapping (
+  message_id          UUID NOT NULL PRIMARY KEY,
+  origin_message_id   UUID NOT NULL,
+  user_id             UUID NOT NULL
+);
+CREATE INDEX IF NOT EXISTS message_mapping_origin_idx ON message_mapping (origin_message_id);
+
+-- 每条原消息一行，用于按社群的保存时间清理
+CREATE TABLE IF NOT EXISTS message_mapping_origin (
+  origin_message_id   UUID NOT NULL PRIMARY KEY,
+  client_id           UUID NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS message_mapping_origin_created_idx ON message_mapping_origin (client_id, created_at);
+`
+
+const (
+	messageMappingBatchSize    = 5000
+	messageMappingQueueSize    = 1024
+	messageMappingFlushDelay   = time.Second
+	messageMappingQueueTimeout = time.Second
+)
+
+type messageMappingItem struct {
+	clientID        string
+	messageID       string
+	originMessageID string
+	userID          string
+}
+
+var (
+	messageMappingQueue = make(chan []messageMappingItem, messageMappingQueueSize)
+	messageMappingFlush = make(chan chan struct{})
+	messageMappingOnce  sync.Once
+)
+
+// 异步保存分发消息的对应关系，队列满时最多等待 1 秒，仍然满时直接写入数据库
+func createMessageMapping(ctx context.Context, clientID string, msgs []*DistributeMessage) {
+	messageMappingOnce.Do(func() { go taskWriteMessageMapping() })
+	items := make([]messageMappingItem, 0, len(msgs))
+	for _, m := range msgs {
+		items = append(items, messageMappingItem{clientID, m.MessageID, m.OriginMessageID, m.UserID})
+	}
+	select {
+	case messageMappingQueue <- items:
+		return
+	case <-time.After(messageMappingQueueTimeout):
+	}
+	session.Logger(ctx).Println("message_mapping queue is full, write directly", len(items))
+	writeMessageMappingBatches(_ctx, items)
+}
+
+// 服务退出前写入队列中剩余的对应关系
+func FlushMessageMapping() {
+	messageMappingOnce.Do(func() { go taskWriteMessageMapping() })
+	done := make(chan struct{})
+	messageMappingFlush <- done
+	<-done
+}
+
+// 合并队列中的对应关系，每批最多 messageMappingBatchSize 条，最多等待 1 秒
+func taskWriteMessageMapping() {
+	var pending []messageMappingItem
+	timer := time.NewTimer(messageMappingFlushDelay)
+	for {
+		var done chan struct{}
+		select {
+		case items := <-messageMappingQueue:
+			pending = append(pending, items...)
+			if len(pending) < messageMappingBatchSize {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(messageMappingFlushDelay)
+		case done = <-messageMappingFlush:
+			for drained := false; !drained; {
+				select {
+				case items := <-messageMappingQueue:
+					pending = append(pending, items...)
+				default:
+					drained = true
+				}
+			}
+		}
+		writeMessageMappingBatches(_ctx, pending)
+		pending = nil
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+func writeMessageMappingBatches(ctx context.Context, pending []messageMappingItem) {
+	for len(pending) > 0 {
+		end := messageMappingBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		if err := writeMessageMapping(ctx, pending[:end]); err != nil {
+			session.Logger(ctx).Println(err)
+		}
+		pending = pending[end:]
+	}
+}
+
+func writeMessageMapping(ctx context.Context, items []messageMappingItem) error {
+	originClients := make(map[string]string)
+	msgIDs := make([]string, 0, len(items))
+	originIDs := make([]string, 0, len(items))
+	userIDs := make([]string, 0, len(items))
+	for _, m := range items {
+		originClients[m.originMessageID] = m.clientID
+		msgIDs = append(msgIDs, m.messageID)
+		originIDs = append(originIDs, m.originMessageID)
+		userIDs = append(userIDs, m.userID)
+	}
+	origins := make([]string, 0, len(originClients))
+	clients := make([]string, 0, len(originClients))
+	for originID, clientID := range originClients {
+		origins = append(origins, originID)
+		clients = append(clients, clientID)
+	}
+	return session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `
+INSERT INTO message_mapping_origin(origin_message_id,client_id)
+SELECT o,c FROM unnest($1::UUID[],$2::UUID[]) AS t(o,c)
+ON CONFLICT (origin_message_id) DO NOTHING
+`, origins, clients); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `
+INSERT INTO message_mapping(message_id,origin_message_id,user_id)
+SELECT m,o,u FROM unnest($1::UUID[],$2::UUID[],$3::UUID[]) AS t(m,o,u)
+ON CONFLICT (message_id) DO NOTHING
+`, msgIDs, originIDs, userIDs)
+		return err
+	})
+}
+
+func getMessageMappingByMsgID(ctx context.Context, msgID string) (*DistributeMessage, error) {
+	m := DistributeMessage{MessageID: msgID, Status: DistributeMessageStatusFinished}
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT origin_message_id::VARCHAR,user_id::VARCHAR FROM message_mapping WHERE message_id=$1
+`, msgID).Scan(&m.OriginMessageID, &m.UserID)
+	return &m, err
+}
+
+// user_id -> message_id
+func getMessageMappingByOriginMsgID(ctx context.Context, clientID, originMsgID string) (map[string]string, error) {
+	res := make(map[string]string)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT m.user_id::VARCHAR,m.message_id::VARCHAR FROM message_mapping m
+JOIN message_mapping_origin o ON o.origin_message_id=m.origin_message_id
+WHERE o.client_id=$1 AND m.origin_message_id=$2
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var userID, msgID string
+			if err := rows.Scan(&userID, &msgID); err != nil {
+				return err
+			}
+			res[userID] = msgID
+		}
+		return nil
+	}, clientID, originMsgID)
+	return res, err
+}
+
+// 按社群的保存时间删除过期的对应关系
+func removeOvertimeMessageMapping(ctx context.Context, clientID string, days int) error {
+	_, err := session.Database(ctx).Exec(ctx, `
+WITH o AS (
+	DELETE FROM message_mapping_origin WHERE client_id=$1 AND created_at<NOW()-$2*INTERVAL '1 day'
+	RETURNING origin_message_id
+)
+DELETE FROM message_mapping WHERE origin_message_id IN (SELECT origin_message_id FROM o)
+`, clientID, days)
+	return err
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/go-redis/redis/v8"
+)
+
+// 测试模式下检查每个用户收到消息的顺序
+var distributeOrderCheck bool
+
+func EnableDistributeOrderCheck() {
+	distributeOrderCheck = true
+}
+
+// 记录用户最后收到的原消息时间，比它早的消息被标记为已发送即为乱序
+func checkDistributeOrder(ctx context.Context, clientID string, msg *DistributeMessage) {
+	if msg == nil || msg.RedeliverID != "" || msg.CreatedAt.IsZero() {
+		return
+	}
+	key := fmt.Sprintf("u_msg_last:%s:%s", clientID, msg.UserID)
+	current := msg.CreatedAt.UnixNano()
+	last, err := session.Redis(ctx).GetSet(ctx, key, current).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	session.Redis(ctx).PExpire(ctx, key, config.QuoteMsgSavedTime)
+	lastNano, _ := strconv.ParseInt(last, 10, 64)
+	if lastNano > current {
+		MetricOrderViolations.Inc(clientID)
+		session.Logger(ctx).Println("distribute order violation", clientID, msg.UserID, msg.OriginMessageID,
+			msg.CreatedAt.Format(time.RFC3339Nano), "before", time.Unix(0, lastNano).Format(time.RFC3339Nano))
+	}
+}
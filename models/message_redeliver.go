@@ -0,0 +1,335 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+)
+
+const message_redeliver_DDL = `
+-- 重新投递历史消息的任务
+CREATE TABLE IF NOT EXISTS message_redeliver (
+  redeliver_id        VARCHAR(36) NOT NULL PRIMARY KEY,
+  client_id           VARCHAR(36) NOT NULL,
+  message_id          VARCHAR(36) NOT NULL,
+  audience            VARCHAR(16) NOT NULL, -- all, status, missed, users
+  status              SMALLINT NOT NULL DEFAULT 0, -- audience 为 status 时的用户身份
+  user_ids            VARCHAR(36)[] NOT NULL DEFAULT '{}',
+  state               SMALLINT NOT NULL DEFAULT 1, -- 1 创建中 2 发送中 3 完成 4 失败
+  total               INTEGER NOT NULL DEFAULT 0,
+  sent                INTEGER NOT NULL DEFAULT 0,
+  error               VARCHAR NOT NULL DEFAULT '',
+  created_by          VARCHAR(36) NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS message_redeliver_client_idx ON message_redeliver (client_id, created_at);
+`
+
+type MessageRedeliver struct {
+	RedeliverID string    `json:"redeliver_id"`
+	ClientID    string    `json:"client_id"`
+	MessageID   string    `json:"message_id"`
+	Audience    string    `json:"audience"`
+	Status      int       `json:"status,omitempty"`
+	UserIDs     []string  `json:"user_ids,omitempty"`
+	State       int       `json:"state"`
+	Total       int       `json:"total"`
+	Sent        int       `json:"sent"`
+	Error       string    `json:"error,omitempty"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const (
+	RedeliverAudienceAll    = "all"
+	RedeliverAudienceStatus = "status"
+	RedeliverAudienceMissed = "missed"
+	RedeliverAudienceUsers  = "users"
+
+	RedeliverStatePending  = 1
+	RedeliverStateSending  = 2
+	RedeliverStateFinished = 3
+	RedeliverStateFailed   = 4
+)
+
+// 发送中超过这个时间还没有发完的任务标记为失败
+const redeliverTimeout = 24 * time.Hour
+
+// 可以重新投递的消息状态，还在分发中的消息不能重新投递
+var redeliverMessageStatus = []int{MessageStatusNormal, MessageStatusFinished, MessageStatusBroadcast, MessageStatusClientMsg, MessageStatusPINMsg}
+
+func redeliverSentKey(redeliverID string) string {
+	return fmt.Sprintf("redeliver_sent:%s", redeliverID)
+}
+
+func incrRedeliverSent(ctx context.Context, p redis.Pipeliner, redeliverID string) error {
+	key := redeliverSentKey(redeliverID)
+	if err := p.Incr(ctx, key).Err(); err != nil {
+		return err
+	}
+	return p.PExpire(ctx, key, redeliverTimeout*2).Err()
+}
+
+// 创建重新投递任务，消息在后台创建后走正常的分发流程
+func CreateMessageRedeliver(ctx context.Context, u *ClientUser, r *MessageRedeliver) (*MessageRedeliver, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	switch r.Audience {
+	case RedeliverAudienceAll, RedeliverAudienceMissed:
+	case RedeliverAudienceStatus:
+		if _, ok := statusLimitMap[r.Status]; !ok {
+			return nil, session.BadDataError(ctx)
+		}
+	case RedeliverAudienceUsers:
+		if len(r.UserIDs) == 0 {
+			return nil, session.BadDataError(ctx)
+		}
+	default:
+		return nil, session.BadDataError(ctx)
+	}
+	msg, status, err := getRedeliverMessage(ctx, u.ClientID, r.MessageID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, session.BadDataError(ctx)
+	} else if err != nil {
+		return nil, err
+	}
+	if msg.Category == mixin.MessageCategoryMessageRecall || msg.Category == "MESSAGE_PIN" ||
+		!containsInt(redeliverMessageStatus, status) {
+		return nil, session.BadDataError(ctx)
+	}
+	// 原消息还在发送，或者已经有任务在投递这条消息
+	balance, err := session.Redis(ctx).Get(ctx, "l_msg:"+r.MessageID).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if balance > 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	var running int
+	if err := session.Database(ctx).QueryRow(ctx, `
+SELECT COUNT(1) FROM message_redeliver WHERE client_id=$1 AND message_id=$2 AND state IN ($3,$4)
+`, u.ClientID, r.MessageID, RedeliverStatePending, RedeliverStateSending).Scan(&running); err != nil {
+		return nil, err
+	}
+	if running > 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	if r.UserIDs == nil {
+		r.UserIDs = []string{}
+	}
+	r.RedeliverID = tools.GetUUID()
+	r.ClientID = u.ClientID
+	r.State = RedeliverStatePending
+	r.CreatedBy = u.UserID
+	r.CreatedAt = time.Now()
+	r.UpdatedAt = r.CreatedAt
+	if _, err := session.Database(ctx).Exec(ctx, `
+INSERT INTO message_redeliver(redeliver_id,client_id,message_id,audience,status,user_ids,state,created_by,created_at,updated_at)
+VALUES($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+`, r.RedeliverID, r.ClientID, r.MessageID, r.Audience, r.Status, r.UserIDs, r.State, r.CreatedBy, r.CreatedAt, r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	go startMessageRedeliver(_ctx, r, msg)
+	return r, nil
+}
+
+func GetMessageRedeliver(ctx context.Context, u *ClientUser, redeliverID string) (*MessageRedeliver, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	list, err := getMessageRedelivers(ctx, `WHERE client_id=$1 AND redeliver_id=$2`, u.ClientID, redeliverID)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, session.BadDataError(ctx)
+	}
+	return list[0], nil
+}
+
+func GetMessageRedeliverList(ctx context.Context, u *ClientUser) ([]*MessageRedeliver, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getMessageRedelivers(ctx, `WHERE client_id=$1 ORDER BY created_at DESC LIMIT 50`, u.ClientID)
+}
+
+func getMessageRedelivers(ctx context.Context, where string, args ...interface{}) ([]*MessageRedeliver, error) {
+	list := make([]*MessageRedeliver, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT redeliver_id,client_id,message_id,audience,status,user_ids,state,total,sent,error,created_by,created_at,updated_at
+FROM message_redeliver `+where, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var r MessageRedeliver
+			if err := rows.Scan(&r.RedeliverID, &r.ClientID, &r.MessageID, &r.Audience, &r.Status, &r.UserIDs, &r.State, &r.Total, &r.Sent, &r.Error, &r.CreatedBy, &r.CreatedAt, &r.UpdatedAt); err != nil {
+				return err
+			}
+			list = append(list, &r)
+		}
+		return nil
+	}, args...)
+	return list, err
+}
+
+func getRedeliverMessage(ctx context.Context, clientID, msgID string) (*mixin.MessageView, int, error) {
+	var m mixin.MessageView
+	var status int
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT user_id,conversation_id,message_id,quote_message_id,category,data,status,created_at
+FROM messages WHERE client_id=$1 AND message_id=$2
+`, clientID, msgID).Scan(&m.UserID, &m.ConversationID, &m.MessageID, &m.QuoteMessageID, &m.Category, &m.Data, &status, &m.CreatedAt)
+	return &m, status, err
+}
+
+func startMessageRedeliver(ctx context.Context, r *MessageRedeliver, msg *mixin.MessageView) {
+	now := time.Now()
+	userList, err := getRedeliverUserList(ctx, r)
+	if err == nil {
+		// 原消息已经发送完毕，保证分发结束时能读取到消息状态
+		err = session.Redis(ctx).Set(ctx, "msg_status:"+r.MessageID, MessageRedisStatusFinished, config.QuoteMsgSavedTime).Err()
+	}
+	if err == nil {
+		err = createDistributeMsgByUserList(ctx, r.ClientID, msg, userList, ClientUserPriorityLow, MessageStatusFinished, r.RedeliverID)
+	}
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		updateMessageRedeliver(ctx, r.RedeliverID, RedeliverStateFailed, 0, 0, err.Error())
+		return
+	}
+	total := 0
+	for _, userID := range userList {
+		if userID != msg.UserID && !checkIsBlockUser(ctx, r.ClientID, userID) {
+			total++
+		}
+	}
+	state := RedeliverStateSending
+	if total == 0 {
+		state = RedeliverStateFinished
+	}
+	updateMessageRedeliver(ctx, r.RedeliverID, state, total, 0, "")
+	tools.PrintTimeDuration(fmt.Sprintf("%s重新投递 %s %d 人...", r.ClientID, r.MessageID, total), now)
+}
+
+func getRedeliverUserList(ctx context.Context, r *MessageRedeliver) ([]string, error) {
+	query := `SELECT user_id FROM client_users WHERE client_id=$1 AND status NOT IN ($2,$3)`
+	args := []interface{}{r.ClientID, ClientUserStatusExit, ClientUserStatusBlock}
+	switch r.Audience {
+	case RedeliverAudienceStatus:
+		query += ` AND status=$4`
+		args = append(args, r.Status)
+	case RedeliverAudienceUsers:
+		query += ` AND user_id=ANY($4)`
+		args = append(args, r.UserIDs)
+	}
+	users := make([]string, 0)
+	if err := session.Database(ctx).ConnQuery(ctx, query, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var userID string
+			if err := rows.Scan(&userID); err != nil {
+				return err
+			}
+			users = append(users, userID)
+		}
+		return nil
+	}, args...); err != nil {
+		return nil, err
+	}
+	if r.Audience != RedeliverAudienceMissed {
+		return users, nil
+	}
+	received, err := getReceivedUserSet(ctx, r.ClientID, r.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	missed := make([]string, 0, len(users))
+	for _, userID := range users {
+		if !received[userID] {
+			missed = append(missed, userID)
+		}
+	}
+	return missed, nil
+}
+
+// 已经给哪些用户创建过这条消息，redis 索引过期后从 message_mapping 中查找
+func getReceivedUserSet(ctx context.Context, clientID, originMsgID string) (map[string]bool, error) {
+	received := make(map[string]bool)
+	resList, err := session.Redis(ctx).SMembers(ctx, "origin_msg_idx:"+originMsgID).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range resList {
+		msg, err := getMsgOriginFromRedisResult(res)
+		if err != nil {
+			continue
+		}
+		received[msg.UserID] = true
+	}
+	mapping, err := getMessageMappingByOriginMsgID(ctx, clientID, originMsgID)
+	if err != nil {
+		return nil, err
+	}
+	for userID := range mapping {
+		received[userID] = true
+	}
+	return received, nil
+}
+
+func updateMessageRedeliver(ctx context.Context, redeliverID string, state, total, sent int, errMsg string) {
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE message_redeliver SET state=$2,total=GREATEST(total,$3),sent=$4,error=$5,updated_at=NOW() WHERE redeliver_id=$1
+`, redeliverID, state, total, sent, errMsg); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
+
+// 每 10 秒同步发送中任务的进度
+func taskUpdateRedeliverProgress() {
+	for {
+		time.Sleep(10 * time.Second)
+		list, err := getMessageRedelivers(_ctx, `WHERE state=$1`, RedeliverStateSending)
+		if err != nil {
+			session.Logger(_ctx).Println(err)
+			continue
+		}
+		for _, r := range list {
+			sent, err := session.Redis(_ctx).Get(_ctx, redeliverSentKey(r.RedeliverID)).Int()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				session.Logger(_ctx).Println(err)
+				continue
+			}
+			state := RedeliverStateSending
+			errMsg := ""
+			if sent >= r.Total {
+				state = RedeliverStateFinished
+			} else if time.Since(r.CreatedAt) > redeliverTimeout {
+				state = RedeliverStateFailed
+				errMsg = "timeout"
+			}
+			updateMessageRedeliver(_ctx, r.RedeliverID, state, r.Total, sent, errMsg)
+			if state != RedeliverStateSending {
+				finishMessageRedeliver(_ctx, r)
+			}
+		}
+	}
+}
+
+func finishMessageRedeliver(ctx context.Context, r *MessageRedeliver) {
+	if err := session.Redis(ctx).Del(ctx, redeliverSentKey(r.RedeliverID)).Err(); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	balance, err := session.Redis(ctx).Get(ctx, "l_msg:"+r.MessageID).Int()
+	if err == nil && balance <= 0 {
+		session.Redis(ctx).Del(ctx, "l_msg:"+r.MessageID)
+	}
+}
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+)
+
+const message_search_DDL = `
+-- 消息全文搜索，只保存文本和文章消息
+CREATE TABLE IF NOT EXISTS message_search (
+  client_id           VARCHAR(36) NOT NULL,
+  message_id          VARCHAR(36) NOT NULL,
+  user_id             VARCHAR(36) NOT NULL,
+  category            VARCHAR NOT NULL,
+  content             TEXT NOT NULL,
+  tsv                 TSVECTOR NOT NULL,
+  created_at          TIMESTAMP WITH TIME ZONE NOT NULL,
+  PRIMARY KEY(client_id, message_id)
+);
+CREATE INDEX IF NOT EXISTS message_search_tsv_idx ON message_search USING GIN (tsv);
+CREATE INDEX IF NOT EXISTS message_search_created_idx ON message_search (client_id, created_at);
+`
+
+// simple 等分词配置不能切分中日韩文字，这类搜索用 pg_trgm 索引加速 ILIKE
+// 单独执行，没有权限创建扩展时不影响其他表
+const message_search_trgm_DDL = `
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS message_search_content_trgm_idx ON message_search USING GIN (content gin_trgm_ops);
+`
+
+type MessageSearchResult struct {
+	MessageID string    `json:"message_id"`
+	UserID    string    `json:"user_id"`
+	FullName  string    `json:"full_name"`
+	AvatarURL string    `json:"avatar_url"`
+	Category  string    `json:"category"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 管理员搜索的过滤条件，为空的条件不过滤
+type MessageSearchParams struct {
+	Query    string
+	UserID   string
+	Category string
+	Start    time.Time
+	End      time.Time
+	Page     int
+}
+
+const messageSearchPageSize = 20
+
+var searchableCategories = map[string]bool{
+	mixin.MessageCategoryPlainText: true,
+	mixin.MessageCategoryPlainPost: true,
+	"ENCRYPTED_TEXT":               true,
+	"ENCRYPTED_POST":               true,
+}
+
+// 只索引群里分发的消息
+var searchableStatus = map[int]bool{
+	MessageStatusPending:   true,
+	MessageStatusBroadcast: true,
+}
+
+func getMessageSearchContent(category, data string) string {
+	if !searchableCategories[category] {
+		return ""
+	}
+	content := strings.ToValidUTF8(string(tools.Base64Decode(data)), "")
+	return strings.TrimSpace(strings.ReplaceAll(content, "\x00", ""))
+}
+
+// 保存消息的搜索索引，失败不影响消息分发
+func createMessageSearch(ctx context.Context, clientID string, msg *mixin.MessageView) {
+	content := getMessageSearchContent(msg.Category, msg.Data)
+	if content == "" {
+		return
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+INSERT INTO message_search(client_id,message_id,user_id,category,content,tsv,created_at)
+VALUES($1,$2,$3,$4,$5,to_tsvector($6::regconfig,$5),$7)
+ON CONFLICT (client_id,message_id) DO NOTHING
+`, clientID, msg.MessageID, msg.UserID, msg.Category, content, config.GetSearchLanguage(clientID), msg.CreatedAt); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
+
+// 撤回的消息不再能被搜索到
+func deleteMessageSearch(ctx context.Context, clientID, msgID string) {
+	if _, err := session.Database(ctx).Exec(ctx, `
+DELETE FROM message_search WHERE client_id=$1 AND message_id=$2
+`, clientID, msgID); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
+
+// 成员只能搜索入群之后收到过的消息，只接收管理员消息的成员只能搜到管理员、嘉宾和自己的消息
+func SearchMessages(ctx context.Context, u *ClientUser, query string, page int) ([]*MessageSearchResult, error) {
+	query = strings.TrimSpace(query)
+	if query == "" || len(query) > 128 {
+		return nil, session.BadDataError(ctx)
+	}
+	var joinedAt time.Time
+	var status, mode int
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT created_at,status,delivery_mode FROM client_users WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID).Scan(&joinedAt, &status, &mode)
+	if durable.IsEmpty(err) || status == ClientUserStatusExit {
+		return nil, session.ForbiddenError(ctx)
+	} else if err != nil {
+		return nil, err
+	}
+	where := " AND s.created_at>=$2"
+	args := []interface{}{u.ClientID, joinedAt}
+	if mode == ClientUserDeliveryAdminOnly {
+		where += ` AND (s.user_id=$1 OR s.user_id=$3 OR s.user_id IN (
+SELECT user_id FROM client_users WHERE client_id=$1 AND status=ANY($4)
+))`
+		args = append(args, u.UserID, []int{ClientUserStatusAdmin, ClientUserStatusGuest})
+	}
+	return searchMessages(ctx, query, where, args, page)
+}
+
+func SearchMessagesByAdmin(ctx context.Context, u *ClientUser, p *MessageSearchParams) ([]*MessageSearchResult, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	p.Query = strings.TrimSpace(p.Query)
+	if p.Query == "" || len(p.Query) > 128 {
+		return nil, session.BadDataError(ctx)
+	}
+	where := ""
+	args := []interface{}{u.ClientID}
+	if p.UserID != "" {
+		args = append(args, p.UserID)
+		where += fmt.Sprintf(" AND s.user_id=$%d", len(args))
+	}
+	if p.Category != "" {
+		args = append(args, p.Category)
+		where += fmt.Sprintf(" AND s.category=$%d", len(args))
+	}
+	if !p.Start.IsZero() {
+		args = append(args, p.Start)
+		where += fmt.Sprintf(" AND s.created_at>=$%d", len(args))
+	}
+	if !p.End.IsZero() {
+		args = append(args, p.End)
+		where += fmt.Sprintf(" AND s.created_at<$%d", len(args))
+	}
+	return searchMessages(ctx, p.Query, where, args, p.Page)
+}
+
+// 包含中日韩文字时按词逐个 ILIKE 匹配，其他按分词配置全文搜索
+func containsCJK(text string) bool {
+	for _, r := range text {
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			return true
+		}
+	}
+	return false
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// args 的第一个参数固定为 client_id
+func searchMessages(ctx context.Context, text, where string, args []interface{}, page int) ([]*MessageSearchResult, error) {
+	if page < 1 {
+		page = 1
+	}
+	clientID := args[0].(string)
+	match := ""
+	if containsCJK(text) {
+		for _, term := range strings.Fields(text) {
+			args = append(args, "%"+likeEscaper.Replace(term)+"%")
+			match += fmt.Sprintf(" AND s.content ILIKE $%d", len(args))
+		}
+	} else {
+		args = append(args, config.GetSearchLanguage(clientID), text)
+		match = fmt.Sprintf(" AND s.tsv @@ websearch_to_tsquery($%d::regconfig,$%d)", len(args)-1, len(args))
+	}
+	args = append(args, (page-1)*messageSearchPageSize)
+	query := fmt.Sprintf(`
+SELECT s.message_id,s.user_id,COALESCE(u.full_name,''),COALESCE(u.avatar_url,''),s.category,s.content,s.created_at
+FROM message_search s
+LEFT JOIN users u ON u.user_id=s.user_id
+WHERE s.client_id=$1%s%s
+ORDER BY s.created_at DESC
+OFFSET $%d LIMIT %d
+`, match, where, len(args), messageSearchPageSize)
+	list := make([]*MessageSearchResult, 0)
+	err := session.Database(ctx).ConnQuery(ctx, query, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var m MessageSearchResult
+			if err := rows.Scan(&m.MessageID, &m.UserID, &m.FullName, &m.AvatarURL, &m.Category, &m.Content, &m.CreatedAt); err != nil {
+				return err
+			}
+			list = append(list, &m)
+		}
+		return nil
+	}, args...)
+	return list, err
+}
+
+const messageSearchBackfillSize = 500
+
+// 为搜索功能上线前的历史消息建立索引，进度保存在 redis 中，重启后继续
+func taskBackfillMessageSearch() {
+	for _, clientID := range config.Config.ClientList {
+		for {
+			count, err := backfillMessageSearch(_ctx, clientID)
+			if err != nil {
+				session.Logger(_ctx).Println(err)
+				time.Sleep(time.Minute)
+				continue
+			}
+			if count < messageSearchBackfillSize {
+				break
+			}
+		}
+	}
+}
+
+func backfillMessageSearch(ctx context.Context, clientID string) (int, error) {
+	key := fmt.Sprintf("msg_search_backfill:%s", clientID)
+	cursor, err := session.Redis(ctx).Get(ctx, key).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	categories := []string{mixin.MessageCategoryMessageRecall}
+	for c := range searchableCategories {
+		categories = append(categories, c)
+	}
+	msgs := make([]*mixin.MessageView, 0, messageSearchBackfillSize)
+	err = session.Database(ctx).ConnQuery(ctx, `
+SELECT user_id,message_id,category,data,created_at FROM messages
+WHERE client_id=$1 AND created_at>$2 AND category=ANY($3) AND status=ANY($4)
+ORDER BY created_at ASC LIMIT $5
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var m mixin.MessageView
+			if err := rows.Scan(&m.UserID, &m.MessageID, &m.Category, &m.Data, &m.CreatedAt); err != nil {
+				return err
+			}
+			msgs = append(msgs, &m)
+		}
+		return nil
+	}, clientID, time.Unix(0, cursor), categories, []int{MessageStatusPending, MessageStatusPrivilege, MessageStatusFinished, MessageStatusBroadcast, MessageStatusPINMsg}, messageSearchBackfillSize)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if m.Category == mixin.MessageCategoryMessageRecall {
+			deleteMessageSearch(ctx, clientID, getRecallOriginMsgID(ctx, m.Data))
+		} else {
+			createMessageSearch(ctx, clientID, m)
+		}
+	}
+	if len(msgs) > 0 {
+		cursor = msgs[len(msgs)-1].CreatedAt.UnixNano()
+		if err := session.Redis(ctx).Set(ctx, key, strconv.FormatInt(cursor, 10), 0).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
@@ -6,19 +6,21 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/MixinNetwork/supergroup/tools"
 	"github.com/fox-one/mixin-sdk-go"
 	"github.com/go-redis/redis/v8"
 )
 
-func SendBatchMessages(ctx context.Context, client *mixin.Client, msgList []*mixin.MessageRequest) error {
+func SendBatchMessages(ctx context.Context, client durable.Transport, msgList []*mixin.MessageRequest) error {
 	sendTimes := len(msgList)/80 + 1
 	var waitSync sync.WaitGroup
 	for i := 0; i < sendTimes; i++ {
@@ -36,7 +38,7 @@ func SendBatchMessages(ctx context.Context, client *mixin.Client, msgList []*mix
 	return nil
 }
 
-func sendMessages(ctx context.Context, client *mixin.Client, msgList []*mixin.MessageRequest, waitSync *sync.WaitGroup, end int) {
+func sendMessages(ctx context.Context, client durable.Transport, msgList []*mixin.MessageRequest, waitSync *sync.WaitGroup, end int) {
 	if len(msgList) == 0 {
 		waitSync.Done()
 		return
@@ -62,18 +64,18 @@ func sendMessages(ctx context.Context, client *mixin.Client, msgList []*mixin.Me
 	}
 }
 
-func SendMessage(ctx context.Context, client *mixin.Client, msg *mixin.MessageRequest, withCreate bool) error {
+func SendMessage(ctx context.Context, client durable.Transport, msg *mixin.MessageRequest, withCreate bool) error {
 	err := client.SendMessage(ctx, msg)
 	if err != nil {
 		if strings.Contains(err.Error(), "403") {
 			if withCreate {
 				d, _ := json.Marshal(msg)
-				session.Logger(ctx).Println(err, string(d), client.ClientID)
+				session.Logger(ctx).Println(err, string(d), client.ClientID())
 				return nil
 			}
 			if _, err := client.CreateConversation(ctx, &mixin.CreateConversationInput{
 				Category:       mixin.ConversationCategoryContact,
-				ConversationID: mixin.UniqueConversationID(client.ClientID, msg.RecipientID),
+				ConversationID: mixin.UniqueConversationID(client.ClientID(), msg.RecipientID),
 				Participants:   []*mixin.Participant{{UserID: msg.RecipientID}},
 			}); err != nil {
 				return err
@@ -93,7 +95,7 @@ func SendMessage(ctx context.Context, client *mixin.Client, msg *mixin.MessageRe
 	return nil
 }
 
-func SendMessages(ctx context.Context, client *mixin.Client, msgs []*mixin.MessageRequest) error {
+func SendMessages(ctx context.Context, client durable.Transport, msgs []*mixin.MessageRequest) error {
 	err := client.SendMessages(ctx, msgs)
 	if err != nil {
 		if strings.Contains(err.Error(), "403") {
@@ -112,6 +114,30 @@ func SendMessages(ctx context.Context, client *mixin.Client, msgs []*mixin.Messa
 	return nil
 }
 
+// 分发消息使用，被限流时直接返回错误，由分发服务降速后重试
+func SendDistributeMessages(ctx context.Context, client durable.Transport, msgs []*mixin.MessageRequest) error {
+	err := client.SendMessages(ctx, msgs)
+	if err == nil || strings.Contains(err.Error(), "403") {
+		return nil
+	}
+	if IsRateLimitError(err) {
+		return err
+	}
+	return SendMessages(ctx, client, msgs)
+}
+
+// 是否是 Mixin API 的限流响应
+func IsRateLimitError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mixin.IsErrorCodes(err, http.StatusTooManyRequests) {
+		return true
+	}
+	return strings.Contains(err.Error(), "429") ||
+		strings.Contains(err.Error(), "Too Many Requests")
+}
+
 type EncryptedMessageResp struct {
 	MessageID   string `json:"message_id"`
 	RecipientID string `json:"recipient_id"`
@@ -122,19 +148,19 @@ type EncryptedMessageResp struct {
 	} `json:"sessions"`
 }
 
-func SendEncryptedMessage(ctx context.Context, pk string, client *mixin.Client, msgs []*mixin.MessageRequest) ([]*EncryptedMessageResp, error) {
-	var resp []*EncryptedMessageResp
+// 生成 /encrypted_messages 的请求体，和发送分开以便单独统计接口耗时
+func BuildEncryptedMessages(ctx context.Context, pk string, client durable.Transport, msgs []*mixin.MessageRequest) ([]map[string]interface{}, error) {
 	var userIDs []string
 	for _, m := range msgs {
 		userIDs = append(userIDs, m.RecipientID)
 	}
-	sessionSet, err := ReadSessionSetByUsers(ctx, client.ClientID, userIDs)
+	sessionSet, err := ReadSessionSetByUsers(ctx, client.ClientID(), userIDs)
 	if err != nil {
 		return nil, err
 	}
 	var body []map[string]interface{}
 	for _, message := range msgs {
-		if message.RepresentativeID == client.ClientID {
+		if message.RepresentativeID == client.ClientID() {
 			message.RepresentativeID = ""
 		}
 		if message.Category == mixin.MessageCategoryMessageRecall {
@@ -170,7 +196,12 @@ func SendEncryptedMessage(ctx context.Context, pk string, client *mixin.Client,
 		}
 		body = append(body, m)
 	}
-	if err := client.Post(ctx, "/encrypted_messages", body, &resp); err != nil {
+	return body, nil
+}
+
+func SendEncryptedMessage(ctx context.Context, client durable.Transport, body []map[string]interface{}) ([]*EncryptedMessageResp, error) {
+	var resp []*EncryptedMessageResp
+	if err := client.SendEncryptedMessages(ctx, body, &resp); err != nil {
 		return nil, err
 	}
 	return resp, nil
@@ -194,24 +225,28 @@ func createDistributeMsgToRedis(ctx context.Context, msgs []*DistributeMessage)
 	if len(msgs) == 0 {
 		return nil
 	}
+	pending := 0
 	_, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
 		for _, msg := range msgs {
 			dMsgKey := fmt.Sprintf("d_msg:%s:%s", msg.ClientID, msg.MessageID)
-			if err := p.HSet(ctx, dMsgKey,
-				map[string]interface{}{
-					"user_id":           msg.UserID,
-					"origin_message_id": msg.OriginMessageID,
-					"message_id":        msg.MessageID,
-					"quote_message_id":  msg.QuoteMessageID,
-					"data":              msg.Data,
-					"representative_id": msg.RepresentativeID,
-					"level":             msg.Level,
-				},
-			).Err(); err != nil {
+			fields := map[string]interface{}{
+				"user_id":           msg.UserID,
+				"origin_message_id": msg.OriginMessageID,
+				"message_id":        msg.MessageID,
+				"quote_message_id":  msg.QuoteMessageID,
+				"data":              msg.Data,
+				"representative_id": msg.RepresentativeID,
+				"level":             msg.Level,
+			}
+			if msg.RedeliverID != "" {
+				fields["redeliver_id"] = msg.RedeliverID
+			}
+			if err := p.HSet(ctx, dMsgKey, fields).Err(); err != nil {
 				session.Logger(ctx).Println(err)
 				return err
 			}
 			if msg.Status == DistributeMessageStatusPending {
+				pending++
 				score := msg.CreatedAt.UnixNano()
 				if msg.Level == ClientUserPriorityHigh {
 					score = score / 2
@@ -229,6 +264,16 @@ func createDistributeMsgToRedis(ctx context.Context, msgs []*DistributeMessage)
 					session.Logger(ctx).Println(err)
 					return err
 				}
+				uMsgKey := userPendingMsgKey(msg.ClientID, msg.UserID)
+				if err := p.ZAdd(ctx, uMsgKey, &redis.Z{
+					Score:  float64(msg.CreatedAt.UnixNano()),
+					Member: msg.MessageID,
+				}).Err(); err != nil {
+					return err
+				}
+				if err := p.PExpire(ctx, uMsgKey, config.QuoteMsgSavedTime).Err(); err != nil {
+					return err
+				}
 			} else {
 				if err := p.PExpire(ctx, dMsgKey, config.QuoteMsgSavedTime).Err(); err != nil {
 					return err
@@ -240,6 +285,12 @@ func createDistributeMsgToRedis(ctx context.Context, msgs []*DistributeMessage)
 		}
 		return nil
 	})
+	if pending > 0 {
+		MetricMessagesCreated.Add(float64(pending), msgs[0].ClientID)
+	}
+	if err == nil {
+		createMessageMapping(ctx, msgs[0].ClientID, msgs)
+	}
 	if msgs[0].Status == DistributeMessageStatusPending {
 		if err := session.Redis(ctx).QPublish(ctx, "distribute", msgs[0].ClientID); err != nil {
 			return err
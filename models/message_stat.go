@@ -0,0 +1,197 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+	"github.com/shopspring/decimal"
+)
+
+const message_stat_DDL = `
+-- 消息的分发、送达、阅读统计
+CREATE TABLE IF NOT EXISTS message_stat (
+  client_id           VARCHAR(36) NOT NULL,
+  message_id          VARCHAR(36) NOT NULL,
+  distributed_count   INTEGER NOT NULL DEFAULT 0,
+  delivered_count     INTEGER NOT NULL DEFAULT 0,
+  read_count          INTEGER NOT NULL DEFAULT 0,
+  updated_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY(client_id, message_id)
+);
+`
+
+type MessageStat struct {
+	ClientID         string    `json:"client_id,omitempty"`
+	MessageID        string    `json:"message_id,omitempty"`
+	DistributedCount int64     `json:"distributed_count"`
+	DeliveredCount   int64     `json:"delivered_count"`
+	ReadCount        int64     `json:"read_count"`
+	UpdatedAt        time.Time `json:"updated_at,omitempty"`
+
+	PendingCount int64           `json:"pending_count"`
+	DeliveryRate decimal.Decimal `json:"delivery_rate"`
+	ReadRate     decimal.Decimal `json:"read_rate"`
+	// 送达和已读人数由 HyperLogLog 统计，是近似值，误差约 1%
+	Approximate bool `json:"approximate"`
+}
+
+const messageStatSavedTime = 7 * 24 * time.Hour
+
+// 已分发的条数用计数器，送达和已读按用户去重，用 HyperLogLog 统计
+func msgStatDistributedKey(clientID, originMsgID string) string {
+	return fmt.Sprintf("msg_stat_distributed:%s:%s", clientID, originMsgID)
+}
+
+func msgStatDeliveredKey(clientID, originMsgID string) string {
+	return fmt.Sprintf("msg_stat_delivered:%s:%s", clientID, originMsgID)
+}
+
+func msgStatReadKey(clientID, originMsgID string) string {
+	return fmt.Sprintf("msg_stat_read:%s:%s", clientID, originMsgID)
+}
+
+// 记录已分发的消息数
+func incrMessageStatDistributed(ctx context.Context, p redis.Pipeliner, clientID, originMsgID string, count int) error {
+	key := msgStatDistributedKey(clientID, originMsgID)
+	if err := p.IncrBy(ctx, key, int64(count)).Err(); err != nil {
+		return err
+	}
+	return p.PExpire(ctx, key, messageStatSavedTime).Err()
+}
+
+// 记录送达和已读的用户，已读的消息一定已经送达
+func recordMessageStatAck(ctx context.Context, clientID, originMsgID, userID, status string) error {
+	_, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		keys := []string{msgStatDeliveredKey(clientID, originMsgID)}
+		if status == "READ" {
+			keys = append(keys, msgStatReadKey(clientID, originMsgID))
+		}
+		for _, key := range keys {
+			if err := p.PFAdd(ctx, key, userID).Err(); err != nil {
+				return err
+			}
+			if err := p.PExpire(ctx, key, messageStatSavedTime).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func GetMessageStat(ctx context.Context, u *ClientUser, msgID string) (*MessageStat, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return nil, session.ForbiddenError(ctx)
+	}
+	return getMessageStat(ctx, u.ClientID, msgID)
+}
+
+func getMessageStat(ctx context.Context, clientID, msgID string) (*MessageStat, error) {
+	stat, err := getMessageStatFromRedis(ctx, clientID, msgID)
+	if err != nil {
+		return nil, err
+	}
+	if stat == nil {
+		// redis 中的统计已过期，使用落库的数据
+		stat, err = getMessageStatFromPsql(ctx, clientID, msgID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pending, err := session.Redis(ctx).Get(ctx, "l_msg:"+msgID).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	if pending > 0 {
+		stat.PendingCount = pending
+	}
+	stat.Approximate = true
+	if stat.DistributedCount > 0 {
+		total := decimal.NewFromInt(stat.DistributedCount)
+		stat.DeliveryRate = decimal.NewFromInt(stat.DeliveredCount).Div(total).Round(4)
+		stat.ReadRate = decimal.NewFromInt(stat.ReadCount).Div(total).Round(4)
+	}
+	return stat, nil
+}
+
+func getMessageStatFromRedis(ctx context.Context, clientID, msgID string) (*MessageStat, error) {
+	var distributed *redis.StringCmd
+	var delivered, read *redis.IntCmd
+	if _, err := session.Redis(ctx).Pipelined(ctx, func(p redis.Pipeliner) error {
+		distributed = p.Get(ctx, msgStatDistributedKey(clientID, msgID))
+		delivered = p.PFCount(ctx, msgStatDeliveredKey(clientID, msgID))
+		read = p.PFCount(ctx, msgStatReadKey(clientID, msgID))
+		return nil
+	}); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	stat := MessageStat{ClientID: clientID, MessageID: msgID, UpdatedAt: time.Now()}
+	stat.DistributedCount, _ = distributed.Int64()
+	stat.DeliveredCount = delivered.Val()
+	stat.ReadCount = read.Val()
+	if stat.DistributedCount == 0 && stat.DeliveredCount == 0 {
+		return nil, nil
+	}
+	return &stat, nil
+}
+
+func getMessageStatFromPsql(ctx context.Context, clientID, msgID string) (*MessageStat, error) {
+	stat := MessageStat{ClientID: clientID, MessageID: msgID}
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT distributed_count, delivered_count, read_count, updated_at
+FROM message_stat WHERE client_id=$1 AND message_id=$2
+`, clientID, msgID).Scan(&stat.DistributedCount, &stat.DeliveredCount, &stat.ReadCount, &stat.UpdatedAt)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	return &stat, nil
+}
+
+func taskUpdateMessageStatToPsql() {
+	for {
+		if err := UpdateMessageStatFromRedis(_ctx); err != nil {
+			session.Logger(_ctx).Println(err)
+		}
+		time.Sleep(10 * time.Minute)
+	}
+}
+
+// 把 redis 中的统计数据落库
+func UpdateMessageStatFromRedis(ctx context.Context) error {
+	msgs := make(map[string]string)
+	for _, pattern := range []string{"msg_stat_distributed:*", "msg_stat_delivered:*"} {
+		keys, err := session.Redis(ctx).Keys(ctx, pattern).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			tmp := strings.Split(key, ":")
+			if len(tmp) != 3 {
+				continue
+			}
+			msgs[tmp[2]] = tmp[1]
+		}
+	}
+	query := durable.InsertQueryOrUpdate("message_stat", "client_id,message_id", "distributed_count,delivered_count,read_count,updated_at")
+	for msgID, clientID := range msgs {
+		stat, err := getMessageStatFromRedis(ctx, clientID, msgID)
+		if err != nil {
+			session.Logger(ctx).Println(err)
+			continue
+		}
+		if stat == nil {
+			continue
+		}
+		if _, err := session.Database(ctx).Exec(ctx, query, stat.ClientID, stat.MessageID, stat.DistributedCount, stat.DeliveredCount, stat.ReadCount, stat.UpdatedAt); err != nil {
+			session.Logger(ctx).Println(err)
+		}
+	}
+	return nil
+}
@@ -20,7 +20,7 @@ func SendWelcomeAndLatestMsg(clientID, userID string) {
 	if err != nil {
 		return
 	}
-	if err := SendTextMsg(_ctx, clientID, userID, c.Welcome); err != nil {
+	if err := SendTextMsg(_ctx, clientID, userID, renderTemplateText(_ctx, clientID, userID, c.Welcome)); err != nil {
 		session.Logger(_ctx).Println(err)
 	}
 	btns := mixin.AppButtonGroupMessage{
@@ -40,20 +40,26 @@ func SendWelcomeAndLatestMsg(clientID, userID string) {
 	if conversationStatus == "" ||
 		conversationStatus == ClientConversationStatusNormal ||
 		conversationStatus == ClientConversationStatusMute {
-		go sendLatestMsgAndPINMsg(client, userID, 20)
+		go sendLatestMsgAndPINMsg(client, userID)
 	} else if conversationStatus == ClientConversationStatusAudioLive {
 		go sendLatestLiveMsg(client, userID)
 	}
 }
 
-func sendLatestMsgAndPINMsg(client *MixinClient, userID string, msgCount int) {
+// 按社群的设置给新成员补发消息，新成员的未读消息从一天前开始
+func sendLatestMsgAndPINMsg(client *MixinClient, userID string) {
 	c, err := GetClientUserByClientIDAndUserID(_ctx, client.ClientID, userID)
 	if err != nil {
 		session.Logger(_ctx).Println(err)
 		return
 	}
+	p, err := getClientCatchupPolicy(_ctx, client.ClientID)
+	if err != nil {
+		session.Logger(_ctx).Println(err)
+		return
+	}
 	_ = UpdateClientUserPriority(_ctx, client.ClientID, userID, ClientUserPriorityPending)
-	sendPendingMsgByCount(_ctx, client.ClientID, userID, msgCount)
+	catchUpMember(_ctx, client.ClientID, userID, p, p.JoinPolicy, time.Now().Add(-24*time.Hour))
 	_ = UpdateClientUserPriority(_ctx, client.ClientID, userID, c.Priority)
 	SendAssetsNotPassMsg(client.ClientID, userID, "", true)
 }
@@ -207,7 +213,7 @@ func distributeMsg(ctx context.Context, msgList []*Message, clientID, userID str
 			session.Logger(ctx).Println(err)
 			continue
 		}
-		_ = SendMessage(ctx, client.Client, m, true)
+		_ = SendMessage(ctx, client.Transport, m, true)
 	}
 	return msgList[0].CreatedAt, nil
 }
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/jackc/pgx/v4"
+)
+
+// 公告和欢迎语中可以使用的变量，按接收人替换，未知的变量原样保留
+var templateVarNames = []string{"{name}", "{level}", "{expired_at}", "{invite_code}", "{group}"}
+
+var templateCategories = map[string]bool{
+	mixin.MessageCategoryPlainText: true,
+	mixin.MessageCategoryPlainPost: true,
+}
+
+func hasTemplateVars(text string) bool {
+	for _, name := range templateVarNames {
+		if strings.Contains(text, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 变量的值只做一次替换，值中的 {xxx} 不会再被展开
+func renderTemplate(text string, vars map[string]string) string {
+	pairs := make([]string, 0, len(templateVarNames)*2)
+	for _, name := range templateVarNames {
+		pairs = append(pairs, name, vars[name])
+	}
+	return strings.NewReplacer(pairs...).Replace(text)
+}
+
+// 按接收人替换 base64 编码的消息内容，不需要替换时返回 nil
+func renderTemplateDataMap(ctx context.Context, clientID, category, data string, userIDs []string) map[string]string {
+	if !templateCategories[category] {
+		return nil
+	}
+	text := string(tools.Base64Decode(data))
+	if !hasTemplateVars(text) {
+		return nil
+	}
+	vars, err := getTemplateVarsMap(ctx, clientID, userIDs)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return nil
+	}
+	result := make(map[string]string, len(vars))
+	for userID, v := range vars {
+		result[userID] = tools.Base64Encode([]byte(renderTemplate(text, v)))
+	}
+	return result
+}
+
+func renderTemplateText(ctx context.Context, clientID, userID, text string) string {
+	if !hasTemplateVars(text) {
+		return text
+	}
+	vars, err := getTemplateVarsMap(ctx, clientID, []string{userID})
+	if err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	return renderTemplate(text, vars[userID])
+}
+
+// 入群提示发给还不是成员的用户，只替换 {name} 和 {group}，其他变量为空
+func renderJoinTemplateText(ctx context.Context, c *Client, userID, text string) string {
+	if !hasTemplateVars(text) {
+		return text
+	}
+	vars := map[string]string{"{group}": c.Name}
+	if u, err := getUserByID(ctx, userID); err != nil {
+		session.Logger(ctx).Println(err)
+	} else {
+		vars["{name}"] = u.FullName
+	}
+	return renderTemplate(text, vars)
+}
+
+func getTemplateVarsMap(ctx context.Context, clientID string, userIDs []string) (map[string]map[string]string, error) {
+	c, err := GetClientByIDOrHost(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	tiers, err := getClientMemberTiers(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]map[string]string, len(userIDs))
+	err = session.Database(ctx).ConnQuery(ctx, `
+SELECT cu.user_id,COALESCE(u.full_name,''),cu.status,cu.level,cu.pay_expired_at,COALESCE(i.invite_code,'')
+FROM client_users cu
+LEFT JOIN users u ON u.user_id=cu.user_id
+LEFT JOIN invitation i ON i.invitee_id=cu.user_id
+WHERE cu.client_id=$1 AND cu.user_id=ANY($2)
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var userID, name, inviteCode string
+			var status, level int
+			var expiredAt time.Time
+			if err := rows.Scan(&userID, &name, &status, &level, &expiredAt, &inviteCode); err != nil {
+				return err
+			}
+			expired := ""
+			if expiredAt.After(time.Now()) {
+				expired = expiredAt.Format("2006-01-02")
+			}
+			result[userID] = map[string]string{
+				"{name}":        name,
+				"{level}":       getClientUserLevelName(tiers, status, level),
+				"{expired_at}":  expired,
+				"{invite_code}": inviteCode,
+				"{group}":       c.Name,
+			}
+		}
+		return nil
+	}, clientID, userIDs)
+	return result, err
+}
+
+// 管理员预览模板，user_id 为空时按管理员自己替换
+func PreviewTemplate(ctx context.Context, u *ClientUser, text, userID string) (string, error) {
+	if !checkIsAdmin(ctx, u.ClientID, u.UserID) {
+		return "", session.ForbiddenError(ctx)
+	}
+	if userID == "" {
+		userID = u.UserID
+	}
+	vars, err := getTemplateVarsMap(ctx, u.ClientID, []string{userID})
+	if err != nil {
+		return "", err
+	}
+	if vars[userID] == nil {
+		return "", session.BadDataError(ctx)
+	}
+	return renderTemplate(text, vars[userID]), nil
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	MetricQueueDepth           = durable.NewGaugeVec("supergroup_distribute_queue_depth", "Pending distribute messages per client and shard.", "client_id", "shard")
+	MetricMessagesCreated      = durable.NewCounterVec("supergroup_messages_created_total", "Distribute messages created.", "client_id")
+	MetricMessagesSent         = durable.NewCounterVec("supergroup_messages_sent_total", "Distribute messages sent.", "client_id")
+	MetricSendDuration         = durable.NewHistogramVec("supergroup_send_duration_seconds", "Latency of sending one distribute batch.", durable.DefaultDurationBuckets, "client_id")
+	MetricBlazeReconnects      = durable.NewCounterVec("supergroup_blaze_reconnects_total", "Blaze connection reconnects.", "client_id")
+	MetricModerationRejections = durable.NewCounterVec("supergroup_moderation_rejections_total", "Messages rejected by moderation rules.", "client_id", "rule")
+	MetricAssetCheckDuration   = durable.NewHistogramVec("supergroup_asset_check_duration_seconds", "Duration of asset checks.", []float64{0.5, 1, 5, 30, 60, 300, 900, 1800, 3600}, "scope")
+	MetricOrderViolations      = durable.NewCounterVec("supergroup_distribute_order_violations_total", "Distribute messages delivered out of order, only counted in fault test mode.", "client_id")
+)
+
+func init() {
+	durable.RegisterMetricsCollector(collectQueueDepth)
+}
+
+// 每个社群每个分片待发送的消息数
+func collectQueueDepth() {
+	results := make([]*redis.IntCmd, 0, len(config.Config.ClientList)*int(config.MessageShardSize))
+	if _, err := session.Redis(_ctx).Pipelined(_ctx, func(p redis.Pipeliner) error {
+		for _, clientID := range config.Config.ClientList {
+			for i := 0; i < int(config.MessageShardSize); i++ {
+				results = append(results, p.ZCard(_ctx, fmt.Sprintf("s_msg:%s:%d", clientID, i)))
+			}
+		}
+		return nil
+	}); err != nil {
+		session.Logger(_ctx).Println(err)
+		return
+	}
+	for i, r := range results {
+		clientID := config.Config.ClientList[i/int(config.MessageShardSize)]
+		shardID := strconv.Itoa(i % int(config.MessageShardSize))
+		MetricQueueDepth.Set(float64(r.Val()), clientID, shardID)
+	}
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/jackc/pgx/v4"
+)
+
+// 按月分区的表，分区键都是 created_at
+var partitionedTables = map[string][]string{
+	"messages":            {"client_id", "message_id"},
+	"distribute_messages": {"client_id", "user_id", "origin_message_id"},
+}
+
+// 提前创建的月份数
+const partitionMonthsAhead = 2
+
+type tablePartition struct {
+	Name  string
+	Start time.Time // MINVALUE 时为零
+	End   time.Time
+}
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func isPartitionedTable(ctx context.Context, table string) (bool, error) {
+	var count int
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT COUNT(1) FROM pg_partitioned_table pt JOIN pg_class c ON c.oid=pt.partrelid
+WHERE c.relname=$1 AND c.relnamespace=to_regnamespace(current_schema())
+`, table).Scan(&count)
+	return count > 0, err
+}
+
+var partitionStartRx = regexp.MustCompile(`FROM \('([^']+)'\)`)
+var partitionEndRx = regexp.MustCompile(`TO \('([^']+)'\)`)
+
+// 表的所有分区，按结束时间排序
+func getTablePartitions(ctx context.Context, table string) ([]*tablePartition, error) {
+	list := make([]*tablePartition, 0)
+	err := session.Database(ctx).ConnQuery(ctx, `
+SELECT c.relname,pg_get_expr(c.relpartbound,c.oid) FROM pg_inherits i
+JOIN pg_class c ON c.oid=i.inhrelid
+JOIN pg_class p ON p.oid=i.inhparent
+WHERE p.relname=$1 AND p.relnamespace=to_regnamespace(current_schema())
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var name, bound string
+			if err := rows.Scan(&name, &bound); err != nil {
+				return err
+			}
+			m := partitionEndRx.FindStringSubmatch(bound)
+			if len(m) != 2 {
+				continue
+			}
+			end, err := parsePartitionBound(m[1])
+			if err != nil {
+				return err
+			}
+			p := &tablePartition{Name: name, End: end}
+			if m := partitionStartRx.FindStringSubmatch(bound); len(m) == 2 {
+				if p.Start, err = parsePartitionBound(m[1]); err != nil {
+					return err
+				}
+			}
+			list = append(list, p)
+		}
+		return nil
+	}, table)
+	sort.Slice(list, func(i, j int) bool { return list[i].End.Before(list[j].End) })
+	return list, err
+}
+
+func parsePartitionBound(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05-07:00", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid partition bound %s", s)
+}
+
+// 创建当前和之后两个月的分区，没有分区的表不处理
+func EnsureMonthlyPartitions(ctx context.Context) error {
+	for table := range partitionedTables {
+		ok, err := isPartitionedTable(ctx, table)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		partitions, err := getTablePartitions(ctx, table)
+		if err != nil {
+			return err
+		}
+		start := monthStart(time.Now())
+		if len(partitions) > 0 && partitions[len(partitions)-1].End.After(start) {
+			start = monthStart(partitions[len(partitions)-1].End)
+		}
+		last := monthStart(time.Now()).AddDate(0, partitionMonthsAhead, 0)
+		for ; !start.After(last); start = start.AddDate(0, 1, 0) {
+			name := fmt.Sprintf("%s_p%s", table, start.Format("200601"))
+			if _, err := session.Database(ctx).Exec(ctx, fmt.Sprintf(
+				`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+				name, table, start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 把已有的表转换为按月分区的表，原来的表作为第一个分区保存到下个月初为止的数据
+func MigrateToPartitionedTables(ctx context.Context) error {
+	for table, keys := range partitionedTables {
+		ok, err := isPartitionedTable(ctx, table)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if err := migrateToPartitionedTable(ctx, table, keys); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		session.Logger(ctx).Println("partitioned", table)
+	}
+	return EnsureMonthlyPartitions(ctx)
+}
+
+func migrateToPartitionedTable(ctx context.Context, table string, keys []string) error {
+	legacy := table + "_legacy"
+	bound := monthStart(time.Now()).AddDate(0, 1, 0).Format(time.RFC3339)
+	// 先在锁表之外验证分区范围，ATTACH 时就不需要再扫描整个表
+	check := table + "_partition_bound"
+	for _, stmt := range []string{
+		fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s`, table, check),
+		fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT %s CHECK (created_at IS NOT NULL AND created_at<'%s') NOT VALID`, table, check, bound),
+		fmt.Sprintf(`ALTER TABLE %s VALIDATE CONSTRAINT %s`, table, check),
+	} {
+		if _, err := session.Database(ctx).Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	return session.Database(ctx).RunInTransaction(ctx, func(ctx context.Context, tx pgx.Tx) error {
+		indexes := make(map[string]string)
+		rows, err := tx.Query(ctx, `
+SELECT indexname,indexdef FROM pg_indexes WHERE tablename=$1 AND schemaname=current_schema() AND indexname!=$2
+`, table, table+"_pkey")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name, def string
+			if err := rows.Scan(&name, &def); err != nil {
+				rows.Close()
+				return err
+			}
+			indexes[name] = def
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		stmts := []string{
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, table, legacy),
+			fmt.Sprintf(`ALTER TABLE %s RENAME CONSTRAINT %s_pkey TO %s_pkey`, legacy, table, legacy),
+		}
+		for name := range indexes {
+			stmts = append(stmts, fmt.Sprintf(`ALTER INDEX %s RENAME TO %s_legacy`, name, name))
+		}
+		stmts = append(stmts,
+			fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS) PARTITION BY RANGE (created_at)`, table, legacy),
+			fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT %s_pkey PRIMARY KEY (%s,created_at)`, table, table, strings.Join(keys, ",")),
+		)
+		for _, def := range indexes {
+			stmts = append(stmts, def)
+		}
+		stmts = append(stmts,
+			fmt.Sprintf(`ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO ('%s')`, table, legacy, bound),
+			fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT %s`, legacy, check),
+		)
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("%s: %w", stmt, err)
+			}
+		}
+		return nil
+	})
+}
+
+// 删除所有数据都超过保存时间的分区，before 为零时不删除
+// 还有不满足 filter 的行（需要一直保存）的分区不删除，只按 filter 分批删除
+func dropExpiredPartitions(ctx context.Context, table string, before time.Time, filter string) ([]*tablePartition, error) {
+	partitions, err := getTablePartitions(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	remain := make([]*tablePartition, 0, len(partitions))
+	for _, p := range partitions {
+		if before.IsZero() || p.End.After(before) {
+			remain = append(remain, p)
+			continue
+		}
+		if filter != "" {
+			var keep bool
+			if err := session.Database(ctx).QueryRow(ctx, fmt.Sprintf(`
+SELECT EXISTS(SELECT 1 FROM %s WHERE NOT (%s))
+`, p.Name, filter)).Scan(&keep); err != nil {
+				return nil, err
+			}
+			if keep {
+				remain = append(remain, p)
+				continue
+			}
+		}
+		if _, err := session.Database(ctx).Exec(ctx, fmt.Sprintf(`DROP TABLE %s`, p.Name)); err != nil {
+			return nil, err
+		}
+		session.Logger(ctx).Println("dropped partition", p.Name)
+	}
+	return remain, nil
+}
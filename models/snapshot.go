@@ -211,6 +211,14 @@ func handelVipSnapshot(ctx context.Context, clientID string, s *mixin.Snapshot)
 	if err != nil {
 		return err
 	}
+	// 设置了自定义等级的社群按等级的价格付费
+	tiers, err := getClientMemberTiers(ctx, clientID)
+	if err != nil {
+		return err
+	}
+	if len(tiers) > 0 {
+		return handleTierSnapshot(ctx, &c, tiers, s)
+	}
 
 	var freshAmount, largeAmount decimal.Decimal
 	if c.AssetID == "" {
@@ -308,7 +316,7 @@ WHERE status=1`, func(rows pgx.Rows) error {
 			session.Logger(ctx).Println("get pin error", err)
 			continue
 		}
-		s, err := client.Transfer(_ctx, t.TransferInput, c.Pin)
+		s, err := client.Transport.Transfer(_ctx, t.TransferInput, c.Pin)
 		if err != nil {
 			session.Logger(ctx).Println("transfer error", err)
 			if strings.Contains(err.Error(), "20117") {
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+	"github.com/go-redis/redis/v8"
+	"github.com/jackc/pgx/v4"
+)
+
+const client_user_lang_DDL = `
+-- 用户希望收到的消息语言，为空不翻译
+ALTER TABLE client_users ADD COLUMN IF NOT EXISTS lang VARCHAR(16) NOT NULL DEFAULT '';
+`
+
+// 翻译服务，from 为空时由翻译服务自动识别
+type Translator interface {
+	Translate(ctx context.Context, text, from, to string) (string, error)
+}
+
+var (
+	translatorMutex sync.RWMutex
+	translators     = map[string]Translator{
+		"dictionary": dictionaryTranslator{},
+		"stub":       stubTranslator{},
+	}
+)
+
+// 注册翻译服务，配置文件中的 translator 指定使用哪一个
+func RegisterTranslator(name string, t Translator) {
+	translatorMutex.Lock()
+	defer translatorMutex.Unlock()
+	translators[name] = t
+}
+
+func getTranslator() Translator {
+	if config.Config.Translator == "" {
+		return nil
+	}
+	translatorMutex.RLock()
+	defer translatorMutex.RUnlock()
+	return translators[config.Config.Translator]
+}
+
+// 本地词典，整条消息匹配 translation_dictionary 中的原文
+type dictionaryTranslator struct{}
+
+func (dictionaryTranslator) Translate(ctx context.Context, text, from, to string) (string, error) {
+	if t, ok := config.Config.TranslationDictionary[to][strings.TrimSpace(text)]; ok {
+		return t, nil
+	}
+	return text, nil
+}
+
+// 只加上语言前缀，用于测试
+type stubTranslator struct{}
+
+func (stubTranslator) Translate(ctx context.Context, text, from, to string) (string, error) {
+	return fmt.Sprintf("[%s] %s", to, text), nil
+}
+
+var translatableCategories = map[string]bool{
+	mixin.MessageCategoryPlainText: true,
+	"ENCRYPTED_TEXT":               true,
+}
+
+var langRx = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+// 翻译结果缓存时间，和消息的 redis 索引一致
+const translationCacheTime = 48 * time.Hour
+
+func GetClientUserLang(ctx context.Context, u *ClientUser) (string, error) {
+	var lang string
+	err := session.Database(ctx).QueryRow(ctx, `
+SELECT lang FROM client_users WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID).Scan(&lang)
+	return lang, err
+}
+
+func UpdateClientUserLang(ctx context.Context, u *ClientUser, lang string) error {
+	if lang != "" && !langRx.MatchString(lang) {
+		return session.BadDataError(ctx)
+	}
+	if _, err := session.Database(ctx).Exec(ctx, `
+UPDATE client_users SET lang=$3 WHERE client_id=$1 AND user_id=$2
+`, u.ClientID, u.UserID, lang); err != nil {
+		return err
+	}
+	cacheUserLangs.Delete(u.ClientID)
+	return nil
+}
+
+var cacheUserLangs = tools.NewMutex()
+
+// 设置了语言的用户，缓存一分钟
+func getUserLangMap(ctx context.Context, clientID string) map[string]string {
+	if langs, ok := cacheUserLangs.Read(clientID).(map[string]string); ok {
+		return langs
+	}
+	langs := make(map[string]string)
+	if err := session.Database(ctx).ConnQuery(ctx, `
+SELECT user_id, lang FROM client_users WHERE client_id=$1 AND lang!='' AND status!=$2
+`, func(rows pgx.Rows) error {
+		for rows.Next() {
+			var userID, lang string
+			if err := rows.Scan(&userID, &lang); err != nil {
+				return err
+			}
+			langs[userID] = lang
+		}
+		return nil
+	}, clientID, ClientUserStatusExit); err != nil {
+		session.Logger(ctx).Println(err)
+		return langs
+	}
+	cacheUserLangs.WriteWithTTL(clientID, langs, time.Minute)
+	return langs
+}
+
+// 按用户的语言翻译文本消息，返回用户到翻译后 data 的对应关系
+// 和社群语言相同、没有设置语言或者翻译失败的用户收到原消息
+func getTranslatedDataMap(ctx context.Context, clientID string, msg *mixin.MessageView, userList []string) map[string]string {
+	result := make(map[string]string)
+	t := getTranslator()
+	if t == nil || !translatableCategories[msg.Category] {
+		return result
+	}
+	langs := getUserLangMap(ctx, clientID)
+	if len(langs) == 0 {
+		return result
+	}
+	from := config.Config.Lang
+	if c, err := GetClientByIDOrHost(ctx, clientID); err == nil && c.Lang != "" {
+		from = c.Lang
+	}
+	text := string(tools.Base64Decode(msg.Data))
+	if strings.TrimSpace(text) == "" {
+		return result
+	}
+	translated := make(map[string]string)
+	for _, userID := range userList {
+		lang := langs[userID]
+		if lang == "" || lang == from {
+			continue
+		}
+		data, ok := translated[lang]
+		if !ok {
+			data = translateMessage(ctx, t, clientID, msg.MessageID, text, from, lang)
+			translated[lang] = data
+		}
+		if data != "" {
+			result[userID] = data
+		}
+	}
+	return result
+}
+
+// 同一条消息的同一种语言只翻译一次，结果缓存在 redis 中
+func translateMessage(ctx context.Context, t Translator, clientID, msgID, text, from, to string) string {
+	key := fmt.Sprintf("msg_trans:%s:%s:%s", clientID, msgID, to)
+	data, err := session.Redis(ctx).Get(ctx, key).Result()
+	if err == nil {
+		return data
+	} else if !errors.Is(err, redis.Nil) {
+		session.Logger(ctx).Println(err)
+	}
+	res, err := t.Translate(ctx, text, from, to)
+	if err != nil {
+		session.Logger(ctx).Println("translate", msgID, to, err)
+		return ""
+	}
+	data = ""
+	if res != text && strings.TrimSpace(res) != "" {
+		data = tools.Base64Encode([]byte(res))
+	}
+	if err := session.Redis(ctx).Set(ctx, key, data, translationCacheTime).Err(); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+	return data
+}
@@ -0,0 +1,115 @@
+//go:build integration
+// +build integration
+
+package models
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+// 记录每种语言的调用次数，结果和 stub 相同
+type countingTranslator struct {
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func (t *countingTranslator) Translate(ctx context.Context, text, from, to string) (string, error) {
+	t.mutex.Lock()
+	t.calls[to]++
+	t.mutex.Unlock()
+	return stubTranslator{}.Translate(ctx, text, from, to)
+}
+
+func setTestTranslator(t *testing.T, name string) {
+	t.Helper()
+	old := config.Config.Translator
+	config.Config.Translator = name
+	t.Cleanup(func() { config.Config.Translator = old })
+}
+
+func setTestUserLang(t *testing.T, clientID, userID, lang string) {
+	t.Helper()
+	if err := UpdateClientUserLang(_ctx, &ClientUser{ClientID: clientID, UserID: userID}, lang); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetTranslatedDataMapWithStubTranslator(t *testing.T) {
+	setTestTranslator(t, "stub")
+	clientID := createTestClient(t, "zh")
+	en := addTestClientUser(t, clientID, ClientUserStatusFresh)
+	ja := addTestClientUser(t, clientID, ClientUserStatusFresh)
+	zh := addTestClientUser(t, clientID, ClientUserStatusFresh)
+	none := addTestClientUser(t, clientID, ClientUserStatusFresh)
+	setTestUserLang(t, clientID, en, "en")
+	setTestUserLang(t, clientID, ja, "ja")
+	setTestUserLang(t, clientID, zh, "zh")
+
+	msg := &mixin.MessageView{
+		MessageID: tools.GetUUID(),
+		Category:  mixin.MessageCategoryPlainText,
+		Data:      tools.Base64Encode([]byte("你好")),
+	}
+	t.Cleanup(func() {
+		session.Redis(_ctx).Del(_ctx, "msg_trans:"+clientID+":"+msg.MessageID+":en", "msg_trans:"+clientID+":"+msg.MessageID+":ja")
+	})
+	res := getTranslatedDataMap(_ctx, clientID, msg, []string{en, ja, zh, none})
+	if len(res) != 2 {
+		t.Fatalf("expected translations for 2 users, got %v", res)
+	}
+	for userID, want := range map[string]string{en: "[en] 你好", ja: "[ja] 你好"} {
+		if got := string(tools.Base64Decode(res[userID])); got != want {
+			t.Fatalf("user %s got %q, want %q", userID, got, want)
+		}
+	}
+	if _, ok := res[zh]; ok {
+		t.Fatal("user with the group language should get the original text")
+	}
+	if _, ok := res[none]; ok {
+		t.Fatal("user without a language should get the original text")
+	}
+
+	// 非文本消息不翻译
+	msg.Category = mixin.MessageCategoryPlainImage
+	if res := getTranslatedDataMap(_ctx, clientID, msg, []string{en, ja}); len(res) != 0 {
+		t.Fatalf("non-text message should not be translated, got %v", res)
+	}
+}
+
+func TestGetTranslatedDataMapTranslatesOncePerLanguage(t *testing.T) {
+	counter := &countingTranslator{calls: make(map[string]int)}
+	RegisterTranslator("counting", counter)
+	setTestTranslator(t, "counting")
+	clientID := createTestClient(t, "zh")
+	users := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		userID := addTestClientUser(t, clientID, ClientUserStatusFresh)
+		setTestUserLang(t, clientID, userID, "en")
+		users = append(users, userID)
+	}
+	msg := &mixin.MessageView{
+		MessageID: tools.GetUUID(),
+		Category:  mixin.MessageCategoryPlainText,
+		Data:      tools.Base64Encode([]byte("hello")),
+	}
+	t.Cleanup(func() {
+		session.Redis(_ctx).Del(_ctx, "msg_trans:"+clientID+":"+msg.MessageID+":en")
+	})
+	for i := 0; i < 2; i++ {
+		res := getTranslatedDataMap(_ctx, clientID, msg, users)
+		if len(res) != len(users) {
+			t.Fatalf("expected %d translations, got %v", len(users), res)
+		}
+	}
+	// 第二次从 redis 缓存中读取
+	if counter.calls["en"] != 1 {
+		t.Fatalf("expected 1 translation for en, got %d", counter.calls["en"])
+	}
+}
@@ -139,6 +139,8 @@ type UserMeResp struct {
 	IsClaim  bool   `json:"is_claim"`
 	IsBlock  bool   `json:"is_block"`
 	IsProxy  bool   `json:"is_proxy"`
+
+	Tier *ClientMemberTier `json:"tier,omitempty"`
 }
 
 func GetMe(ctx context.Context, u *ClientUser) UserMeResp {
@@ -151,6 +153,7 @@ func GetMe(ctx context.Context, u *ClientUser) UserMeResp {
 		IsBlock:    checkIsBlockUser(ctx, u.ClientID, u.UserID),
 		IsProxy:    proxy.Status == ClientUserProxyStatusActive,
 		FullName:   proxy.FullName,
+		Tier:       getClientUserTier(ctx, u.ClientID, u.UserID, u.Status),
 	}
 	return me
 }
@@ -253,7 +256,7 @@ func GetUserByIdentityNumber(ctx context.Context, identityNumber string) (*mixin
 }
 
 func SearchUser(ctx context.Context, userIDOrIdentityNumber string) (*mixin.User, error) {
-	u, err := GetFirstClient(ctx).ReadUser(ctx, userIDOrIdentityNumber)
+	u, err := getFirstMixinClient(ctx).Transport.ReadUser(ctx, userIDOrIdentityNumber)
 	if err != nil {
 		return nil, err
 	}
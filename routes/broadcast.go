@@ -3,6 +3,7 @@ package routes
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/MixinNetwork/supergroup/middlewares"
 	"github.com/MixinNetwork/supergroup/models"
@@ -18,6 +19,19 @@ func registerBroadcast(router *httptreemux.TreeMux) {
 	router.GET("/broadcast", b.getBroadcast)
 	router.POST("/broadcast", b.postBroadcast)
 	router.DELETE("/broadcast/:id", b.deleteBroadcast)
+	router.GET("/broadcast/scheduled", b.getScheduledBroadcast)
+	router.POST("/broadcast/preview", b.previewBroadcast)
+	router.POST("/broadcast/template/preview", b.previewTemplate)
+	router.PUT("/broadcast/:id", b.updateScheduledBroadcast)
+	router.GET("/broadcast/recurring", b.getRecurringBroadcast)
+	router.POST("/broadcast/recurring", b.postRecurringBroadcast)
+	router.PUT("/broadcast/recurring/:id", b.updateRecurringBroadcast)
+	router.PUT("/broadcast/recurring/:id/status", b.updateRecurringBroadcastStatus)
+	router.GET("/broadcast/recurring/:id/history", b.getRecurringBroadcastHistory)
+	router.GET("/broadcast/multi", b.getMultiBroadcast)
+	router.POST("/broadcast/multi", b.postMultiBroadcast)
+	router.GET("/broadcast/multi/clients", b.getMultiBroadcastClients)
+	router.GET("/broadcast/multi/:id", b.getMultiBroadcastReport)
 }
 
 func (b *broadcastImpl) getBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
@@ -30,12 +44,20 @@ func (b *broadcastImpl) getBroadcast(w http.ResponseWriter, r *http.Request, par
 
 func (b *broadcastImpl) postBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	var body struct {
-		Data     string `json:"data"`
-		Category string `json:"category"`
+		Data     string                   `json:"data"`
+		Category string                   `json:"category"`
+		SendAt   time.Time                `json:"send_at"`
+		Segment  *models.BroadcastSegment `json:"segment"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
-	} else if err := models.CreateBroadcast(r.Context(), middlewares.CurrentUser(r), body.Data, body.Category); err != nil {
+	} else if !body.SendAt.IsZero() {
+		if b, err := models.CreateScheduledBroadcast(r.Context(), middlewares.CurrentUser(r), body.Data, body.Category, body.SendAt, body.Segment); err != nil {
+			views.RenderErrorResponse(w, r, err)
+		} else {
+			views.RenderDataResponse(w, r, b)
+		}
+	} else if err := models.CreateBroadcast(r.Context(), middlewares.CurrentUser(r), body.Data, body.Category, body.Segment); err != nil {
 		views.RenderErrorResponse(w, r, err)
 	} else {
 		views.RenderDataResponse(w, r, "success")
@@ -53,3 +75,138 @@ func (b *broadcastImpl) deleteBroadcast(w http.ResponseWriter, r *http.Request,
 		views.RenderDataResponse(w, r, "success")
 	}
 }
+
+func (b *broadcastImpl) getScheduledBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if broadcasts, err := models.GetScheduledBroadcasts(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, broadcasts)
+	}
+}
+
+func (b *broadcastImpl) previewBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.BroadcastSegment
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if preview, err := models.PreviewBroadcastSegment(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, preview)
+	}
+}
+
+func (b *broadcastImpl) previewTemplate(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body struct {
+		Data   string `json:"data"`
+		UserID string `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if data, err := models.PreviewTemplate(r.Context(), middlewares.CurrentUser(r), body.Data, body.UserID); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, map[string]string{"data": data})
+	}
+}
+
+func (b *broadcastImpl) updateScheduledBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body struct {
+		Data     string                   `json:"data"`
+		Category string                   `json:"category"`
+		SendAt   time.Time                `json:"send_at"`
+		Segment  *models.BroadcastSegment `json:"segment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateScheduledBroadcast(r.Context(), middlewares.CurrentUser(r), params["id"], body.Data, body.Category, body.SendAt, body.Segment); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
+
+func (b *broadcastImpl) getRecurringBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetBroadcastRecurringList(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (b *broadcastImpl) postRecurringBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.BroadcastRecurring
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if rb, err := models.CreateBroadcastRecurring(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, rb)
+	}
+}
+
+func (b *broadcastImpl) updateRecurringBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.BroadcastRecurring
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if rb, err := models.UpdateBroadcastRecurring(r.Context(), middlewares.CurrentUser(r), params["id"], &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, rb)
+	}
+}
+
+func (b *broadcastImpl) updateRecurringBroadcastStatus(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body struct {
+		Status int `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if rb, err := models.UpdateBroadcastRecurringStatus(r.Context(), middlewares.CurrentUser(r), params["id"], body.Status); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, rb)
+	}
+}
+
+func (b *broadcastImpl) getRecurringBroadcastHistory(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetBroadcastRecurringHistory(r.Context(), middlewares.CurrentUser(r), params["id"]); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (b *broadcastImpl) getMultiBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetMultiBroadcasts(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (b *broadcastImpl) postMultiBroadcast(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.MultiBroadcast
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if mb, err := models.CreateMultiBroadcast(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, mb)
+	}
+}
+
+func (b *broadcastImpl) getMultiBroadcastClients(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetOwnerClients(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (b *broadcastImpl) getMultiBroadcastReport(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if report, err := models.GetMultiBroadcastReport(r.Context(), middlewares.CurrentUser(r), params["id"]); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, report)
+	}
+}
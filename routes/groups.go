@@ -15,6 +15,7 @@ func registerGroups(router *httptreemux.TreeMux) {
 	impl := &groupsImpl{}
 	router.GET("/group", impl.getGroupInfo)
 	router.GET("/group/vip", impl.getGroupVip)
+	router.GET("/group/tiers", impl.getGroupTiers)
 	router.GET("/groupList", impl.getGroupInfoList)
 	router.GET("/group/status", impl.getGroupStatus)
 	router.GET("/swapList/:id", impl.swapList)
@@ -37,6 +38,14 @@ func (impl *groupsImpl) getGroupVip(w http.ResponseWriter, r *http.Request, para
 	}
 }
 
+func (impl *groupsImpl) getGroupTiers(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if tiers, err := models.GetClientMemberTiersByHost(r.Context(), r.Header.Get("Origin")); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, tiers)
+	}
+}
+
 func (impl *groupsImpl) getGroupStatus(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	status := models.GetClientStatusByID(r.Context(), middlewares.CurrentUser(r))
 	views.RenderDataResponse(w, r, status)
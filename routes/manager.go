@@ -23,6 +23,20 @@ func registerManager(router *httptreemux.TreeMux) {
 
 	router.GET("/group/member/auth", impl.getGroupMemberAuth)
 	router.PUT("/group/member/auth", impl.updateGroupMemberAuth)
+
+	router.GET("/group/delivery/tier", impl.getGroupDeliveryTier)
+	router.PUT("/group/delivery/tier", impl.updateGroupDeliveryTier)
+
+	router.GET("/blaze/status", impl.getBlazeStatus)
+
+	router.GET("/group/retention", impl.getGroupRetention)
+	router.PUT("/group/retention", impl.updateGroupRetention)
+
+	router.GET("/group/catchup", impl.getGroupCatchupPolicy)
+	router.PUT("/group/catchup", impl.updateGroupCatchupPolicy)
+	router.GET("/group/holding", impl.getGroupHoldingProviders)
+	router.PUT("/group/holding", impl.updateGroupHoldingProviders)
+	router.PUT("/group/tiers", impl.updateGroupTiers)
 }
 
 func (impl *managerImpl) groupStat(w http.ResponseWriter, r *http.Request, params map[string]string) {
@@ -71,6 +85,25 @@ func (impl *managerImpl) updateGroupMemberAuth(w http.ResponseWriter, r *http.Re
 	}
 }
 
+func (impl *managerImpl) getGroupDeliveryTier(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if tiers, err := models.GetClientDeliveryTiersByAdmin(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, tiers)
+	}
+}
+
+func (impl *managerImpl) updateGroupDeliveryTier(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body []*models.ClientDeliveryTier
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientDeliveryTiers(r.Context(), middlewares.CurrentUser(r), body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
+
 func (impl *managerImpl) updateGroupSetting(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	var body struct {
 		Description string `json:"description,omitempty"`
@@ -84,3 +117,82 @@ func (impl *managerImpl) updateGroupSetting(w http.ResponseWriter, r *http.Reque
 		views.RenderDataResponse(w, r, "success")
 	}
 }
+
+func (impl *managerImpl) getBlazeStatus(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if status, err := models.GetBlazeStatusByAdmin(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, status)
+	}
+}
+
+func (impl *managerImpl) getGroupRetention(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if retention, err := models.GetClientRetentionByAdmin(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, retention)
+	}
+}
+
+func (impl *managerImpl) updateGroupRetention(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.ClientRetention
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientRetention(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
+
+func (impl *managerImpl) getGroupCatchupPolicy(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if policy, err := models.GetClientCatchupPolicyByAdmin(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, policy)
+	}
+}
+
+func (impl *managerImpl) updateGroupCatchupPolicy(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.ClientCatchupPolicy
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientCatchupPolicy(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
+
+func (impl *managerImpl) getGroupHoldingProviders(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetClientHoldingProvidersByAdmin(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, map[string]interface{}{
+			"available": models.GetHoldingProviderNames(),
+			"providers": list,
+		})
+	}
+}
+
+func (impl *managerImpl) updateGroupHoldingProviders(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body []*models.ClientHoldingProvider
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientHoldingProviders(r.Context(), middlewares.CurrentUser(r), body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
+
+func (impl *managerImpl) updateGroupTiers(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body []*models.ClientMemberTier
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientMemberTiers(r.Context(), middlewares.CurrentUser(r), body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, "success")
+	}
+}
@@ -0,0 +1,178 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/middlewares"
+	"github.com/MixinNetwork/supergroup/models"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/views"
+	"github.com/dimfeld/httptreemux"
+)
+
+type messageImpl struct{}
+
+func registerMessage(router *httptreemux.TreeMux) {
+	var impl messageImpl
+	router.GET("/message/stat/:id", impl.getMessageStat)
+	router.POST("/message/redeliver", impl.createMessageRedeliver)
+	router.GET("/message/redeliver", impl.getMessageRedeliverList)
+	router.GET("/message/redeliver/:id", impl.getMessageRedeliver)
+	router.GET("/message/search", impl.searchMessages)
+	router.GET("/message/search/all", impl.searchMessagesByAdmin)
+	router.POST("/message/export", impl.createMessageExport)
+	router.GET("/message/export", impl.getMessageExportList)
+	router.GET("/message/export/:id", impl.getMessageExport)
+	router.GET("/message/export/:id/download", impl.downloadMessageExport)
+	router.GET("/message/history", impl.getMessageHistory)
+}
+
+func (impl *messageImpl) getMessageStat(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if params["id"] == "" {
+		views.RenderErrorResponse(w, r, session.BadDataError(r.Context()))
+		return
+	}
+	if stat, err := models.GetMessageStat(r.Context(), middlewares.CurrentUser(r), params["id"]); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, stat)
+	}
+}
+
+func (impl *messageImpl) createMessageRedeliver(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.MessageRedeliver
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if redeliver, err := models.CreateMessageRedeliver(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, redeliver)
+	}
+}
+
+func (impl *messageImpl) getMessageRedeliverList(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetMessageRedeliverList(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (impl *messageImpl) getMessageRedeliver(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if redeliver, err := models.GetMessageRedeliver(r.Context(), middlewares.CurrentUser(r), params["id"]); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, redeliver)
+	}
+}
+
+func (impl *messageImpl) searchMessages(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if list, err := models.SearchMessages(r.Context(), middlewares.CurrentUser(r), r.URL.Query().Get("q"), page); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (impl *messageImpl) searchMessagesByAdmin(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	query := r.URL.Query()
+	p := models.MessageSearchParams{
+		Query:    query.Get("q"),
+		UserID:   query.Get("user_id"),
+		Category: query.Get("category"),
+	}
+	p.Page, _ = strconv.Atoi(query.Get("page"))
+	var err error
+	if p.Start, err = parseSearchDate(query.Get("start")); err != nil {
+		views.RenderErrorResponse(w, r, session.BadDataError(r.Context()))
+		return
+	}
+	if p.End, err = parseSearchDate(query.Get("end")); err != nil {
+		views.RenderErrorResponse(w, r, session.BadDataError(r.Context()))
+		return
+	}
+	if list, err := models.SearchMessagesByAdmin(r.Context(), middlewares.CurrentUser(r), &p); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+// 支持 2006-01-02 和 RFC3339 两种格式，为空时不过滤
+func parseSearchDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (impl *messageImpl) createMessageExport(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.MessageExport
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if e, err := models.CreateMessageExportByAdmin(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, e)
+	}
+}
+
+func (impl *messageImpl) getMessageExportList(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if list, err := models.GetMessageExportList(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, list)
+	}
+}
+
+func (impl *messageImpl) getMessageExport(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if e, err := models.GetMessageExport(r.Context(), middlewares.CurrentUser(r), params["id"]); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, e)
+	}
+}
+
+var exportContentTypes = map[string]string{
+	models.ExportFormatJSONL: "application/x-ndjson; charset=utf-8",
+	models.ExportFormatCSV:   "text/csv; charset=utf-8",
+	models.ExportFormatHTML:  "text/html; charset=utf-8",
+}
+
+func (impl *messageImpl) downloadMessageExport(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	e, err := models.GetMessageExportFile(r.Context(), middlewares.CurrentUser(r), params["id"])
+	if err != nil {
+		views.RenderErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", exportContentTypes[e.Format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.FileName))
+	w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	if err := models.CopyMessageExportFile(r.Context(), e.ExportID, w); err != nil {
+		session.Logger(r.Context()).Println(err)
+	}
+}
+
+func (impl *messageImpl) getMessageHistory(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	query := r.URL.Query()
+	p := models.MessageHistoryParams{
+		Before: query.Get("before"),
+		After:  query.Get("after"),
+		Around: query.Get("around"),
+		Unread: query.Get("unread") == "true",
+	}
+	p.Limit, _ = strconv.Atoi(query.Get("limit"))
+	if h, err := models.GetMessageHistory(r.Context(), middlewares.CurrentUser(r), &p); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, h)
+	}
+}
@@ -15,6 +15,7 @@ func RegisterRoutes(router *httptreemux.TreeMux) {
 	registerUsers(router)
 	registerGroups(router)
 	registerBroadcast(router)
+	registerMessage(router)
 	registerCommon(router)
 	registerLive(router)
 	registerAirdrop(router)
@@ -18,6 +18,10 @@ func registerUsers(router *httptreemux.TreeMux) {
 	impl := &usersImpl{}
 	router.POST("/auth", impl.authenticate)
 	router.POST("/user/chatStatus", impl.chatStatus)
+	router.GET("/user/delivery", impl.getDelivery)
+	router.PUT("/user/delivery", impl.updateDelivery)
+	router.GET("/user/lang", impl.getLang)
+	router.PUT("/user/lang", impl.updateLang)
 	router.GET("/me", impl.me)
 	router.GET("/user/block/:id", impl.blockUser)
 
@@ -57,6 +61,42 @@ func (impl *usersImpl) chatStatus(w http.ResponseWriter, r *http.Request, params
 		views.RenderDataResponse(w, r, user)
 	}
 }
+func (impl *usersImpl) getDelivery(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if d, err := models.GetClientUserDelivery(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, d)
+	}
+}
+func (impl *usersImpl) updateDelivery(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body models.ClientUserDelivery
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if d, err := models.UpdateClientUserDelivery(r.Context(), middlewares.CurrentUser(r), &body); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, d)
+	}
+}
+func (impl *usersImpl) getLang(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	if lang, err := models.GetClientUserLang(r.Context(), middlewares.CurrentUser(r)); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, map[string]string{"lang": lang})
+	}
+}
+func (impl *usersImpl) updateLang(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	var body struct {
+		Lang string `json:"lang"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		views.RenderErrorResponse(w, r, session.BadRequestError(r.Context()))
+	} else if err := models.UpdateClientUserLang(r.Context(), middlewares.CurrentUser(r), body.Lang); err != nil {
+		views.RenderErrorResponse(w, r, err)
+	} else {
+		views.RenderDataResponse(w, r, map[string]string{"lang": body.Lang})
+	}
+}
 func (impl *usersImpl) userSearch(w http.ResponseWriter, r *http.Request, params map[string]string) {
 	key := r.URL.Query().Get("key")
 	if key == "" {
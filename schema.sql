@@ -51,8 +51,40 @@ CREATE TABLE broadcast (
 	status int2 NOT NULL DEFAULT 0,
 	created_at timestamptz NOT NULL DEFAULT now(),
 	top_at timestamptz NOT NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	category varchar NOT NULL DEFAULT ''::character varying,
+	"data" text NOT NULL DEFAULT ''::text,
+	created_by varchar(36) NOT NULL DEFAULT ''::character varying,
+	send_at timestamptz NOT NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	recurring_id varchar(36) NOT NULL DEFAULT ''::character varying,
+	segment text NOT NULL DEFAULT ''::text,
+	multi_id varchar(36) NOT NULL DEFAULT ''::character varying,
+	sending_at timestamptz NOT NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	attempts int2 NOT NULL DEFAULT 0,
 	CONSTRAINT broadcast_pkey PRIMARY KEY (client_id, message_id)
 );
+CREATE INDEX broadcast_multi_idx ON broadcast USING btree (multi_id);
+CREATE INDEX broadcast_recurring_idx ON broadcast USING btree (recurring_id, created_at);
+CREATE INDEX broadcast_send_idx ON broadcast USING btree (status, send_at);
+
+
+CREATE TABLE broadcast_recurring (
+	recurring_id varchar(36) NOT NULL,
+	client_id varchar(36) NOT NULL,
+	category varchar NOT NULL,
+	"data" text NOT NULL,
+	cron varchar NOT NULL,
+	timezone varchar NOT NULL DEFAULT 'UTC'::character varying,
+	end_at timestamptz NOT NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	status int2 NOT NULL DEFAULT 1,
+	next_at timestamptz NOT NULL,
+	last_at timestamptz NOT NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	created_by varchar(36) NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT broadcast_recurring_pkey PRIMARY KEY (recurring_id)
+);
+CREATE INDEX broadcast_recurring_client_idx ON broadcast_recurring USING btree (client_id);
+CREATE INDEX broadcast_recurring_next_idx ON broadcast_recurring USING btree (status, next_at);
 
 
 CREATE TABLE claim (
@@ -130,6 +162,39 @@ CREATE TABLE client_block_user (
 CREATE INDEX client_block_user_idx ON client_block_user USING btree (client_id);
 
 
+CREATE TABLE client_catchup_policy (
+	client_id varchar(36) NOT NULL,
+	join_policy int2 NOT NULL DEFAULT 1,
+	return_policy int2 NOT NULL DEFAULT 0,
+	latest_count int4 NOT NULL DEFAULT 20,
+	max_count int4 NOT NULL DEFAULT 200,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT client_catchup_policy_pkey PRIMARY KEY (client_id)
+);
+
+
+CREATE TABLE client_delivery_tier (
+	client_id varchar(36) NOT NULL,
+	tier_index int2 NOT NULL,
+	"name" varchar NOT NULL DEFAULT ''::character varying,
+	priority _int2 NOT NULL DEFAULT '{}'::smallint[],
+	status _int2 NOT NULL DEFAULT '{}'::smallint[],
+	is_paid bool NOT NULL DEFAULT false,
+	active_days int4 NOT NULL DEFAULT 0,
+	delay int4 NOT NULL DEFAULT 0,
+	CONSTRAINT client_delivery_tier_pkey PRIMARY KEY (client_id, tier_index)
+);
+
+
+CREATE TABLE client_holding_provider (
+	client_id varchar(36) NOT NULL,
+	provider varchar NOT NULL,
+	weight varchar NOT NULL DEFAULT '1'::character varying,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT client_holding_provider_pkey PRIMARY KEY (client_id, provider)
+);
+
+
 CREATE TABLE client_member_auth (
 	client_id varchar(36) NOT NULL,
 	user_status int2 NOT NULL,
@@ -150,6 +215,21 @@ CREATE TABLE client_member_auth (
 );
 
 
+CREATE TABLE client_member_tier (
+	client_id varchar(36) NOT NULL,
+	"level" int2 NOT NULL,
+	"name" varchar(32) NOT NULL,
+	amount varchar NOT NULL DEFAULT '0'::character varying,
+	usd_amount varchar NOT NULL DEFAULT '0'::character varying,
+	price varchar NOT NULL DEFAULT '0'::character varying,
+	duration int4 NOT NULL DEFAULT 365,
+	msg_limit int4 NOT NULL DEFAULT 10,
+	permissions text NOT NULL DEFAULT ''::text,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT client_member_tier_pkey PRIMARY KEY (client_id, level)
+);
+
+
 CREATE TABLE client_replay (
 	client_id varchar(36) NOT NULL,
 	join_msg text NULL DEFAULT ''::text,
@@ -166,6 +246,19 @@ CREATE TABLE client_replay (
 );
 
 
+CREATE TABLE client_retention (
+	client_id varchar(36) NOT NULL,
+	mapping_days int4 NOT NULL DEFAULT 30,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	messages_days int4 NOT NULL DEFAULT 0,
+	distribute_days int4 NOT NULL DEFAULT 1,
+	live_replay_days int4 NOT NULL DEFAULT 0,
+	login_log_days int4 NOT NULL DEFAULT 0,
+	snapshots_days int4 NOT NULL DEFAULT 0,
+	CONSTRAINT client_retention_pkey PRIMARY KEY (client_id)
+);
+
+
 CREATE TABLE client_user_proxy (
 	client_id varchar(36) NOT NULL,
 	proxy_user_id varchar(36) NOT NULL,
@@ -197,6 +290,14 @@ CREATE TABLE client_users (
 	read_at timestamptz NULL DEFAULT now(),
 	pay_status int2 NULL DEFAULT 1,
 	pay_expired_at timestamptz NULL DEFAULT '1970-01-01 08:00:00+08'::timestamp with time zone,
+	delivery_mode int2 NOT NULL DEFAULT 1,
+	timezone varchar NOT NULL DEFAULT ''::character varying,
+	quiet_start int2 NOT NULL DEFAULT 0,
+	quiet_end int2 NOT NULL DEFAULT 0,
+	digest_at timestamptz NOT NULL DEFAULT now(),
+	lang varchar(16) NOT NULL DEFAULT ''::character varying,
+	"level" int2 NOT NULL DEFAULT 0,
+	pay_level int2 NOT NULL DEFAULT 0,
 	CONSTRAINT client_users_pkey PRIMARY KEY (client_id, user_id)
 );
 CREATE INDEX client_user_idx ON client_users USING btree (client_id);
@@ -235,8 +336,8 @@ CREATE TABLE distribute_messages (
 	representative_id varchar(36) NULL DEFAULT ''::character varying,
 	conversation_id varchar(36) NULL DEFAULT ''::character varying,
 	shard_id varchar(36) NULL DEFAULT ''::character varying,
-	CONSTRAINT distribute_messages_pkey PRIMARY KEY (client_id, user_id, origin_message_id)
-);
+	CONSTRAINT distribute_messages_pkey PRIMARY KEY (client_id, user_id, origin_message_id, created_at)
+) PARTITION BY RANGE (created_at);
 CREATE INDEX distribute_messages_all_list_idx ON distribute_messages USING btree (client_id, shard_id, status, level, created_at);
 CREATE INDEX distribute_messages_id_idx ON distribute_messages USING btree (message_id);
 CREATE INDEX distribute_messages_list_idx ON distribute_messages USING btree (client_id, origin_message_id, level);
@@ -466,6 +567,98 @@ CREATE TABLE lottery_supply_received (
 );
 
 
+CREATE TABLE message_export (
+	export_id varchar(36) NOT NULL,
+	client_id varchar(36) NOT NULL,
+	format varchar(16) NOT NULL,
+	start_at timestamptz NOT NULL,
+	end_at timestamptz NOT NULL,
+	state int2 NOT NULL DEFAULT 1,
+	count int8 NOT NULL DEFAULT 0,
+	"size" int8 NOT NULL DEFAULT 0,
+	file_name varchar NOT NULL DEFAULT ''::character varying,
+	error varchar NOT NULL DEFAULT ''::character varying,
+	created_by varchar(36) NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT message_export_pkey PRIMARY KEY (export_id)
+);
+CREATE INDEX message_export_client_idx ON message_export USING btree (client_id, created_at);
+CREATE INDEX message_export_state_idx ON message_export USING btree (state, created_at);
+
+
+CREATE TABLE message_export_chunk (
+	export_id varchar(36) NOT NULL,
+	seq int4 NOT NULL,
+	"data" bytea NOT NULL,
+	CONSTRAINT message_export_chunk_pkey PRIMARY KEY (export_id, seq)
+);
+
+
+CREATE TABLE message_mapping (
+	message_id uuid NOT NULL,
+	origin_message_id uuid NOT NULL,
+	user_id uuid NOT NULL,
+	CONSTRAINT message_mapping_pkey PRIMARY KEY (message_id)
+);
+CREATE INDEX message_mapping_origin_idx ON message_mapping USING btree (origin_message_id);
+
+
+CREATE TABLE message_mapping_origin (
+	origin_message_id uuid NOT NULL,
+	client_id uuid NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT message_mapping_origin_pkey PRIMARY KEY (origin_message_id)
+);
+CREATE INDEX message_mapping_origin_created_idx ON message_mapping_origin USING btree (client_id, created_at);
+
+
+CREATE TABLE message_redeliver (
+	redeliver_id varchar(36) NOT NULL,
+	client_id varchar(36) NOT NULL,
+	message_id varchar(36) NOT NULL,
+	audience varchar(16) NOT NULL,
+	status int2 NOT NULL DEFAULT 0,
+	user_ids _varchar NOT NULL DEFAULT '{}'::character varying[],
+	state int2 NOT NULL DEFAULT 1,
+	total int4 NOT NULL DEFAULT 0,
+	sent int4 NOT NULL DEFAULT 0,
+	error varchar NOT NULL DEFAULT ''::character varying,
+	created_by varchar(36) NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT message_redeliver_pkey PRIMARY KEY (redeliver_id)
+);
+CREATE INDEX message_redeliver_client_idx ON message_redeliver USING btree (client_id, created_at);
+
+
+CREATE TABLE message_search (
+	client_id varchar(36) NOT NULL,
+	message_id varchar(36) NOT NULL,
+	user_id varchar(36) NOT NULL,
+	category varchar NOT NULL,
+	"content" text NOT NULL,
+	tsv tsvector NOT NULL,
+	created_at timestamptz NOT NULL,
+	CONSTRAINT message_search_pkey PRIMARY KEY (client_id, message_id)
+);
+CREATE INDEX message_search_created_idx ON message_search USING btree (client_id, created_at);
+CREATE INDEX message_search_tsv_idx ON message_search USING gin (tsv);
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX message_search_content_trgm_idx ON message_search USING gin (content gin_trgm_ops);
+
+
+CREATE TABLE message_stat (
+	client_id varchar(36) NOT NULL,
+	message_id varchar(36) NOT NULL,
+	distributed_count int4 NOT NULL DEFAULT 0,
+	delivered_count int4 NOT NULL DEFAULT 0,
+	read_count int4 NOT NULL DEFAULT 0,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT message_stat_pkey PRIMARY KEY (client_id, message_id)
+);
+
+
 CREATE TABLE messages (
 	client_id varchar(36) NOT NULL,
 	user_id varchar(36) NOT NULL,
@@ -476,8 +669,23 @@ CREATE TABLE messages (
 	status int2 NOT NULL,
 	created_at timestamptz NOT NULL,
 	quote_message_id varchar(36) NULL DEFAULT ''::character varying,
-	CONSTRAINT messages_pkey PRIMARY KEY (client_id, message_id)
+	CONSTRAINT messages_pkey PRIMARY KEY (client_id, message_id, created_at)
+) PARTITION BY RANGE (created_at);
+CREATE INDEX messages_created_idx ON messages USING btree (client_id, created_at);
+
+
+CREATE TABLE multi_broadcast (
+	multi_id varchar(36) NOT NULL,
+	owner_id varchar(36) NOT NULL,
+	category varchar NOT NULL,
+	"data" text NOT NULL,
+	variants text NOT NULL DEFAULT ''::text,
+	client_ids _varchar NOT NULL,
+	send_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	CONSTRAINT multi_broadcast_pkey PRIMARY KEY (multi_id)
 );
+CREATE INDEX multi_broadcast_owner_idx ON multi_broadcast USING btree (owner_id, created_at);
 
 
 CREATE TABLE power (
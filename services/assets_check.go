@@ -19,7 +19,11 @@ func (service *AssetsCheckService) Run(ctx context.Context) error {
 			session.Logger(ctx).Println(err)
 		}
 		tools.PrintTimeDuration("资产检查...", now)
-		time.Sleep(config.AssetsCheckTime)
+		models.MetricAssetCheckDuration.Observe(time.Since(now).Seconds(), "all")
+		sleepWithContext(ctx, config.AssetsCheckTime)
+		if ctx.Err() != nil {
+			return nil
+		}
 	}
 }
 
@@ -46,11 +50,15 @@ func startAssetCheck(ctx context.Context) error {
 	for k := range _allUser {
 		allUser = append(allUser, k)
 	}
-	foxUserAssetMap, _ := models.GetAllUserFoxShares(ctx, allUser)
-	exinUserAssetMap, _ := models.GetAllUserExinShares(ctx, allUser)
+	snapshot := models.PrefetchHoldings(ctx, allUser)
 
 	for _, user := range allClientUser {
-		curStatus, err := models.GetClientUserStatus(ctx, user, foxUserAssetMap[user.UserID], exinUserAssetMap[user.UserID])
+		if ctx.Err() != nil {
+			return nil
+		}
+		now := time.Now()
+		curStatus, err := models.GetClientUserStatus(ctx, user, snapshot)
+		models.MetricAssetCheckDuration.Observe(time.Since(now).Seconds(), "user")
 		if err != nil {
 			session.Logger(ctx).Println(err)
 			if err := models.UpdateClientUserPriorityAndStatus(ctx, user.ClientID, user.UserID, models.ClientUserPriorityLow, models.ClientUserStatusAudience); err != nil {
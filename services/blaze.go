@@ -8,6 +8,7 @@ import (
 	"time"
 
 	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/models"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/fox-one/mixin-sdk-go"
@@ -23,10 +24,17 @@ func (b *BlazeService) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	var wg sync.WaitGroup
 	for _, client := range clientList {
-		go connectMixinSDKClient(ctx, client)
+		wg.Add(1)
+		go func(client *models.Client) {
+			defer wg.Done()
+			connectMixinSDKClient(ctx, client)
+		}(client)
 	}
-	select {}
+	<-ctx.Done()
+	wg.Wait()
+	return nil
 }
 
 type mixinBlazeHandler func(ctx context.Context, msg bot.MessageView, clientID string) error
@@ -45,8 +53,22 @@ func (f mixinBlazeHandler) OnMessage(ctx context.Context, msg bot.MessageView, c
 }
 
 func connectMixinSDKClient(ctx context.Context, c *models.Client) {
-	batchAckMap := newAckMap()
-	go batchAckMsg(ctx, batchAckMap, c.ClientID, c.SessionID, c.PrivateKey)
+	transport, err := durable.NewTransport(&mixin.Keystore{
+		ClientID:   c.ClientID,
+		SessionID:  c.SessionID,
+		PinToken:   c.PinToken,
+		PrivateKey: c.PrivateKey,
+	})
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return
+	}
+	ackDone := make(chan struct{})
+	go func() {
+		batchAckMsg(ctx, transport)
+		close(ackDone)
+	}()
+	defer func() { <-ackDone }()
 	h := func(ctx context.Context, botMsg bot.MessageView, clientID string) error {
 		if botMsg.Category == mixin.MessageCategorySystemConversation {
 			return nil
@@ -64,28 +86,58 @@ func connectMixinSDKClient(ctx context.Context, c *models.Client) {
 			CreatedAt:        botMsg.CreatedAt,
 			UpdatedAt:        botMsg.UpdatedAt,
 		}
-		if botMsg.Category == mixin.MessageCategorySystemAccountSnapshot {
-			if err := models.ReceivedSnapshot(ctx, clientID, &msg); err != nil {
+		// 重新推送的消息只 ack，不再处理；正在处理的消息不 ack，由处理完成的连接 ack
+		state, err := models.ClaimReceivedMessage(ctx, clientID, msg.MessageID)
+		if err != nil {
+			return err
+		}
+		switch state {
+		case models.ReceivedMessageBusy:
+			return nil
+		case models.ReceivedMessageClaimed:
+			if err := receivedMessage(ctx, clientID, &msg); err != nil {
+				if err := models.ReleaseReceivedMessage(ctx, clientID, msg.MessageID); err != nil {
+					session.Logger(ctx).Println(err)
+				}
+				return err
+			}
+			if err := models.FinishReceivedMessage(ctx, clientID, msg.MessageID); err != nil {
 				return err
 			}
-		} else if err := models.ReceivedMessage(ctx, clientID, &msg); err != nil {
-			session.Logger(ctx).Println(err)
-			return err
 		}
-		batchAckMap.set(msg.MessageID)
-		return nil
+		return models.AddPendingAck(ctx, clientID, msg.MessageID)
 	}
 
+	supervisor := newBlazeSupervisor(c.ClientID)
+	go supervisor.report(ctx)
+	listener := supervisedBlazeHandler{mixinBlazeHandler(h), supervisor}
 	for {
-		client := bot.NewBlazeClient(c.ClientID, c.SessionID, c.PrivateKey)
-		if err := client.Loop(ctx, mixinBlazeHandler(h)); err != nil {
-			if !ignoreLoopBlazeError(err) {
-				log.Println("blaze", err)
-			}
+		supervisor.connecting(ctx)
+		err := transport.Loop(ctx, listener)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil && !ignoreLoopBlazeError(err) {
+			log.Println("blaze", c.ClientID, err)
+		}
+		sleepWithContext(ctx, supervisor.disconnected(ctx, err))
+		if ctx.Err() != nil {
+			return
 		}
 	}
 }
 
+func receivedMessage(ctx context.Context, clientID string, msg *mixin.MessageView) error {
+	if msg.Category == mixin.MessageCategorySystemAccountSnapshot {
+		return models.ReceivedSnapshot(ctx, clientID, msg)
+	}
+	if err := models.ReceivedMessage(ctx, clientID, msg); err != nil {
+		session.Logger(ctx).Println(err)
+		return err
+	}
+	return nil
+}
+
 var ignoreMessage = []string{"1006", "timeout", "connection reset by peer"}
 
 func ignoreLoopBlazeError(err error) bool {
@@ -97,55 +149,51 @@ func ignoreLoopBlazeError(err error) bool {
 	return false
 }
 
-func batchAckMsg(ctx context.Context, m *ackMap, uid, sid, key string) {
+// 待 ack 的消息在 redis 中，ctx 取消后再尝试发送一次
+func batchAckMsg(ctx context.Context, transport durable.Transport) {
+	clientID := transport.ClientID()
 	for {
-		if len(m.m) == 0 {
-			time.Sleep(time.Second)
+		msgIDs, err := models.GetPendingAcks(session.Detach(ctx), clientID, 100)
+		if err != nil {
+			session.Logger(ctx).Println(err)
+			if ctx.Err() != nil {
+				return
+			}
+			sleepWithContext(ctx, time.Second)
 			continue
 		}
-		req := make([]*bot.ReceiptAcknowledgementRequest, 0)
-		msgIDs := make([]string, 0)
-		for msgID := range m.m {
+		if len(msgIDs) == 0 {
+			if ctx.Err() != nil {
+				return
+			}
+			sleepWithContext(ctx, time.Second)
+			continue
+		}
+		req := make([]*bot.ReceiptAcknowledgementRequest, 0, len(msgIDs))
+		for _, msgID := range msgIDs {
 			req = append(req, &bot.ReceiptAcknowledgementRequest{
 				MessageId: msgID,
 				Status:    "READ",
 			})
-			msgIDs = append(msgIDs, msgID)
-		}
-		if len(req) > 100 {
-			req = req[0:100]
-			msgIDs = msgIDs[0:100]
 		}
-		if err := bot.PostAcknowledgements(ctx, req, uid, sid, key); err == nil {
-			m.remove(msgIDs)
+		if err := transport.Acknowledge(session.Detach(ctx), req); err == nil {
+			if err := models.RemovePendingAcks(session.Detach(ctx), clientID, msgIDs); err != nil {
+				session.Logger(ctx).Println(err)
+			}
+		} else if ctx.Err() != nil {
+			session.Logger(ctx).Println("ack flush failed, left in redis", len(msgIDs), err)
+			return
 		}
 		if len(req) != 100 {
-			time.Sleep(100 * time.Millisecond)
+			sleepWithContext(ctx, 100*time.Millisecond)
 		}
 	}
 }
 
-type ackMap struct {
-	mutex sync.Mutex
-	m     map[string]bool
-}
-
-func newAckMap() *ackMap {
-	return &ackMap{
-		m: make(map[string]bool),
-	}
-}
-
-func (m *ackMap) set(key string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	m.m[key] = true
-}
-
-func (m *ackMap) remove(keys []string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	for _, key := range keys {
-		delete(m.m, key)
+// 等待 d 或者 ctx 取消
+func sleepWithContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
 	}
 }
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/models"
+	"github.com/MixinNetwork/supergroup/session"
+)
+
+// 连接持续超过这个时间，下次断开时重新从最小间隔开始退避
+const blazeStableTime = time.Minute
+
+// 维护单个机器人的 blaze 连接状态和重连间隔
+type blazeSupervisor struct {
+	mutex   sync.Mutex
+	status  models.BlazeStatus
+	attempt int64
+	backoff time.Duration
+}
+
+func newBlazeSupervisor(clientID string) *blazeSupervisor {
+	return &blazeSupervisor{
+		status:  models.BlazeStatus{ClientID: clientID},
+		backoff: config.BlazeBackoffMin,
+	}
+}
+
+// 开始一次连接，Loop 运行 5 秒没有返回即认为已连接
+func (s *blazeSupervisor) connecting(ctx context.Context) {
+	s.mutex.Lock()
+	s.attempt++
+	attempt := s.attempt
+	s.status.State = models.BlazeStateConnecting
+	s.mutex.Unlock()
+	s.save(ctx)
+	go func() {
+		sleepWithContext(ctx, 5*time.Second)
+		s.mutex.Lock()
+		ok := ctx.Err() == nil && s.attempt == attempt && s.status.State == models.BlazeStateConnecting
+		s.mutex.Unlock()
+		if ok {
+			s.markConnected(ctx)
+		}
+	}()
+}
+
+func (s *blazeSupervisor) markConnected(ctx context.Context) {
+	s.mutex.Lock()
+	if s.status.State == models.BlazeStateConnected {
+		s.mutex.Unlock()
+		return
+	}
+	s.status.State = models.BlazeStateConnected
+	s.status.ConnectedAt = time.Now()
+	s.mutex.Unlock()
+	s.save(ctx)
+}
+
+func (s *blazeSupervisor) received(ctx context.Context) {
+	s.mutex.Lock()
+	s.status.LastMessageAt = time.Now()
+	connected := s.status.State == models.BlazeStateConnected
+	s.mutex.Unlock()
+	if !connected {
+		s.markConnected(ctx)
+	}
+}
+
+// 记录断开并返回下次重连前需要等待的时间
+func (s *blazeSupervisor) disconnected(ctx context.Context, err error) time.Duration {
+	s.mutex.Lock()
+	now := time.Now()
+	if s.status.State == models.BlazeStateConnected && now.Sub(s.status.ConnectedAt) > blazeStableTime {
+		s.backoff = config.BlazeBackoffMin
+	}
+	if s.status.State != models.BlazeStateDisconnected {
+		s.status.DisconnectedAt = now
+	}
+	backoff := s.backoff
+	s.backoff *= 2
+	if s.backoff > config.BlazeBackoffMax {
+		s.backoff = config.BlazeBackoffMax
+	}
+	s.status.State = models.BlazeStateDisconnected
+	s.status.Reconnects++
+	s.status.Backoff = int64(backoff / time.Second)
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+	s.mutex.Unlock()
+	s.save(ctx)
+	models.MetricBlazeReconnects.Inc(s.status.ClientID)
+	return backoff
+}
+
+// 定时写入状态，监控据此判断 blaze 服务是否存活
+func (s *blazeSupervisor) report(ctx context.Context) {
+	for {
+		sleepWithContext(ctx, 10*time.Second)
+		if ctx.Err() != nil {
+			return
+		}
+		s.save(ctx)
+	}
+}
+
+func (s *blazeSupervisor) save(ctx context.Context) {
+	s.mutex.Lock()
+	status := s.status
+	s.mutex.Unlock()
+	if err := models.SaveBlazeStatus(session.Detach(ctx), &status); err != nil {
+		session.Logger(ctx).Println(err)
+	}
+}
+
+// 收到任何消息都更新连接状态
+type supervisedBlazeHandler struct {
+	mixinBlazeHandler
+	supervisor *blazeSupervisor
+}
+
+func (h supervisedBlazeHandler) OnAckReceipt(ctx context.Context, msg bot.MessageView, clientID string) error {
+	h.supervisor.received(ctx)
+	return h.mixinBlazeHandler.OnAckReceipt(ctx, msg, clientID)
+}
+
+func (h supervisedBlazeHandler) OnMessage(ctx context.Context, msg bot.MessageView, clientID string) error {
+	h.supervisor.received(ctx)
+	return h.mixinBlazeHandler.OnMessage(ctx, msg, clientID)
+}
@@ -7,20 +7,15 @@ import (
 	"sync"
 	"time"
 
+	"github.com/MixinNetwork/supergroup/config"
 	"github.com/MixinNetwork/supergroup/models"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/MixinNetwork/supergroup/tools"
-	"github.com/fox-one/mixin-sdk-go"
 	"github.com/go-redis/redis/v8"
 )
 
 type CreateDistributeMsgService struct{}
 
-type SafeUpdater struct {
-	mu sync.Mutex
-	v  map[string]time.Time
-}
-
 func (service *CreateDistributeMsgService) Run(ctx context.Context) error {
 	createMutex = tools.NewMutex()
 	list, err := models.GetClientList(ctx)
@@ -30,16 +25,9 @@ func (service *CreateDistributeMsgService) Run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	needReInit = SafeUpdater{v: make(map[string]time.Time)}
-
 	for i, client := range list {
-		needReInit.v[client.ClientID] = time.Now()
 		createMutex.Write(client.ClientID, false)
-		if err := models.InitShardID(ctx, client.ClientID); err != nil {
-			session.Logger(ctx).Println(err)
-		} else {
-			go mutexCreateMsg(ctx, client.ClientID, i)
-		}
+		go mutexCreateMsg(ctx, client.ClientID, i)
 	}
 
 	go func() {
@@ -51,7 +39,14 @@ func (service *CreateDistributeMsgService) Run(ctx context.Context) error {
 	for {
 		msg, err := pubsub.ReceiveMessage(ctx)
 		if err != nil {
-			panic(err)
+			if ctx.Err() != nil {
+				break
+			}
+			session.Logger(ctx).Println(err)
+			pubsub.Close()
+			sleepWithContext(ctx, time.Second)
+			pubsub = session.Redis(ctx).Subscribe(ctx, "create")
+			continue
 		}
 		if msg.Channel == "create" {
 			go mutexCreateMsg(ctx, msg.Payload, 1)
@@ -59,23 +54,14 @@ func (service *CreateDistributeMsgService) Run(ctx context.Context) error {
 			session.Logger(ctx).Println(msg.Channel, msg.Payload)
 		}
 	}
+	pubsub.Close()
+	// 等待正在创建的消息完成
+	createWait.Wait()
+	return nil
 }
 
-func (s *SafeUpdater) Update(ctx context.Context, clientID string, t time.Time) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.v[clientID] = t
-	models.InitShardID(ctx, clientID)
-}
-
-var needReInit SafeUpdater
 var createMutex *tools.Mutex
-
-func reInitShardID(ctx context.Context, clientID string) {
-	if needReInit.v[clientID].Add(time.Hour).Before(time.Now()) {
-		needReInit.Update(ctx, clientID, time.Now())
-	}
-}
+var createWait sync.WaitGroup
 
 func mutexCreateMsg(ctx context.Context, clientID string, i int) {
 	m := createMutex.Read(clientID)
@@ -86,6 +72,8 @@ func mutexCreateMsg(ctx context.Context, clientID string, i int) {
 		return
 	}
 	createMutex.Write(clientID, true)
+	createWait.Add(1)
+	defer createWait.Done()
 	createMsg(ctx, clientID, i)
 	createMutex.Write(clientID, false)
 }
@@ -112,6 +100,9 @@ func cleanClientMsgCount(ctx context.Context) {
 
 func createMsg(ctx context.Context, clientID string, i int) {
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 		min := tools.GetMinuteTime(time.Now())
 		_count, err := session.Redis(ctx).Get(ctx, fmt.Sprintf("client_msg_count:%s:%s", clientID, min)).Int()
 		if err != nil {
@@ -119,89 +110,77 @@ func createMsg(ctx context.Context, clientID string, i int) {
 				session.Logger(ctx).Println(err)
 			}
 		} else {
-			if _count >= 100000 {
-				time.Sleep(time.Duration(tools.GetNextMinuteTime(min)))
+			if _count >= config.GetDistributeRate(clientID).CreateLimit {
+				sleepWithContext(ctx, time.Duration(tools.GetNextMinuteTime(min)))
+				continue
 			}
 		}
-		count := createMsgByPriority(ctx, clientID, models.MessageStatusPending)
+		// 已经开始创建的消息不因退出而中断
+		count, waiting := createMsgByTier(session.Detach(ctx), clientID)
 		if count != 0 {
-			time.Sleep(time.Millisecond * time.Duration(i) * 100)
+			sleepWithContext(ctx, time.Millisecond*time.Duration(i)*100)
 			continue
 		}
-		count = createMsgByPriority(ctx, clientID, models.MessageStatusPrivilege)
-		if count != 0 {
-			time.Sleep(time.Millisecond * time.Duration(i) * 100)
+		if waiting {
+			// 还有梯队在等待延迟
+			sleepWithContext(ctx, time.Second)
 			continue
 		}
-		reInitShardID(ctx, clientID)
 		return
 	}
 }
 
-func createMsgByPriority(ctx context.Context, clientID string, msgStatus int) int {
+// 按梯队顺序创建分发消息，前面的梯队都创建完了才会创建后面的梯队
+func createMsgByTier(ctx context.Context, clientID string) (int, bool) {
 	now := time.Now()
 	msgs, err := models.GetPendingMessageByClientID(ctx, clientID)
 	if err != nil {
 		session.Logger(ctx).Println(err)
-		return 0
+		return 0, false
 	}
 	if len(msgs) == 0 {
-		return 0
+		return 0, false
 	}
+	tiers, err := models.GetClientDeliveryTiers(ctx, clientID)
+	if err != nil {
+		session.Logger(ctx).Println(err)
+		return 0, false
+	}
+	progress := make(map[string]*models.MessageTierProgress, len(msgs))
 	for _, msg := range msgs {
-		status, err := session.Redis(ctx).Get(ctx, "msg_status:"+msg.MessageID).Int()
+		p, err := models.GetMessageTierProgress(ctx, msg.MessageID)
 		if err != nil {
-			if errors.Is(err, redis.Nil) {
-				status = 0
-			} else {
+			session.Logger(ctx).Println(err)
+			return 0, false
+		}
+		if !p.Done && p.Next >= len(tiers) {
+			// 梯队被调整过，剩下的梯队已经不存在了
+			if err := models.FinishMessageTiers(ctx, clientID, msg.MessageID); err != nil {
 				session.Logger(ctx).Println(err)
-				return 0
 			}
+			p.Done = true
 		}
-		if msgStatus == models.MessageStatusPending {
-			// 要创建优先级高的消息
-			if status == 0 {
-				if err := createDistributeMsg(ctx, clientID, models.ClientUserPriorityHigh, msg); err != nil {
-					session.Logger(ctx).Println(err)
-					return 0
-				}
-				tools.PrintTimeDuration(clientID+"创建消息...", now)
-				return 1
-			}
-			if status == models.MessageStatusPrivilege ||
-				status == models.MessageRedisStatusFinished ||
-				status == models.MessageStatusFinished {
-				// 已经创建了优先级高的消息了
+		progress[msg.MessageID] = p
+	}
+	waiting := false
+	for index, tier := range tiers {
+		for _, msg := range msgs {
+			p := progress[msg.MessageID]
+			if p.Done || p.Next != index {
 				continue
 			}
-			session.Logger(ctx).Println("unknown msg status", msgStatus, status)
-		} else if msgStatus == models.MessageStatusPrivilege {
-			// 要创建优先级低的消息了
-			if status == models.MessageStatusPrivilege {
-				if err := createDistributeMsg(ctx, clientID, models.ClientUserPriorityLow, msg); err != nil {
-					session.Logger(ctx).Println(err)
-					return 0
-				}
-				tools.PrintTimeDuration(clientID+"创建消息...", now)
-				return 1
+			if index > 0 && time.Since(p.CreatedAt) < time.Duration(tier.Delay)*time.Second {
+				// 更晚的消息也不会到时间
+				waiting = true
+				break
 			}
-			if status == models.MessageStatusFinished ||
-				status == models.MessageRedisStatusFinished {
-				// 已经创建了优先级低的消息了
-				continue
+			if err := models.CreateDistributeMsgByTier(ctx, clientID, msg, tiers, index); err != nil {
+				session.Logger(ctx).Println(err)
+				return 0, false
 			}
-			session.Logger(ctx).Println("unknown msg status", msgStatus, status) // 2 0
+			tools.PrintTimeDuration(fmt.Sprintf("%s创建消息 %s...", clientID, tier.Name), now)
+			return 1, false
 		}
 	}
-	return 0
-}
-
-func createDistributeMsg(ctx context.Context, clientID string, level int, msg *models.Message) error {
-	return models.CreateDistributeMsgAndMarkStatus(ctx, clientID, &mixin.MessageView{
-		UserID:         msg.UserID,
-		MessageID:      msg.MessageID,
-		Category:       msg.Category,
-		Data:           msg.Data,
-		QuoteMessageID: msg.QuoteMessageID,
-	}, []int{level})
+	return 0, waiting
 }
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"errors"
+	"math/rand"
+
+	"github.com/MixinNetwork/supergroup/models"
+)
+
+// 测试模式下按比例注入发送失败，用来检查分发顺序
+var distributeFaultRate float64
+
+var errInjectedFault = errors.New("injected distribute fault")
+
+func SetDistributeFaultRate(rate float64) {
+	if rate <= 0 {
+		return
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	distributeFaultRate = rate
+	models.EnableDistributeOrderCheck()
+}
+
+func injectFault() bool {
+	return distributeFaultRate > 0 && rand.Float64() < distributeFaultRate
+}
+
+// 模拟部分消息发送成功，剩下的消息之后会用同样的 message_id 重新发送
+func injectPartialDelivered(delivered []string) []string {
+	if !injectFault() || len(delivered) == 0 {
+		return delivered
+	}
+	return delivered[:rand.Intn(len(delivered))]
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/MixinNetwork/supergroup/models"
 	"github.com/MixinNetwork/supergroup/session"
 	"github.com/MixinNetwork/supergroup/tools"
@@ -22,30 +23,46 @@ var distributeMutex *tools.Mutex
 
 var distributeWait map[string]*sync.WaitGroup
 
+var distributeRate map[string]*rateController
+
+// 所有正在运行的分片，退出时等待它们结束
+var distributeShards sync.WaitGroup
+
 func (service *DistributeMessageService) Run(ctx context.Context) error {
 	distributeMutex = tools.NewMutex()
 	distributeWait = make(map[string]*sync.WaitGroup)
+	distributeRate = make(map[string]*rateController)
 	go mixin.UseAutoFasterRoute()
 	go models.CacheAllBlockUser()
 
 	for _, clientID := range config.Config.ClientList {
 		distributeMutex.Write(clientID, false)
 		distributeWait[clientID] = &sync.WaitGroup{}
+		distributeRate[clientID] = newRateController(clientID)
 		go startDistributeMessageByClientID(ctx, clientID)
 	}
 
-	// 每天删除过期的大群消息
+	// 每天按保存时间清理数据，并提前创建之后月份的分区
 	go func() {
 		for {
-			time.Sleep(time.Hour * 24)
-			if err := models.RemoveOvertimeDistributeMessages(ctx); err != nil {
+			sleepWithContext(ctx, time.Hour*24)
+			if ctx.Err() != nil {
+				return
+			}
+			if err := models.EnsureMonthlyPartitions(ctx); err != nil {
+				session.Logger(ctx).Println(err)
+			}
+			if err := models.RemoveOvertimeData(ctx); err != nil {
 				session.Logger(ctx).Println(err)
 			}
 		}
 	}() // 每秒重试未完成的消息服务
 	go func() {
 		for {
-			time.Sleep(time.Second)
+			sleepWithContext(ctx, time.Second)
+			if ctx.Err() != nil {
+				return
+			}
 			if err := startDistributeMessageIfUnfinished(ctx); err != nil {
 				session.Logger(ctx).Println(err)
 			}
@@ -55,6 +72,9 @@ func (service *DistributeMessageService) Run(ctx context.Context) error {
 	for {
 		msg, err := pubsub.ReceiveMessage(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			pubsub = session.Redis(ctx).Subscribe(ctx, "distribute")
 			session.Logger(ctx).Println(err)
 			continue
@@ -65,6 +85,10 @@ func (service *DistributeMessageService) Run(ctx context.Context) error {
 			session.Logger(ctx).Println(msg.Channel, msg.Payload)
 		}
 	}
+	pubsub.Close()
+	// 等待所有分片把正在发送的消息发完
+	distributeShards.Wait()
+	return nil
 }
 
 func startDistributeMessageIfUnfinished(ctx context.Context) error {
@@ -85,7 +109,7 @@ func startDistributeMessageIfUnfinished(ctx context.Context) error {
 	for clientID := range cs {
 		go startDistributeMessageByClientID(ctx, clientID)
 	}
-	time.Sleep(time.Second * 10)
+	sleepWithContext(ctx, time.Second*10)
 	return nil
 }
 
@@ -99,7 +123,7 @@ func startDistributeMessageByClientID(ctx context.Context, clientID string) {
 		session.Logger(ctx).Println(err)
 		return
 	}
-	mixinClient, err := mixin.NewFromKeystore(&mixin.Keystore{
+	transport, err := durable.NewTransport(&mixin.Keystore{
 		ClientID:   client.ClientID,
 		SessionID:  client.SessionID,
 		PrivateKey: client.PrivateKey,
@@ -112,15 +136,22 @@ func startDistributeMessageByClientID(ctx context.Context, clientID string) {
 	distributeMutex.Write(client.ClientID, true)
 	for i := 0; i < int(config.MessageShardSize); i++ {
 		distributeWait[client.ClientID].Add(1)
-		go pendingActiveDistributedMessages(ctx, mixinClient, i, client.PrivateKey)
+		distributeShards.Add(1)
+		go func(i int) {
+			defer distributeShards.Done()
+			defer distributeWait[client.ClientID].Done()
+			pendingActiveDistributedMessages(ctx, transport, i, client.PrivateKey)
+		}(i)
 	}
 	distributeWait[client.ClientID].Wait()
 	distributeMutex.Write(client.ClientID, false)
 }
 
-func pendingActiveDistributedMessages(ctx context.Context, client *mixin.Client, i int, pk string) {
+// ctx 取消后，发送完当前这一批消息再返回
+func pendingActiveDistributedMessages(ctx context.Context, client durable.Transport, i int, pk string) {
 	// 发送消息
 	shardID := strconv.Itoa(i)
+	batchCtx := session.Detach(ctx)
 	isEncrypted := false
 	if config.Config.Encrypted {
 		me, err := client.UserMe(ctx)
@@ -135,38 +166,64 @@ func pendingActiveDistributedMessages(ctx context.Context, client *mixin.Client,
 		}
 	}
 	for {
-		messages, msgOriginMsgIDMap, err := models.PendingActiveDistributedMessages(ctx, client.ClientID, shardID)
+		if ctx.Err() != nil {
+			return
+		}
+		messages, msgOriginMsgIDMap, err := models.PendingActiveDistributedMessages(ctx, client.ClientID(), shardID)
 		if err != nil {
 			session.Logger(ctx).Println("PendingActiveDistributedMessages ERROR:", err)
-			time.Sleep(time.Duration(i) * time.Millisecond * 100)
+			sleepWithContext(ctx, time.Duration(i)*time.Millisecond*100)
 			continue
 		}
 		if len(messages) < 1 {
-			distributeWait[client.ClientID].Done()
 			return
 		}
+		messages, err = models.SkipQuietDistributeMessages(batchCtx, client.ClientID(), shardID, messages, msgOriginMsgIDMap)
+		if err != nil {
+			session.Logger(ctx).Println("SkipQuietDistributeMessages ERROR:", err)
+			sleepWithContext(ctx, time.Duration(i)*time.Millisecond*100)
+			continue
+		}
+		if len(messages) < 1 {
+			continue
+		}
 		messages = handleMsg(messages)
+		limiter := distributeRate[client.ClientID()]
+		if !limiter.wait(ctx, len(messages)) {
+			return
+		}
 		now := time.Now()
 		if isEncrypted {
-			err = handleEncryptedDistributeMsg(ctx, client, messages, pk, shardID, msgOriginMsgIDMap)
+			err = handleEncryptedDistributeMsg(batchCtx, client, limiter, messages, pk, shardID, msgOriginMsgIDMap)
 		} else {
-			err = handleNormalDistributeMsg(ctx, client, messages, shardID, msgOriginMsgIDMap)
+			err = handleNormalDistributeMsg(batchCtx, client, limiter, messages, shardID, msgOriginMsgIDMap)
 		}
+		models.MetricSendDuration.Observe(time.Since(now).Seconds(), client.ClientID())
 		if err != nil {
 			session.Logger(ctx).Println("PendingActiveDistributedMessages sendDistributedMessges ERROR:", err)
-			time.Sleep(time.Duration(i) * time.Millisecond * 100)
+			sleepWithContext(ctx, time.Duration(i)*time.Millisecond*100)
 			continue
 		}
-		tools.PrintTimeDuration(fmt.Sprintf("%s:%s:msg send %d...", client.ClientID, shardID, len(messages)), now)
+		tools.PrintTimeDuration(fmt.Sprintf("%s:%s:msg send %d (%.0f/s)...", client.ClientID(), shardID, len(messages), limiter.currentRate()), now)
 	}
 }
 
-func handleEncryptedDistributeMsg(ctx context.Context, client *mixin.Client, messages []*mixin.MessageRequest, pk, shardID string, msgOriginMsgIDMap map[string]*models.DistributeMessage) error {
-	var delivered []string
-	results, err := models.SendEncryptedMessage(ctx, pk, client, messages)
+func handleEncryptedDistributeMsg(ctx context.Context, client durable.Transport, limiter *rateController, messages []*mixin.MessageRequest, pk, shardID string, msgOriginMsgIDMap map[string]*models.DistributeMessage) error {
+	if injectFault() {
+		return errInjectedFault
+	}
+	body, err := models.BuildEncryptedMessages(ctx, pk, client, messages)
 	if err != nil {
 		return err
 	}
+	// 速率控制只统计接口的耗时和结果
+	start := time.Now()
+	results, err := models.SendEncryptedMessage(ctx, client, body)
+	limiter.observe(time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	var delivered []string
 	var sessions []*models.Session
 	for _, m := range results {
 		if m.State == "SUCCESS" {
@@ -182,26 +239,36 @@ func handleEncryptedDistributeMsg(ctx context.Context, client *mixin.Client, mes
 			}
 		}
 	}
-	if err := models.UpdateDistributeMessagesStatusToFinished(ctx, client.ClientID, shardID, delivered, msgOriginMsgIDMap); err != nil {
+	delivered = injectPartialDelivered(delivered)
+	if err := models.UpdateDistributeMessagesStatusToFinished(ctx, client.ClientID(), shardID, delivered, msgOriginMsgIDMap); err != nil {
 		return err
 	}
-	if err := models.SyncSession(ctx, client.ClientID, sessions); err != nil {
+	models.MetricMessagesSent.Add(float64(len(delivered)), client.ClientID())
+	if err := models.SyncSession(ctx, client.ClientID(), sessions); err != nil {
 		return err
 	}
 	return nil
 }
 
-func handleNormalDistributeMsg(ctx context.Context, client *mixin.Client, messages []*mixin.MessageRequest, shardID string, msgOriginMsgIDMap map[string]*models.DistributeMessage) error {
-	if err := models.SendMessages(ctx, client, messages); err != nil {
+func handleNormalDistributeMsg(ctx context.Context, client durable.Transport, limiter *rateController, messages []*mixin.MessageRequest, shardID string, msgOriginMsgIDMap map[string]*models.DistributeMessage) error {
+	if injectFault() {
+		return errInjectedFault
+	}
+	start := time.Now()
+	err := models.SendDistributeMessages(ctx, client, messages)
+	limiter.observe(time.Since(start), err)
+	if err != nil {
 		return err
 	}
 	var delivered []string
 	for _, v := range messages {
 		delivered = append(delivered, v.MessageID)
 	}
-	if err := models.UpdateDistributeMessagesStatusToFinished(ctx, client.ClientID, shardID, delivered, msgOriginMsgIDMap); err != nil {
+	delivered = injectPartialDelivered(delivered)
+	if err := models.UpdateDistributeMessagesStatusToFinished(ctx, client.ClientID(), shardID, delivered, msgOriginMsgIDMap); err != nil {
 		return err
 	}
+	models.MetricMessagesSent.Add(float64(len(delivered)), client.ClientID())
 	return nil
 }
 
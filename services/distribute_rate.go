@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/models"
+)
+
+// 同一个社群的所有分片共用一个发送速率控制器
+// 批次耗时正常时线性增加速率，耗时过长或被限流时按比例降低速率 (AIMD)
+type rateController struct {
+	mutex       sync.Mutex
+	conf        config.DistributeRate
+	rate        float64   // 当前每秒允许发送的条数
+	next        time.Time // 下一批消息最早可以发送的时间
+	decreasedAt time.Time
+}
+
+func newRateController(clientID string) *rateController {
+	conf := config.GetDistributeRate(clientID)
+	return &rateController{conf: conf, rate: conf.Initial}
+}
+
+// 按照当前速率为 n 条消息预留发送时间，需要时等待，ctx 取消时返回 false
+func (r *rateController) wait(ctx context.Context, n int) bool {
+	r.mutex.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	start := r.next
+	r.next = r.next.Add(time.Duration(float64(n) / r.rate * float64(time.Second)))
+	r.mutex.Unlock()
+	sleepWithContext(ctx, time.Until(start))
+	return ctx.Err() == nil
+}
+
+// 根据一批消息的发送耗时和结果调整速率
+func (r *rateController) observe(latency time.Duration, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	target := time.Duration(r.conf.TargetLatency) * time.Millisecond
+	throttled := models.IsRateLimitError(err)
+	if throttled || (err == nil && latency > target) {
+		// 多个分片会同时观察到同一次拥塞，一个目标耗时内只降速一次
+		if time.Since(r.decreasedAt) < target {
+			return
+		}
+		r.decreasedAt = time.Now()
+		r.rate = math.Max(r.conf.Min, r.rate*r.conf.Decrease)
+		if throttled {
+			// 被限流后所有分片暂停一个目标耗时
+			r.next = time.Now().Add(target)
+		}
+		return
+	}
+	if err == nil {
+		r.rate = math.Min(r.conf.Max, r.rate+r.conf.Increase)
+	}
+}
+
+func (r *rateController) currentRate() float64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.rate
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/MixinNetwork/supergroup/models"
+	"github.com/MixinNetwork/supergroup/session"
+)
+
+type ExportService struct{}
+
+// 命令行指定了社群时只导出这一次，否则持续执行管理员创建的导出任务
+var exportOnce *models.MessageExport
+
+func SetExportOnce(clientID, format, start, end string) error {
+	if clientID == "" {
+		return nil
+	}
+	e := models.MessageExport{ClientID: clientID, Format: format, CreatedBy: "cli"}
+	var err error
+	if e.StartAt, err = time.Parse("2006-01-02", start); err != nil {
+		return fmt.Errorf("invalid export start: %s", start)
+	}
+	e.EndAt = time.Now()
+	if end != "" {
+		if e.EndAt, err = time.Parse("2006-01-02", end); err != nil {
+			return fmt.Errorf("invalid export end: %s", end)
+		}
+	}
+	exportOnce = &e
+	return nil
+}
+
+func (service *ExportService) Run(ctx context.Context) error {
+	if exportOnce != nil {
+		e, err := models.CreateMessageExport(ctx, exportOnce)
+		if err != nil {
+			return err
+		}
+		if err := models.RunMessageExport(ctx, e); err != nil {
+			return err
+		}
+		if err := saveExportOnceFile(ctx, e); err != nil {
+			return err
+		}
+		session.Logger(ctx).Println("export finished", e.FileName, e.Count)
+		return nil
+	}
+	cleanAt := time.Time{}
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := models.ResetStaleMessageExports(ctx); err != nil {
+			session.Logger(ctx).Println(err)
+		}
+		if time.Since(cleanAt) > time.Hour {
+			if err := models.RemoveOvertimeMessageExports(ctx); err != nil {
+				session.Logger(ctx).Println(err)
+			}
+			cleanAt = time.Now()
+		}
+		e, err := models.ClaimMessageExport(ctx)
+		if err != nil {
+			session.Logger(ctx).Println(err)
+		} else if e != nil {
+			if err := models.RunMessageExport(ctx, e); err != nil {
+				session.Logger(ctx).Println("export error...", e.ExportID, err)
+			}
+			continue
+		}
+		sleepWithContext(ctx, 10*time.Second)
+	}
+}
+
+// 命令行导出时同时保存到当前目录
+func saveExportOnceFile(ctx context.Context, e *models.MessageExport) error {
+	f, err := os.Create(e.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return models.CopyMessageExportFile(ctx, e.ExportID, f)
+}
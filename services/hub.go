@@ -3,8 +3,12 @@ package services
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/models"
 	"github.com/MixinNetwork/supergroup/session"
 )
 
@@ -13,6 +17,9 @@ type Hub struct {
 	services map[string]Service
 }
 
+// -service all 时启动的常驻服务
+var longRunningServices = []string{"blaze", "create_message", "distribute_message", "assets_check", "swap", "export"}
+
 func NewHub(db *durable.Database, redis *durable.Redis) *Hub {
 	hub := &Hub{services: make(map[string]Service)}
 	hub.context = session.WithDatabase(context.Background(), db)
@@ -31,6 +38,64 @@ func (hub *Hub) StartService(name string) error {
 	return service.Run(hub.context)
 }
 
+// 在同一个进程中运行多个服务，names 用逗号分隔或者为 all
+// ctx 取消后等待所有服务退出；常驻服务出错退出时，5 秒后重新启动
+func (hub *Hub) StartServices(ctx context.Context, names string) error {
+	list := strings.Split(names, ",")
+	if names == "all" {
+		list = longRunningServices
+	}
+	for _, name := range list {
+		if hub.services[name] == nil {
+			return fmt.Errorf("no service found: %s", name)
+		}
+	}
+	ctx = session.WithDatabase(ctx, session.Database(hub.context))
+	ctx = session.WithRedis(ctx, session.Redis(hub.context))
+
+	var wg sync.WaitGroup
+	for _, name := range list {
+		wg.Add(1)
+		go func(name string, service Service) {
+			defer wg.Done()
+			for {
+				err := service.Run(ctx)
+				if ctx.Err() != nil {
+					session.Logger(ctx).Println("service stopped", name)
+					return
+				}
+				if err == nil {
+					session.Logger(ctx).Println("service finished", name)
+					return
+				}
+				if !isLongRunningService(name) {
+					session.Logger(ctx).Println("service error...", name, err)
+					return
+				}
+				session.Logger(ctx).Println("service error, restarting...", name, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(5 * time.Second):
+				}
+			}
+		}(name, hub.services[name])
+	}
+	wg.Wait()
+	// 退出前写入还在队列中的消息对应关系
+	models.FlushMessageMapping()
+	return nil
+}
+
+func isLongRunningService(name string) bool {
+	for _, n := range longRunningServices {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (hub *Hub) registerServices() {
 	hub.services["scan"] = &ScanService{}
 	hub.services["distribute_message"] = &DistributeMessageService{}
@@ -42,4 +107,6 @@ func (hub *Hub) registerServices() {
 	hub.services["update_lp_check"] = &UpdateLpCheckService{}
 	hub.services["migration"] = &MigrationService{}
 	hub.services["airdrop"] = &AirdropService{}
+	hub.services["export"] = &ExportService{}
+	hub.services["partition"] = &PartitionService{}
 }
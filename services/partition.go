@@ -0,0 +1,14 @@
+package services
+
+import (
+	"context"
+
+	"github.com/MixinNetwork/supergroup/models"
+)
+
+// 把已有的 messages 和 distribute_messages 转换为按月分区的表，只需要执行一次
+type PartitionService struct{}
+
+func (service *PartitionService) Run(ctx context.Context) error {
+	return models.MigrateToPartitionedTables(ctx)
+}
@@ -0,0 +1,254 @@
+//go:build integration
+// +build integration
+
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	bot "github.com/MixinNetwork/bot-api-go-client"
+	"github.com/MixinNetwork/supergroup/config"
+	"github.com/MixinNetwork/supergroup/durable"
+	"github.com/MixinNetwork/supergroup/models"
+	"github.com/MixinNetwork/supergroup/session"
+	"github.com/MixinNetwork/supergroup/tools"
+	"github.com/fox-one/mixin-sdk-go"
+)
+
+// 需要本地的 Postgres 和 Redis，见 README 中的测试说明
+// SUPERGROUP_CONFIG=$PWD/config.json go test -tags integration ./services
+
+type testGroup struct {
+	ClientID string
+	AdminID  string
+	Members  []string
+}
+
+// 创建一个社群，一个管理员和 n 个高优先级的成员，入群时间在一小时前
+func createTestGroup(ctx context.Context, t *testing.T, n int) *testGroup {
+	t.Helper()
+	g := &testGroup{ClientID: tools.GetUUID(), AdminID: tools.GetUUID()}
+	privateKey := base64.RawURLEncoding.EncodeToString(mixin.GenerateEd25519Key())
+	db := session.Database(ctx)
+	if _, err := db.Exec(ctx, `
+INSERT INTO client(client_id,client_secret,session_id,pin_token,private_key,name,description,host,asset_id,owner_id,speak_status)
+VALUES($1,'',$2,'',$3,'test','test',$1,'',$4,$5)
+`, g.ClientID, tools.GetUUID(), privateKey, g.AdminID, models.ClientSpeckStatusClose); err != nil {
+		t.Fatal(err)
+	}
+	joinedAt := time.Now().Add(-time.Hour)
+	users := map[string]int{g.AdminID: models.ClientUserStatusAdmin}
+	for i := 0; i < n; i++ {
+		userID := tools.GetUUID()
+		g.Members = append(g.Members, userID)
+		users[userID] = models.ClientUserStatusFresh
+	}
+	for userID, status := range users {
+		if _, err := db.Exec(ctx, `
+INSERT INTO client_users(client_id,user_id,access_token,priority,status,created_at,read_at)
+VALUES($1,$2,'',$3,$4,$5,$5)
+`, g.ClientID, userID, models.ClientUserPriorityHigh, status, joinedAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ctx = session.WithDatabase(ctx, db)
+		if _, err := db.Exec(ctx, `
+DELETE FROM message_mapping WHERE origin_message_id IN (SELECT origin_message_id FROM message_mapping_origin WHERE client_id=$1)
+`, g.ClientID); err != nil {
+			t.Log(err)
+		}
+		for _, table := range []string{"client", "client_users", "messages", "distribute_messages", "message_mapping_origin"} {
+			if _, err := db.Exec(ctx, "DELETE FROM "+table+" WHERE client_id=$1", g.ClientID); err != nil {
+				t.Log(table, err)
+			}
+		}
+	})
+	return g
+}
+
+func startTestServices(t *testing.T, clientID, names string) (*Hub, context.CancelFunc) {
+	t.Helper()
+	durable.UseFakeTransport()
+	config.Config.ClientList = []string{clientID}
+	ctx := context.Background()
+	hub := NewHub(durable.NewDatabase(ctx), durable.NewRedis(ctx))
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		_ = hub.StartServices(ctx, names)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Error("services did not stop")
+		}
+	})
+	// 等待服务订阅 redis 的 create 和 distribute
+	time.Sleep(2 * time.Second)
+	return hub, cancel
+}
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return cond()
+}
+
+// 管理员发给机器人的消息经过 blaze、create_message、distribute_message 发给所有成员
+func TestBlazeCreateDistributeWithFakeTransport(t *testing.T) {
+	ctx := context.Background()
+	db := durable.NewDatabase(ctx)
+	ctx = session.WithDatabase(ctx, db)
+	g := createTestGroup(ctx, t, 3)
+	startTestServices(t, g.ClientID, "blaze,create_message,distribute_message")
+
+	fake := durable.GetFakeTransport(g.ClientID)
+	msgID := tools.GetUUID()
+	text := "integration test " + msgID
+	fake.Deliver(bot.MessageView{
+		ConversationId: mixin.UniqueConversationID(g.ClientID, g.AdminID),
+		UserId:         g.AdminID,
+		MessageId:      msgID,
+		Category:       mixin.MessageCategoryPlainText,
+		Data:           base64.StdEncoding.EncodeToString([]byte(text)),
+		Status:         "SENT",
+		CreatedAt:      time.Now(),
+	})
+
+	received := make(map[string]int)
+	ok := waitFor(t, 30*time.Second, func() bool {
+		received = make(map[string]int)
+		for _, m := range fake.SentMessages() {
+			if m.Category == mixin.MessageCategoryPlainText && string(tools.Base64Decode(m.Data)) == text {
+				received[m.RecipientID]++
+			}
+		}
+		return len(received) == len(g.Members)
+	})
+	if !ok {
+		t.Fatalf("expected %d recipients, got %v", len(g.Members), received)
+	}
+	for _, userID := range g.Members {
+		if received[userID] != 1 {
+			t.Fatalf("member %s received %d copies", userID, received[userID])
+		}
+	}
+	if received[g.AdminID] != 0 {
+		t.Fatal("sender should not receive its own message")
+	}
+	for _, m := range fake.SentMessages() {
+		if received[m.RecipientID] > 0 && m.RepresentativeID != g.AdminID {
+			t.Fatalf("copy to %s is not sent on behalf of the admin", m.RecipientID)
+		}
+	}
+
+	acked := waitFor(t, 10*time.Second, func() bool {
+		for _, a := range fake.AckedMessages() {
+			if a.MessageId == msgID {
+				return true
+			}
+		}
+		return false
+	})
+	if !acked {
+		t.Fatal("received message was not acked")
+	}
+}
+
+// 发送时随机整批失败，每个成员仍按原消息的顺序收到，按实际发出的顺序检查
+func TestDistributeOrderWithSendFailures(t *testing.T) {
+	ctx := context.Background()
+	db := durable.NewDatabase(ctx)
+	ctx = session.WithDatabase(ctx, db)
+	g := createTestGroup(ctx, t, 5)
+	startTestServices(t, g.ClientID, "blaze,create_message,distribute_message")
+
+	fake := durable.GetFakeTransport(g.ClientID)
+	stop := make(chan struct{})
+	faultDone := make(chan struct{})
+	go func() {
+		defer close(faultDone)
+		errInjected := errors.New("injected send failure")
+		for {
+			select {
+			case <-stop:
+				fake.SetSendError(nil)
+				return
+			case <-time.After(time.Duration(10+rand.Intn(40)) * time.Millisecond):
+				if rand.Intn(3) == 0 {
+					fake.SetSendError(errInjected)
+				} else {
+					fake.SetSendError(nil)
+				}
+			}
+		}
+	}()
+
+	const total = 20
+	prefix := "order " + tools.GetUUID() + " "
+	base := time.Now()
+	for i := 0; i < total; i++ {
+		fake.Deliver(bot.MessageView{
+			ConversationId: mixin.UniqueConversationID(g.ClientID, g.AdminID),
+			UserId:         g.AdminID,
+			MessageId:      tools.GetUUID(),
+			Category:       mixin.MessageCategoryPlainText,
+			Data:           base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s%03d", prefix, i))),
+			Status:         "SENT",
+			CreatedAt:      base.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+
+	// 每个成员第一次收到每条消息的顺序
+	orders := make(map[string][]int)
+	ok := waitFor(t, 90*time.Second, func() bool {
+		orders = make(map[string][]int)
+		seen := make(map[string]bool)
+		for _, m := range fake.SentMessages() {
+			text := string(tools.Base64Decode(m.Data))
+			if !strings.HasPrefix(text, prefix) || seen[m.MessageID] {
+				continue
+			}
+			seen[m.MessageID] = true
+			i, _ := strconv.Atoi(strings.TrimPrefix(text, prefix))
+			orders[m.RecipientID] = append(orders[m.RecipientID], i)
+		}
+		for _, userID := range g.Members {
+			if len(orders[userID]) < total {
+				return false
+			}
+		}
+		return true
+	})
+	close(stop)
+	<-faultDone
+	if !ok {
+		t.Fatalf("not all messages were delivered: %v", orders)
+	}
+	for _, userID := range g.Members {
+		for i, n := range orders[userID] {
+			if n != i {
+				t.Fatalf("member %s received messages out of order: %v", userID, orders[userID])
+			}
+		}
+	}
+}
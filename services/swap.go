@@ -20,7 +20,10 @@ func (service *SwapService) Run(ctx context.Context) error {
 		updateExinList(ctx)
 		updateFoxSwapList(ctx)
 		updateExinOtc(ctx)
-		time.Sleep(time.Minute * 5)
+		sleepWithContext(ctx, time.Minute*5)
+		if ctx.Err() != nil {
+			return nil
+		}
 	}
 }
 
@@ -3,6 +3,7 @@ package session
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/MixinNetwork/supergroup/durable"
 	"github.com/dgrijalva/jwt-go"
@@ -113,3 +114,19 @@ func WithAuthorizationInfo(ctx context.Context, tokenString string) context.Cont
 	})
 	return context.WithValue(ctx, keyAuthorizationInfo, value)
 }
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// 保留 ctx 中的数据库、redis 等，但不会被取消，用于退出前把进行中的任务做完
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
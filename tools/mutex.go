@@ -7,14 +7,16 @@ import (
 
 type Mutex struct {
 	*sync.Mutex
-	cleanTimer *time.Timer
-	V          map[string]interface{}
+	V map[string]interface{}
+	// 每个 key 单独的过期时间，Read 时检查
+	expires map[string]time.Time
 }
 
 func NewMutex() *Mutex {
 	m := new(Mutex)
 	m.Mutex = new(sync.Mutex)
 	m.V = make(map[string]interface{})
+	m.expires = make(map[string]time.Time)
 	return m
 }
 
@@ -22,11 +24,17 @@ func (m *Mutex) Write(key string, v interface{}) {
 	m.Lock()
 	defer m.Unlock()
 	m.V[key] = v
+	delete(m.expires, key)
 }
 
 func (m *Mutex) Read(key string) interface{} {
 	m.Lock()
 	defer m.Unlock()
+	if t, ok := m.expires[key]; ok && !time.Now().Before(t) {
+		delete(m.V, key)
+		delete(m.expires, key)
+		return nil
+	}
 	return m.V[key]
 }
 
@@ -35,15 +43,13 @@ func (m *Mutex) Delete(key string) interface{} {
 	defer m.Unlock()
 	v := m.V[key]
 	delete(m.V, key)
+	delete(m.expires, key)
 	return v
 }
 
 func (m *Mutex) WriteWithTTL(key string, v interface{}, ttl time.Duration) {
-	m.Write(key, v)
-	if m.cleanTimer != nil {
-		m.cleanTimer.Stop()
-	}
-	m.cleanTimer = time.AfterFunc(ttl, func() {
-		m.Delete(key)
-	})
+	m.Lock()
+	defer m.Unlock()
+	m.V[key] = v
+	m.expires[key] = time.Now().Add(ttl)
 }
@@ -0,0 +1,29 @@
+package tools
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMutexWriteWithTTLPerKey(t *testing.T) {
+	m := NewMutex()
+	m.WriteWithTTL("a", 1, 20*time.Millisecond)
+	m.WriteWithTTL("b", 2, time.Hour)
+	m.Write("c", 3)
+	time.Sleep(30 * time.Millisecond)
+	if v := m.Read("a"); v != nil {
+		t.Fatalf("a should expire, got %v", v)
+	}
+	if v := m.Read("b"); v != 2 {
+		t.Fatalf("b should not expire, got %v", v)
+	}
+	if v := m.Read("c"); v != 3 {
+		t.Fatalf("c has no ttl, got %v", v)
+	}
+	m.WriteWithTTL("c", 4, 20*time.Millisecond)
+	m.Write("c", 5)
+	time.Sleep(30 * time.Millisecond)
+	if v := m.Read("c"); v != 5 {
+		t.Fatalf("Write should clear the ttl, got %v", v)
+	}
+}